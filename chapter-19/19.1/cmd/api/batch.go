@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"greelight.techkunstler.com/internal/validator"
+)
+
+// A batchItemResult describes the outcome of processing a single item in a batch
+// request made in partial mode. Status is the HTTP status code the item would have got
+// if it had been sent on its own, and exactly one of Resource or Error is set.
+type batchItemResult struct {
+	Index    int `json:"index"`
+	Status   int `json:"status"`
+	Resource any `json:"resource,omitempty"`
+	Error    any `json:"error,omitempty"`
+}
+
+// The readPartialParam() helper reads the opt-in ?partial= query string parameter used
+// by batch endpoints, like POST /v1/movies/batch. When true, each item is processed
+// independently and the response lists per-item results, rather than the whole batch
+// succeeding or failing together. Invalid values are recorded in the provided Validator
+// instance.
+
+func (app *application) readPartialParam(qs url.Values, v *validator.Validator) bool {
+	return app.readBool(qs, "partial", false, v)
+}
+
+// The processBatch() helper calls fn for each of the n items in a batch, independently
+// of one another, and collects the results in order. A failure processing one item
+// doesn't stop the others from being processed.
+
+func (app *application) processBatch(n int, fn func(i int) batchItemResult) []batchItemResult {
+	results := make([]batchItemResult, n)
+
+	for i := range n {
+		results[i] = fn(i)
+		results[i].Index = i
+	}
+
+	return results
+}
+
+// The writeMultiStatus() helper sends the per-item results of a partial batch request
+// with a 207 Multi-Status status code, along with a summary of how many items
+// succeeded and failed.
+
+func (app *application) writeMultiStatus(w http.ResponseWriter, r *http.Request, results []batchItemResult) {
+	succeeded := 0
+	for _, result := range results {
+		if result.Status < http.StatusBadRequest {
+			succeeded++
+		}
+	}
+
+	env := envelope{
+		"results": results,
+		"summary": map[string]int{
+			"total":     len(results),
+			"succeeded": succeeded,
+			"failed":    len(results) - succeeded,
+		},
+	}
+
+	err := app.writeJSON(w, http.StatusMultiStatus, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
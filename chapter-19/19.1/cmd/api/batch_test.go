@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"greelight.techkunstler.com/internal/data"
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestProcessBatchPartial(t *testing.T) {
+	app := newTestApplication(t)
+
+	movies := []*data.Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		{Title: "", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		{Title: "Up", Year: 2009, Runtime: 96, Genres: []string{"animation"}},
+	}
+
+	// Validate each movie independently, so the invalid one in the middle doesn't stop
+	// the others from succeeding.
+	results := app.processBatch(len(movies), func(i int) batchItemResult {
+		v := validator.New()
+		if data.ValidateMovie(v, movies[i]); !v.Valid() {
+			return batchItemResult{Status: http.StatusUnprocessableEntity, Error: v.Errors}
+		}
+		return batchItemResult{Status: http.StatusCreated, Resource: movies[i]}
+	})
+
+	wantStatus := []int{http.StatusCreated, http.StatusUnprocessableEntity, http.StatusCreated}
+
+	for i, result := range results {
+		if result.Index != i {
+			t.Errorf("result %d: got index %d", i, result.Index)
+		}
+		if result.Status != wantStatus[i] {
+			t.Errorf("result %d: got status %d; want %d", i, result.Status, wantStatus[i])
+		}
+	}
+
+	r, err := http.NewRequest(http.MethodPost, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.writeMultiStatus(w, r, results)
+	})
+
+	code, _, body := execute(t, handler, r)
+	if code != http.StatusMultiStatus {
+		t.Fatalf("got status %d; want %d", code, http.StatusMultiStatus)
+	}
+
+	summary, _ := decodeJSON(t, body)["summary"].(map[string]any)
+	if summary["succeeded"] != 2.0 || summary["failed"] != 1.0 {
+		t.Errorf("got summary %v; want 2 succeeded and 1 failed", summary)
+	}
+}
+
+func TestReadPartialParam(t *testing.T) {
+	app := newTestApplication(t)
+
+	v := validator.New()
+	if !app.readPartialParam(url.Values{"partial": {"true"}}, v) {
+		t.Error("got false for partial=true")
+	}
+	if app.readPartialParam(url.Values{}, v) {
+		t.Error("got true when partial is absent")
+	}
+	if !v.Valid() {
+		t.Fatalf("unexpected errors %v", v.Errors)
+	}
+
+	app.readPartialParam(url.Values{"partial": {"maybe"}}, v)
+	if v.Errors["partial"] != "must be a boolean value" {
+		t.Errorf("got errors %v", v.Errors)
+	}
+}
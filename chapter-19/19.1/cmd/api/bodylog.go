@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// bodyLogMaxBytes is the most of each request and response body which logBodies() logs.
+const bodyLogMaxBytes = 2048
+
+// sensitiveJSONField matches a JSON string field whose key suggests that it holds a
+// secret, like "password" or "token", capturing everything up to the opening quote of
+// the value. The value may be cut off by truncation, so its closing quote is optional.
+var sensitiveJSONField = regexp.MustCompile(`(?i)("[^"]*(?:password|token|secret)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+// The redactBody() function replaces the values of sensitive JSON fields in a (possibly
+// truncated) body with "[REDACTED]".
+
+func redactBody(body []byte) string {
+	return sensitiveJSONField.ReplaceAllString(string(body), `$1"[REDACTED]"`)
+}
+
+// bodyCapture is an io.Writer which keeps the first bodyLogMaxBytes bytes written to it,
+// and counts the rest.
+type bodyCapture struct {
+	buf   bytes.Buffer
+	total int64
+}
+
+func (c *bodyCapture) Write(b []byte) (int, error) {
+	c.total += int64(len(b))
+	if room := bodyLogMaxBytes - c.buf.Len(); room > 0 {
+		c.buf.Write(b[:min(room, len(b))])
+	}
+	return len(b), nil
+}
+
+// bodyLogWriter wraps a http.ResponseWriter, copying the response body to a bodyCapture
+// as it is written.
+type bodyLogWriter struct {
+	http.ResponseWriter
+	capture bodyCapture
+}
+
+func (bw *bodyLogWriter) Write(b []byte) (int, error) {
+	bw.capture.Write(b)
+	return bw.ResponseWriter.Write(b)
+}
+
+func (bw *bodyLogWriter) Flush() {
+	if flusher, ok := bw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap() lets http.ResponseController reach the underlying http.ResponseWriter.
+func (bw *bodyLogWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// The logBodies() middleware logs the request and response bodies at debug level, if it
+// has been enabled with the -log-bodies flag. It is meant for debugging in development,
+// so the -log-bodies flag is refused in production. Only the first bodyLogMaxBytes of
+// each body are logged, and the values of sensitive JSON fields are redacted.
+//
+// The start of the request body is read into a buffer before the handler runs, and
+// replayed ahead of the rest of the body, so that the handler still reads all of it.
+
+func (app *application) logBodies(next http.Handler) http.Handler {
+	if !app.config.logBodies {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			request, err = io.ReadAll(io.LimitReader(r.Body, bodyLogMaxBytes))
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(request), r.Body), r.Body}
+		}
+
+		bw := &bodyLogWriter{ResponseWriter: w}
+
+		next.ServeHTTP(bw, r)
+
+		app.requestLogger(r).Debug("request and response bodies",
+			"request_body", redactBody(request),
+			"response_body", redactBody(bw.capture.buf.Bytes()),
+			"response_bytes", bw.capture.total)
+	})
+}
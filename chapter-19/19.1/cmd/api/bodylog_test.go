@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greelight.techkunstler.com/internal/assert"
+)
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "Password",
+			body: `{"email": "alice@example.com", "password": "pa55word"}`,
+			want: `{"email": "alice@example.com", "password": "[REDACTED]"}`,
+		},
+		{
+			name: "Nested token",
+			body: `{"authentication_token":{"token":"Y3QMGX3PJ3WLRL2YRTQGQ6KRHU","expiry":"2026-10-17T12:00:00Z"}}`,
+			want: `{"authentication_token":{"token":"[REDACTED]","expiry":"2026-10-17T12:00:00Z"}}`,
+		},
+		{
+			name: "Escaped quote",
+			body: `{"new_password":"pa\"55word","name":"Alice"}`,
+			want: `{"new_password":"[REDACTED]","name":"Alice"}`,
+		},
+		{
+			name: "Truncated",
+			body: `{"name":"Alice","password":"pa55`,
+			want: `{"name":"Alice","password":"[REDACTED]"`,
+		},
+		{
+			name: "Nothing sensitive",
+			body: `{"title":"Moana","year":2016}`,
+			want: `{"title":"Moana","year":2016}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, redactBody([]byte(tt.body)), tt.want)
+		})
+	}
+}
+
+func TestLogBodies(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.logBodies = true
+
+	var buf bytes.Buffer
+	app.logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	// The handler echoes the request body back, to check that it can still read all of
+	// it after logBodies() has read the start.
+	long := strings.Repeat("x", 2*bodyLogMaxBytes)
+	requestBody := `{"name":"Alice","password":"pa55word","bio":"` + long + `"}`
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(body)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(requestBody))
+
+	_, _, body := execute(t, app.logBodies(next), r)
+	assert.Equal(t, body, requestBody)
+
+	var entry map[string]any
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("invalid log entry %q: %v", buf.String(), err)
+	}
+
+	assert.Equal(t, entry["level"], any("DEBUG"))
+	assert.Equal(t, entry["response_bytes"], any(float64(len(requestBody))))
+
+	for _, key := range []string{"request_body", "response_body"} {
+		logged, _ := entry[key].(string)
+		if strings.Contains(logged, "pa55word") {
+			t.Errorf("%s contains the password: %q", key, logged)
+		}
+		if !strings.Contains(logged, `"password":"[REDACTED]"`) {
+			t.Errorf("%s doesn't contain the redacted password: %q", key, logged)
+		}
+		if len(logged) >= len(requestBody) {
+			t.Errorf("%s is %d bytes long; want it truncated", key, len(logged))
+		}
+	}
+}
+
+func TestLogBodiesDisabled(t *testing.T) {
+	app := newTestApplication(t)
+
+	var buf bytes.Buffer
+	app.logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(`{"password":"pa55word"}`))
+
+	execute(t, app.logBodies(next), r)
+	assert.Equal(t, buf.String(), "")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"greelight.techkunstler.com/internal/data"
+	"log/slog"
 	"net/http"
 )
 
@@ -15,6 +16,18 @@ type contextKey string
 
 const userContextKey = contextKey("user")
 
+// The loggerContextKey is used for the request-scoped logger.
+const loggerContextKey = contextKey("logger")
+
+// The movieViewContextKey is used for the data.MovieView which handlers render movies
+// with.
+const movieViewContextKey = contextKey("movieView")
+
+// The routeNameContextKey is used for the *string which app.endpoint() fills in with the
+// name of the matched route, so that the metrics() middleware, which runs before the
+// router, can label the request with it.
+const routeNameContextKey = contextKey("routeName")
+
 // The contextSetUser() method returns a new copy of the request iwth the provided
 // User struct added to the context. Note that we use our userContextKey constant as
 // the key.
@@ -36,3 +49,57 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	return user
 
 }
+
+// The contextSetMovieView() method returns a new copy of the request with the provided
+// movie view added to the context.
+func (app *application) contextSetMovieView(r *http.Request, view data.MovieView) *http.Request {
+	ctx := context.WithValue(r.Context(), movieViewContextKey, view)
+	return r.WithContext(ctx)
+}
+
+// The contextGetMovieView() method returns the movie view for the current request. Unless
+// a middleware has chosen otherwise, this is the full view.
+func (app *application) contextGetMovieView(r *http.Request) data.MovieView {
+	view, ok := r.Context().Value(movieViewContextKey).(data.MovieView)
+	if !ok {
+		return data.MovieViewFull
+	}
+	return view
+}
+
+// The contextSetLogger() method returns a new copy of the request with the provided
+// logger added to the context.
+func (app *application) contextSetLogger(r *http.Request, logger *slog.Logger) *http.Request {
+	ctx := context.WithValue(r.Context(), loggerContextKey, logger)
+	return r.WithContext(ctx)
+}
+
+// The requestLogger() method returns the logger for the current request, which carries
+// the request ID, method and URI (and the user ID once the request has been
+// authenticated) as attributes on every log entry. If the request hasn't been through
+// the logRequestContext() middleware, it falls back to the application logger with the
+// method and URI attached.
+func (app *application) requestLogger(r *http.Request) *slog.Logger {
+	logger, ok := r.Context().Value(loggerContextKey).(*slog.Logger)
+	if !ok {
+		return app.logger.With("method", r.Method, "uri", r.URL.RequestURI())
+	}
+	return logger
+}
+
+// The contextWithRouteName() method returns a new copy of the request with somewhere for
+// app.endpoint() to record the route name, and a pointer to read it from afterwards.
+// Requests which don't match a route keep the name "unmatched".
+func (app *application) contextWithRouteName(r *http.Request) (*http.Request, *string) {
+	name := "unmatched"
+	ctx := context.WithValue(r.Context(), routeNameContextKey, &name)
+	return r.WithContext(ctx), &name
+}
+
+// The contextSetRouteName() method records the name of the matched route, if the request
+// came through contextWithRouteName().
+func (app *application) contextSetRouteName(r *http.Request, name string) {
+	if p, ok := r.Context().Value(routeNameContextKey).(*string); ok {
+		*p = name
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"greelight.techkunstler.com/internal/data"
+)
+
+// coverContentTypes maps the image types accepted for movie covers to the file extension
+// they are stored with.
+var coverContentTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+var (
+	errUploadTooLarge = errors.New("upload too large")
+	errMissingCover   = errors.New(`the request must include a "cover" file`)
+)
+
+// The readCoverUpload() helper reads the "cover" file from a multipart/form-data
+// request body. The whole body is limited to the -max-upload-bytes setting, and the
+// declared size of the file part is checked against it too. It returns the file data
+// and its sniffed content type, or errUploadTooLarge if either limit is exceeded.
+
+func (app *application) readCoverUpload(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	maxBytes := app.config.uploads.maxBytes
+
+	// Allow a little extra on top of the file size for the multipart boundaries and
+	// part headers.
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+4096)
+
+	// Parse the form, keeping up to 1MB in memory and spilling anything larger to
+	// temporary files.
+	err := r.ParseMultipartForm(1_048_576)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return nil, "", errUploadTooLarge
+		}
+		return nil, "", err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("cover")
+	if err != nil {
+		if errors.Is(err, http.ErrMissingFile) {
+			return nil, "", errMissingCover
+		}
+		return nil, "", err
+	}
+	defer file.Close()
+
+	if header.Size > maxBytes {
+		return nil, "", errUploadTooLarge
+	}
+
+	// Don't trust the size alone; stop reading once we go past the limit.
+	b, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(b)) > maxBytes {
+		return nil, "", errUploadTooLarge
+	}
+
+	return b, http.DetectContentType(b), nil
+}
+
+// The uploadMovieCoverHandler() stores a cover image for a movie, replacing any existing
+// one. The image is sent as the "cover" field of a multipart/form-data request body.
+
+func (app *application) uploadMovieCoverHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Read the upload before touching the database, so that oversized requests are
+	// rejected as cheaply as possible.
+	b, contentType, err := app.readCoverUpload(w, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUploadTooLarge):
+			app.payloadTooLargeResponse(w, r, app.config.uploads.maxBytes)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	ext, ok := coverContentTypes[contentType]
+	if !ok {
+		v := app.newValidator(r)
+		v.AddError("cover", "must be a JPEG or PNG image")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	_, err = app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = os.MkdirAll(app.config.uploads.coversDir, 0o755)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Remove any cover stored with a different extension, so there is only ever one
+	// per movie.
+	for _, other := range coverContentTypes {
+		if other != ext {
+			os.Remove(filepath.Join(app.config.uploads.coversDir, fmt.Sprintf("%d%s", id, other)))
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(app.config.uploads.coversDir, fmt.Sprintf("%d%s", id, ext)), b, 0o644)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	cover := map[string]any{
+		"movie_id":     id,
+		"content_type": contentType,
+		"size":         len(b),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"cover": cover}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
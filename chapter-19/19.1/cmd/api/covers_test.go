@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"greelight.techkunstler.com/internal/assert"
+)
+
+// newCoverRequest() returns a PUT /v1/movies/1/cover request with a multipart body
+// containing a PNG "cover" file of the given size.
+
+func newCoverRequest(t *testing.T, size int) *http.Request {
+	t.Helper()
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, size-8)...)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	part, err := mw.CreateFormFile("cover", "cover.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write(png)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "/v1/movies/1/cover", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey,
+		httprouter.Params{{Key: "id", Value: "1"}}))
+
+	return r
+}
+
+func TestReadCoverUpload(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.uploads.maxBytes = 1024
+
+	t.Run("In limit", func(t *testing.T) {
+		r := newCoverRequest(t, 1024)
+
+		b, contentType, err := app.readCoverUpload(httptest.NewRecorder(), r)
+		assert.NilError(t, err)
+		assert.Equal(t, len(b), 1024)
+		assert.Equal(t, contentType, "image/png")
+	})
+
+	t.Run("Over limit", func(t *testing.T) {
+		r := newCoverRequest(t, 1025)
+
+		_, _, err := app.readCoverUpload(httptest.NewRecorder(), r)
+		if err != errUploadTooLarge {
+			t.Errorf("got error %v; want errUploadTooLarge", err)
+		}
+	})
+
+	t.Run("Body over limit", func(t *testing.T) {
+		r := newCoverRequest(t, 64*1024)
+
+		_, _, err := app.readCoverUpload(httptest.NewRecorder(), r)
+		if err != errUploadTooLarge {
+			t.Errorf("got error %v; want errUploadTooLarge", err)
+		}
+	})
+}
+
+func TestUploadMovieCoverHandlerTooLarge(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.uploads.maxBytes = 1024
+
+	// An oversized upload is rejected before the database is touched.
+	status, _, body := execute(t, http.HandlerFunc(app.uploadMovieCoverHandler), newCoverRequest(t, 2048))
+
+	assert.Status(t, status, http.StatusRequestEntityTooLarge)
+	assert.JSONField(t, []byte(body), "error", "the upload must not be larger than 1024 bytes")
+}
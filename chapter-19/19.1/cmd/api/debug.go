@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// The debugInfoHandler() returns a snapshot of the build and runtime state of the
+// running process. Unlike the healthcheck this is intended for operators only, so it is
+// registered behind the "admin:read" permission in routes.go.
+
+func (app *application) debugInfoHandler(w http.ResponseWriter, r *http.Request) {
+	// Read the current memory statistics. Note that ReadMemStats() briefly stops the
+	// world, which is fine for an occasional ops request like this one.
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	env := envelope{
+		"build": map[string]string{
+			"version":    version,
+			"go_version": runtime.Version(),
+		},
+		"runtime": map[string]any{
+			"gomaxprocs": runtime.GOMAXPROCS(0),
+			"goroutines": runtime.NumGoroutine(),
+			"num_cpu":    runtime.NumCPU(),
+		},
+		"memory": map[string]uint64{
+			"alloc":       m.Alloc,
+			"total_alloc": m.TotalAlloc,
+			"sys":         m.Sys,
+			"heap_alloc":  m.HeapAlloc,
+			"heap_inuse":  m.HeapInuse,
+			"num_gc":      uint64(m.NumGC),
+		},
+		"started_at": app.startTime.UTC().Format(time.RFC3339),
+		"uptime":     time.Since(app.startTime).Round(time.Second).String(),
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDebugInfoHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	r, err := http.NewRequest(http.MethodGet, "/v1/debug/info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, body := execute(t, http.HandlerFunc(app.debugInfoHandler), r)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", code, http.StatusOK)
+	}
+
+	js := decodeJSON(t, body)
+
+	rt, ok := js["runtime"].(map[string]any)
+	if !ok {
+		t.Fatalf("response missing runtime object: %s", body)
+	}
+	if goroutines, ok := rt["goroutines"].(float64); !ok || goroutines < 1 {
+		t.Errorf("got goroutines %v; want a positive count", rt["goroutines"])
+	}
+
+	if _, ok := js["uptime"].(string); !ok {
+		t.Errorf("response missing uptime field: %s", body)
+	}
+}
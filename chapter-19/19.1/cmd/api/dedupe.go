@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// recentRequests remembers a hash of each request handled by rejectDuplicateRequests()
+// for the length of the window, along with the Location of the resource it created. The
+// hashes are held in memory, so they are per-instance and don't survive a restart.
+
+type recentRequests struct {
+	mu      sync.Mutex
+	window  time.Duration
+	swept   time.Time
+	entries map[string]recentRequest
+}
+
+type recentRequest struct {
+	expires  time.Time
+	location string
+}
+
+func newRecentRequests(window time.Duration) *recentRequests {
+	return &recentRequests{
+		window:  window,
+		entries: make(map[string]recentRequest),
+	}
+}
+
+// reserve() records the request hash at the given time, and reports whether it is new.
+// If the same hash was recorded within the window, the earlier request is returned
+// instead. Expired hashes are swept at most once per window, as they are reserved.
+
+func (s *recentRequests) reserve(hash string, now time.Time) (recentRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) >= s.window {
+		for key, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, key)
+			}
+		}
+		s.swept = now
+	}
+
+	if e, found := s.entries[hash]; found && now.Before(e.expires) {
+		return e, false
+	}
+
+	s.entries[hash] = recentRequest{expires: now.Add(s.window)}
+	return recentRequest{}, true
+}
+
+// complete() records the Location of the resource created by the request with the hash.
+func (s *recentRequests) complete(hash, location string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, found := s.entries[hash]; found {
+		e.location = location
+		s.entries[hash] = e
+	}
+}
+
+// release() forgets the request hash, so that the request can be retried.
+func (s *recentRequests) release(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, hash)
+}
+
+// The requestHash() helper returns a hex-encoded SHA-256 hash of the user ID, method,
+// path and body of a request. Each part is prefixed with its length, so that the parts
+// can't run into each other.
+
+func requestHash(userID int64, method, path string, body []byte) string {
+	h := sha256.New()
+	for _, part := range [][]byte{[]byte(strconv.FormatInt(userID, 10)), []byte(method), []byte(path), body} {
+		h.Write([]byte(strconv.Itoa(len(part)) + ":"))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The rejectDuplicateRequests() middleware catches accidental double submissions, like a
+// form posted twice, when the -duplicate-request-window flag is set. A request with the
+// same user, method, path and body as one received within the window is rejected with a
+// 409 Conflict response, pointing at the resource the first request created if it's
+// known. Only requests which succeed are remembered, so a request which failed can be
+// retried straight away. It must be used after the user has been authenticated, so wrap
+// it inside requiredPermission().
+
+func (app *application) rejectDuplicateRequests(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.recentRequests == nil {
+			next(w, r)
+			return
+		}
+
+		// Read as much of the body as readJSON() allows, plus one byte, and replay it
+		// ahead of the rest, so that readJSON() still rejects a body which is too large.
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, 1_048_576+1))
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+
+		user := app.contextGetUser(r)
+		hash := requestHash(user.ID, r.Method, r.URL.Path, body)
+
+		original, ok := app.recentRequests.reserve(hash, time.Now())
+		if !ok {
+			app.duplicateRequestResponse(w, r, original.location)
+			return
+		}
+
+		rw := &statusRecorder{ResponseWriter: w}
+		next(rw, r)
+
+		if rw.status >= 200 && rw.status < 300 {
+			app.recentRequests.complete(hash, w.Header().Get("Location"))
+		} else {
+			app.recentRequests.release(hash)
+		}
+	})
+}
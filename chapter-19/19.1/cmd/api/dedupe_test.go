@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+)
+
+func TestRejectDuplicateRequests(t *testing.T) {
+	// Answer each insert with the next movie ID, counting the inserts.
+	var inserts int64
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			inserts++
+			return []string{"id", "created_at", "updated_at", "version"},
+				[][]driver.Value{{inserts, time.Now(), time.Now(), int64(1)}}
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+	app.recentRequests = newRecentRequests(time.Minute)
+
+	handler := app.rejectDuplicateRequests(app.createMovieHandler)
+
+	send := func(userID int64, body string) (int, http.Header, string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+		r = app.contextSetUser(r, &data.User{ID: userID})
+		return execute(t, handler, r)
+	}
+
+	// The Location header is an absolute URL, built from the request's host.
+	location := "http://example.com/v1/movies/1"
+	moana := `{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"]}`
+
+	status, headers, _ := send(1, moana)
+	assert.Status(t, status, http.StatusCreated)
+	assert.Equal(t, headers.Get("Location"), location)
+
+	// Submitting the same movie again is flagged as a duplicate, and points at the movie
+	// which the first request created.
+	status, headers, body := send(1, moana)
+	assert.Status(t, status, http.StatusConflict)
+	assert.Equal(t, headers.Get("Location"), location)
+	if !strings.Contains(body, location) {
+		t.Errorf("got body %q; want it to mention %s", body, location)
+	}
+	assert.Equal(t, inserts, int64(1))
+
+	// A different user, or a different body, isn't a duplicate.
+	status, _, _ = send(2, moana)
+	assert.Status(t, status, http.StatusCreated)
+
+	status, _, _ = send(1, `{"title":"Up","year":2009,"runtime":"96 mins","genres":["animation"]}`)
+	assert.Status(t, status, http.StatusCreated)
+
+	// A request which fails isn't remembered, so it can be retried.
+	invalid := `{"title":"","year":2016,"runtime":"107 mins","genres":["animation"]}`
+	for range 2 {
+		status, _, _ = send(1, invalid)
+		assert.Status(t, status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestRecentRequestsExpiry(t *testing.T) {
+	s := newRecentRequests(5 * time.Second)
+	now := time.Now()
+
+	_, ok := s.reserve("a", now)
+	assert.Equal(t, ok, true)
+
+	_, ok = s.reserve("a", now.Add(4*time.Second))
+	assert.Equal(t, ok, false)
+
+	// Once the window has passed the hash is forgotten, and the request is allowed again.
+	_, ok = s.reserve("a", now.Add(5*time.Second))
+	assert.Equal(t, ok, true)
+
+	// Reserving sweeps out the other expired hashes.
+	s.reserve("b", now.Add(5*time.Second))
+	s.reserve("c", now.Add(11*time.Second))
+	assert.Equal(t, len(s.entries), 1)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// deprecation describes an endpoint which is going to be removed. The sunset is the date
+// after which it may stop working, or the zero time if no date has been set.
+type deprecation struct {
+	sunset time.Time
+}
+
+// deprecatedEndpoints lists the endpoints, by their names in endpointNames, which have
+// been deprecated in code. Add an entry here when an endpoint is replaced, like:
+//
+//	"movies:csv": {sunset: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+//
+// The -deprecated-endpoints flag can deprecate more endpoints, and overrides the sunset
+// dates given here.
+var deprecatedEndpoints = map[string]deprecation{}
+
+// The parseDeprecation() function parses a deprecated endpoint in the form name, or
+// name=YYYY-MM-DD to give a sunset date as well, checking that the name is a known
+// endpoint.
+
+func parseDeprecation(s string) (string, deprecation, error) {
+	name, date, found := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+
+	if !slices.Contains(endpointNames, name) {
+		return "", deprecation{}, fmt.Errorf("unknown endpoint %q", name)
+	}
+	if !found {
+		return name, deprecation{}, nil
+	}
+
+	sunset, err := time.Parse(time.DateOnly, strings.TrimSpace(date))
+	if err != nil {
+		return "", deprecation{}, fmt.Errorf("endpoint %q must have a sunset date in the form YYYY-MM-DD", name)
+	}
+	return name, deprecation{sunset: sunset}, nil
+}
+
+// The deprecation() method looks up the named endpoint in the -deprecated-endpoints flag
+// and then the deprecatedEndpoints registry, and reports whether it is deprecated.
+
+func (app *application) deprecation(name string) (deprecation, bool) {
+	if d, ok := app.config.deprecatedEndpoints[name]; ok {
+		return d, true
+	}
+	d, ok := deprecatedEndpoints[name]
+	return d, ok
+}
+
+// The markDeprecated() middleware warns clients that an endpoint is going to be removed,
+// by adding a "Deprecation: true" header to its responses, and a Sunset header (RFC 8594)
+// with the date after which it may stop working, if there is one.
+
+func (app *application) markDeprecated(d deprecation, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		if !d.sunset.IsZero() {
+			w.Header().Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+		}
+		next(w, r)
+	}
+}
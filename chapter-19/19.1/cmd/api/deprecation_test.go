@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/assert"
+)
+
+func TestParseDeprecation(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		sunset  time.Time
+		wantErr bool
+	}{
+		{value: "movies:csv", want: "movies:csv"},
+		{value: " movies:csv = 2027-01-01 ", want: "movies:csv", sunset: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{value: "movies:csv=next year", wantErr: true},
+		{value: "movies:explode", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			name, d, err := parseDeprecation(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			assert.Equal(t, name, tt.want)
+			assert.Equal(t, d.sunset, tt.sunset)
+		})
+	}
+}
+
+func TestDeprecatedEndpoints(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.deprecatedEndpoints = map[string]deprecation{
+		"healthcheck": {sunset: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"readiness":   {},
+	}
+
+	routes := app.routes()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantDeprec string
+		wantSunset string
+	}{
+		{name: "With sunset", path: "/v1/healthcheck", wantDeprec: "true", wantSunset: "Fri, 01 Jan 2027 00:00:00 GMT"},
+		{name: "Without sunset", path: "/readyz", wantDeprec: "true"},
+		{name: "Not deprecated", path: "/v1/movies/featured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			_, headers, _ := execute(t, routes, r)
+
+			assert.Equal(t, headers.Get("Deprecation"), tt.wantDeprec)
+			assert.Equal(t, headers.Get("Sunset"), tt.wantSunset)
+		})
+	}
+}
+
+func TestDeprecationRegistry(t *testing.T) {
+	sunset := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	saved := deprecatedEndpoints
+	defer func() { deprecatedEndpoints = saved }()
+	deprecatedEndpoints = map[string]deprecation{
+		"healthcheck": {sunset: sunset},
+		"readiness":   {sunset: sunset},
+	}
+
+	// The flag overrides the registry, so it can postpone or drop a sunset date.
+	app := newTestApplication(t)
+	app.config.deprecatedEndpoints = map[string]deprecation{"healthcheck": {}}
+
+	d, ok := app.deprecation("healthcheck")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, d.sunset, time.Time{})
+
+	d, ok = app.deprecation("readiness")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, d.sunset, sunset)
+
+	_, ok = app.deprecation("metrics")
+	assert.Equal(t, ok, false)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// docsFS holds the OpenAPI document describing the API, and a browsable API explorer
+// page which renders it.
+//
+//go:embed "docs"
+var docsFS embed.FS
+
+// The openAPIHandler() handler serves the OpenAPI document for the API.
+
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	js, err := docsFS.ReadFile("docs/openapi.json")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// The docsHandler() handler serves the API explorer page, which loads the OpenAPI
+// document from GET /v1/openapi.json.
+
+func (app *application) docsHandler(w http.ResponseWriter, r *http.Request) {
+	html, err := docsFS.ReadFile("docs/index.html")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(html)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greelight.techkunstler.com/internal/assert"
+)
+
+func TestDocs(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.docsEnabled = true
+
+	routes := app.routes()
+
+	status, headers, body := execute(t, routes, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	assert.Status(t, status, http.StatusOK)
+	assert.Equal(t, headers.Get("Content-Type"), "text/html; charset=utf-8")
+	assert.StringContains(t, body, "<html")
+	assert.StringContains(t, body, "/v1/openapi.json")
+
+	status, headers, body = execute(t, routes, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	assert.Status(t, status, http.StatusOK)
+	assert.Equal(t, headers.Get("Content-Type"), "application/json")
+
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal([]byte(body), &spec)
+	assert.NilError(t, err)
+	assert.Equal(t, spec.OpenAPI, "3.0.3")
+
+	// Every documented operation must exist, so requests for them mustn't get a 404 or
+	// 405 response. They fail in other ways, as there's no database or authentication.
+	for path, item := range spec.Paths {
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+
+			target := strings.ReplaceAll(path, "{id}", "1")
+			r := httptest.NewRequest(strings.ToUpper(method), target, nil)
+
+			status, _, _ := execute(t, routes, r)
+			if status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: got status %d for a documented operation", strings.ToUpper(method), path, status)
+			}
+		}
+	}
+}
+
+func TestDocsDisabled(t *testing.T) {
+	app := newTestApplication(t)
+
+	for _, path := range []string{"/docs", "/v1/openapi.json"} {
+		status, _, _ := execute(t, app.routes(), httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Status(t, status, http.StatusNotFound)
+	}
+}
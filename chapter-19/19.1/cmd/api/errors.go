@@ -2,18 +2,21 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"greelight.techkunstler.com/internal/validator"
 )
 
-// The logError() method is a generic helper for logging an error message along
-// with the current request method and URL as attributes in the log entry.
+// The logError() method is a generic helper for logging an error message using the
+// request-scoped logger, so that the request ID, method and URL are included as
+// attributes in the log entry.
 
 func (app *application) logError(r *http.Request, err error) {
-	var (
-		method = r.Method
-		uri    = r.URL.RequestURI()
-	)
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.requestLogger(r).Error(err.Error())
 }
 
 // The errorResponse() method is a generic helper for sending JSON-formatted error
@@ -35,6 +38,28 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 	}
 }
 
+// The documentedErrorResponse() method is like errorResponse(), but if the
+// -error-docs-base-url flag is set it also includes a "more_info" link to the
+// documentation page for the given error slug, like <base>/errors/rate-limit.
+
+func (app *application) documentedErrorResponse(w http.ResponseWriter, r *http.Request, status int, message any, slug string) {
+	if app.config.errorDocsBaseURL == "" {
+		app.errorResponse(w, r, status, message)
+		return
+	}
+
+	env := envelope{
+		"error":     message,
+		"more_info": app.config.errorDocsBaseURL + "/errors/" + slug,
+	}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
 // Ther serverErrorResponse() method will be used when our application encounters an unexpected problem at runtime. It logs the detailed error message,
 // Then uses the errorResponse() helper to send a 500 interal server error status code and JSON response (containing a generic error message) to the client.
 
@@ -62,10 +87,23 @@ func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter,
-	r *http.Request,
-	errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+// The failedValidationResponse() method sends the validator's errors with a 422
+// Unprocessable Entity status code. If the validator dropped errors because it reached
+// its limit, the response includes a note saying so.
+
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+	if !v.Omitted {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, v.Errors)
+		return
+	}
+
+	env := envelope{"error": v.Errors, "note": "additional errors omitted"}
+
+	err := app.writeJSON(w, http.StatusUnprocessableEntity, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
@@ -73,34 +111,102 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// The duplicateRequestResponse() method is used when a request is identical to one
+// received a moment ago. If the location of the resource which the first request created
+// is known, it is sent in the Location header and included in the message.
+
+func (app *application) duplicateRequestResponse(w http.ResponseWriter, r *http.Request, location string) {
+	message := "an identical request was received recently, so this one has been treated as a duplicate"
+	if location != "" {
+		w.Header().Set("Location", location)
+		message += fmt.Sprintf(", the original request created %s", location)
+	}
+	app.documentedErrorResponse(w, r, http.StatusConflict, message, "duplicate-request")
+}
+
+// The unsupportedMediaTypeResponse() method is used when the request body has a content
+// type which the endpoint doesn't accept. The accepted types are listed in the
+// Accept-Post response header.
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, allowed []string) {
+	w.Header().Set("Accept-Post", strings.Join(allowed, ", "))
+
+	message := fmt.Sprintf("the content type must be one of: %s", strings.Join(allowed, ", "))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+// The payloadTooLargeResponse() method is used when an upload is bigger than the
+// configured limit, which is included in the message.
+
+func (app *application) payloadTooLargeResponse(w http.ResponseWriter, r *http.Request, limit int64) {
+	message := fmt.Sprintf("the upload must not be larger than %d bytes", limit)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, message)
+}
+
+// The endpointDisabledResponse() method is used for endpoints which have been turned off
+// with the -disabled-endpoints flag.
+
+func (app *application) endpointDisabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this endpoint has been temporarily disabled, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.documentedErrorResponse(w, r, http.StatusTooManyRequests, message, "rate-limit")
+}
+
+func (app *application) writeQuotaExceededResponse(w http.ResponseWriter, r *http.Request, resetAt time.Time) {
+	// Let the client know how long to wait before trying again, in seconds.
+	retryAfter := int(math.Ceil(time.Until(resetAt).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	message := fmt.Sprintf("daily write quota exceeded, the quota resets at %s",
+		resetAt.UTC().Format(time.RFC3339))
+	app.documentedErrorResponse(w, r, http.StatusTooManyRequests, message, "write-quota")
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.documentedErrorResponse(w, r, http.StatusUnauthorized, message, "invalid-credentials")
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter,
 	r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.documentedErrorResponse(w, r, http.StatusUnauthorized, message, "invalid-token")
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.documentedErrorResponse(w, r, http.StatusUnauthorized, message, "authentication-required")
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to acces this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.documentedErrorResponse(w, r, http.StatusForbidden, message, "inactive-account")
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to acce the resources."
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.documentedErrorResponse(w, r, http.StatusForbidden, message, "not-permitted")
+}
+
+// The serviceUnavailableResponse() method is used when the server is temporarily unable
+// to handle the request, for example because the background task queue is full.
+
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server is temporarily unable to handle your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// The overloadedResponse() method is used when the server is already handling as many
+// requests as the -max-in-flight flag allows. The Retry-After header asks the client to
+// wait a second before trying again.
+
+func (app *application) overloadedResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	message := "the server is handling too many requests, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
 }
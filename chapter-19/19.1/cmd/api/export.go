@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"greelight.techkunstler.com/internal/data"
+	"greelight.techkunstler.com/internal/validator"
+)
+
+// userExport is the bundle of a user's data returned by GET /v1/users/me/export. The
+// password hash is never included, as the User type doesn't encode it to JSON.
+type userExport struct {
+	ExportedAt  time.Time        `json:"exported_at"`
+	User        *data.User       `json:"user"`
+	Permissions data.Permissions `json:"permissions"`
+}
+
+// newUserExport() assembles the export bundle for a user from the relevant models.
+
+func (app *application) newUserExport(user *data.User) (*userExport, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Always encode the permissions as an array, even if the user has none.
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	return &userExport{
+		ExportedAt:  time.Now().UTC(),
+		User:        user,
+		Permissions: permissions,
+	}, nil
+}
+
+// The writeExportZip() helper writes the export bundle as a zip archive containing a
+// single export.json file.
+
+func writeExportZip(w io.Writer, export *userExport) error {
+	zw := zip.NewWriter(w)
+
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "export.json",
+		Method:   zip.Deflate,
+		Modified: export.ExportedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	js, err := json.MarshalIndent(export, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(js)
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// The exportUserHandler() returns all of the data we hold about the authenticated user,
+// to support data portability requests. The format query string parameter selects
+// between a JSON response (the default) and a zip download.
+
+func (app *application) exportUserHandler(w http.ResponseWriter, r *http.Request) {
+	v := app.newValidator(r)
+
+	format := app.readString(r.URL.Query(), "format", "json")
+	v.Check(validator.PermittedValue(format, "json", "zip"), "format", "must be json or zip")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	export, err := app.newUserExport(app.contextGetUser(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="greenlight-export-%d.zip"`, export.User.ID))
+
+		err = writeExportZip(w, export)
+		if err != nil {
+			// The headers have already been sent, so all we can do is log the error.
+			app.logError(r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"export": export}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/data"
+)
+
+func newTestExport(t *testing.T) *userExport {
+	t.Helper()
+
+	user := &data.User{
+		ID:        7,
+		Name:      "Alice",
+		Email:     "alice@example.com",
+		Activated: true,
+	}
+
+	err := user.Password.Set("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &userExport{
+		ExportedAt:  time.Now().UTC(),
+		User:        user,
+		Permissions: data.Permissions{"movies:read", "movies:write"},
+	}
+}
+
+// checkExportJSON() asserts that an encoded export contains the user's profile and
+// permissions, but no password or hash.
+
+func checkExportJSON(t *testing.T, js []byte) {
+	t.Helper()
+
+	body := string(js)
+	for _, want := range []string{`"alice@example.com"`, `"Alice"`, `"movies:read"`, `"movies:write"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("export is missing %s: %s", want, body)
+		}
+	}
+
+	for _, notWant := range []string{"password", "hash", "$2a$"} {
+		if strings.Contains(strings.ToLower(body), strings.ToLower(notWant)) {
+			t.Errorf("export contains %q: %s", notWant, body)
+		}
+	}
+}
+
+func TestUserExportJSON(t *testing.T) {
+	js, err := json.Marshal(envelope{"export": newTestExport(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkExportJSON(t, js)
+}
+
+func TestWriteExportZip(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := writeExportZip(&buf, newTestExport(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "export.json" {
+		t.Fatalf("got zip files %v; want only export.json", zr.File)
+	}
+
+	f, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	js, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkExportJSON(t, js)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// featureDefaults lists the feature flags which gate experimental endpoints and
+// behaviours, and whether each is on unless configured otherwise. The -feature flag and
+// the features file can only set the flags listed here.
+var featureDefaults = map[string]bool{
+	"movies-duplicates": true,
+}
+
+// featureFlags holds the current value of every feature flag. The values can be
+// replaced while the server is running, when the features file is reloaded.
+type featureFlags struct {
+	mu    sync.RWMutex
+	flags map[string]bool
+}
+
+// newFeatureFlags() returns the feature flags with their defaults, overridden by the
+// given values.
+func newFeatureFlags(overrides map[string]bool) *featureFlags {
+	f := &featureFlags{}
+	f.set(overrides)
+	return f
+}
+
+// set() replaces the flags with their defaults, overridden by the given values.
+func (f *featureFlags) set(overrides map[string]bool) {
+	flags := maps.Clone(featureDefaults)
+	maps.Copy(flags, overrides)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flags = flags
+}
+
+func (f *featureFlags) enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.flags[name]
+}
+
+// The parseFeature() function parses a feature flag setting in the form name=true or
+// name=false, checking that the name is a known feature.
+
+func parseFeature(s string) (string, bool, error) {
+	name, value, found := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+
+	if _, ok := featureDefaults[name]; !ok {
+		return "", false, fmt.Errorf("unknown feature %q", name)
+	}
+	if !found {
+		return "", false, fmt.Errorf("feature %q must be in the form name=true or name=false", name)
+	}
+
+	on, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return "", false, fmt.Errorf("feature %q must be true or false", name)
+	}
+	return name, on, nil
+}
+
+// The readFeaturesFile() function reads feature flag settings from a file, one name=value
+// pair per line. Blank lines and lines starting with # are ignored.
+
+func readFeaturesFile(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	features := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, on, err := parseFeature(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		features[name] = on
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return features, nil
+}
+
+// The loadFeatures() method works out the feature flags from their defaults, the
+// features file (if there is one) and the -feature flags, in increasing order of
+// precedence.
+
+func (app *application) loadFeatures() (map[string]bool, error) {
+	features := make(map[string]bool)
+
+	if app.config.featuresFile != "" {
+		fromFile, err := readFeaturesFile(app.config.featuresFile)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(features, fromFile)
+	}
+
+	maps.Copy(features, app.config.features)
+	return features, nil
+}
+
+// The reloadFeatures() method re-reads the features file and applies the result. If the
+// file can't be read, the current flags are left as they are. It is called when the
+// process receives a SIGHUP signal.
+
+func (app *application) reloadFeatures() {
+	features, err := app.loadFeatures()
+	if err != nil {
+		app.logger.Error("failed to reload feature flags", "error", err.Error())
+		return
+	}
+
+	app.featureFlags.set(features)
+	app.logger.Info("reloaded feature flags", "features", features)
+}
+
+// The feature() method reports whether the named feature flag is on. If the application
+// has no feature flags, for example in tests, every feature has its default value.
+
+func (app *application) feature(name string) bool {
+	if app.featureFlags == nil {
+		return featureDefaults[name]
+	}
+	return app.featureFlags.enabled(name)
+}
+
+// The requireFeature() middleware sends a 404 Not Found response unless the named
+// feature flag is on, so that clients can't tell a gated endpoint exists. The flag is
+// checked on every request, so it takes effect as soon as the flags are reloaded.
+
+func (app *application) requireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	if _, ok := featureDefaults[name]; !ok {
+		panic("unknown feature name: " + name)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.feature(name) {
+			app.notFoundResponse(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
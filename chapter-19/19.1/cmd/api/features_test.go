@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"greelight.techkunstler.com/internal/assert"
+)
+
+func TestRequireFeature(t *testing.T) {
+	tests := []struct {
+		name       string
+		on         bool
+		wantStatus int
+	}{
+		// With the flag off the endpoint doesn't exist. With it on, an anonymous request
+		// gets as far as the permission check.
+		{name: "Off", on: false, wantStatus: http.StatusNotFound},
+		{name: "On", on: true, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.featureFlags = newFeatureFlags(map[string]bool{"movies-duplicates": tt.on})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/duplicates", nil)
+			status, _, _ := execute(t, app.routes(), r)
+
+			assert.Status(t, status, tt.wantStatus)
+		})
+	}
+}
+
+func TestParseFeature(t *testing.T) {
+	name, on, err := parseFeature("movies-duplicates=false")
+	assert.NilError(t, err)
+	assert.Equal(t, name, "movies-duplicates")
+	assert.Equal(t, on, false)
+
+	for _, s := range []string{"webhooks=true", "movies-duplicates", "movies-duplicates=maybe"} {
+		_, _, err := parseFeature(s)
+		if err == nil {
+			t.Errorf("%q: got nil error; want an error", s)
+		}
+	}
+}
+
+func TestReloadFeatures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "features")
+
+	writeFile := func(contents string) {
+		t.Helper()
+		err := os.WriteFile(path, []byte(contents), 0o600)
+		assert.NilError(t, err)
+	}
+
+	writeFile("# Turned off while we fix the similarity query.\nmovies-duplicates=false\n")
+
+	app := newTestApplication(t)
+	app.config.featuresFile = path
+
+	features, err := app.loadFeatures()
+	assert.NilError(t, err)
+	app.featureFlags = newFeatureFlags(features)
+
+	assert.Equal(t, app.feature("movies-duplicates"), false)
+
+	// The new file contents take effect on reload.
+	writeFile("movies-duplicates=true\n")
+	app.reloadFeatures()
+	assert.Equal(t, app.feature("movies-duplicates"), true)
+
+	// A bad file leaves the flags as they were.
+	writeFile("movies-duplicates=maybe\n")
+	app.reloadFeatures()
+	assert.Equal(t, app.feature("movies-duplicates"), true)
+
+	// A -feature flag takes precedence over the file.
+	writeFile("movies-duplicates=true\n")
+	app.config.features = map[string]bool{"movies-duplicates": false}
+	app.reloadFeatures()
+	assert.Equal(t, app.feature("movies-duplicates"), false)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+
+	"greelight.techkunstler.com/internal/data"
+	"greelight.techkunstler.com/internal/validator"
+)
+
+// The listCanonicalGenresHandler() returns the canonical genre vocabulary. When the
+// -strict-genres flag is set, these are the only genres movies may have.
+
+func (app *application) listCanonicalGenresHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"genres": data.CanonicalGenres,
+		"strict": app.config.strictGenres,
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The bulkUpdateGenresHandler() adds a genre to, or removes a genre from, every movie
+// matching a title and genres filter, for catalog maintenance. As a guard against
+// accidentally changing the whole catalog, the request must include "confirm": true.
+
+func (app *application) bulkUpdateGenresHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Filter struct {
+			Title  string   `json:"title"`
+			Genres []string `json:"genres"`
+		} `json:"filter"`
+		Operation string `json:"operation"`
+		Genre     string `json:"genre"`
+		Confirm   bool   `json:"confirm"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	v.Check(validator.PermittedValue(input.Operation, data.GenreOpAdd, data.GenreOpRemove), "operation", "must be either add or remove")
+	v.Check(input.Genre != "", "genre", "must be provided")
+	data.ValidateGenres(v, "genre", []string{input.Genre})
+	v.Check(input.Confirm, "confirm", "must be true to apply a bulk update")
+
+	// With strict genres on, a genre can only be added if it's in the canonical list.
+	// Removing an unknown genre is allowed, as that's how old genres get cleaned up.
+	if app.config.strictGenres && input.Operation == data.GenreOpAdd && input.Genre != "" {
+		gv := app.newValidator(r)
+		data.ValidateCanonicalGenres(gv, []string{input.Genre})
+		if message, ok := gv.Errors["genres"]; ok {
+			v.AddError("genre", message)
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// A missing genres filter matches every movie, the same as in GET /v1/movies.
+	if input.Filter.Genres == nil {
+		input.Filter.Genres = []string{}
+	}
+
+	affected, err := app.models.Movies.UpdateGenres(input.Filter.Title, input.Filter.Genres, input.Operation, input.Genre)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.requestLogger(r).Info("bulk genre update", "operation", input.Operation, "genre", input.Genre, "affected", affected)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"affected": affected}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestListCanonicalGenresHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/genres/canonical", nil)
+	status, _, body := execute(t, http.HandlerFunc(app.listCanonicalGenresHandler), r)
+
+	assert.Status(t, status, http.StatusOK)
+	assert.JSONField(t, []byte(body), "genres", data.CanonicalGenres)
+	assert.JSONField(t, []byte(body), "strict", false)
+}
+
+func TestValidateMovieStrictGenres(t *testing.T) {
+	movie := &data.Movie{
+		Title:   "Moana",
+		Year:    2016,
+		Runtime: 107,
+		Genres:  []string{"animation", "musicall"},
+	}
+
+	app := newTestApplication(t)
+
+	// Without strict genres any genre is accepted.
+	v := validator.New()
+	app.validateMovie(v, movie)
+	if !v.Valid() {
+		t.Errorf("got errors %v; want none", v.Errors)
+	}
+
+	app.config.strictGenres = true
+
+	v = validator.New()
+	app.validateMovie(v, movie)
+	assert.Equal(t, v.Errors["genres"], `"musicall" is not a known genre, did you mean: musical?`)
+
+	movie.Genres = []string{"animation", "musical"}
+
+	v = validator.New()
+	app.validateMovie(v, movie)
+	if !v.Valid() {
+		t.Errorf("got errors %v; want none", v.Errors)
+	}
+}
+
+func TestBulkUpdateGenresHandlerValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		strict  bool
+		field   string
+		wantErr string
+	}{
+		{
+			name:    "Unconfirmed",
+			body:    `{"filter": {"genres": ["drama"]}, "operation": "add", "genre": "classic"}`,
+			field:   "confirm",
+			wantErr: "must be true to apply a bulk update",
+		},
+		{
+			name:    "Unknown operation",
+			body:    `{"operation": "replace", "genre": "classic", "confirm": true}`,
+			field:   "operation",
+			wantErr: "must be either add or remove",
+		},
+		{
+			name:    "Missing genre",
+			body:    `{"operation": "remove", "confirm": true}`,
+			field:   "genre",
+			wantErr: "must be provided",
+		},
+		{
+			name:    "Genre too long",
+			body:    `{"operation": "add", "genre": "` + strings.Repeat("a", 51) + `", "confirm": true}`,
+			field:   "genre",
+			wantErr: "must not contain a genre more than 50 bytes long",
+		},
+		{
+			name:    "Genre with a comma",
+			body:    `{"operation": "add", "genre": "drama,war", "confirm": true}`,
+			field:   "genre",
+			wantErr: "must not contain a genre with a comma",
+		},
+		{
+			name:    "Unknown genre with strict genres",
+			body:    `{"operation": "add", "genre": "musicall", "confirm": true}`,
+			strict:  true,
+			field:   "genre",
+			wantErr: `"musicall" is not a known genre, did you mean: musical?`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.strictGenres = tt.strict
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/admin/movies/bulk-genre", strings.NewReader(tt.body))
+			status, _, body := execute(t, http.HandlerFunc(app.bulkUpdateGenresHandler), r)
+
+			assert.Status(t, status, http.StatusUnprocessableEntity)
+			assert.JSONField(t, []byte(body), "error."+tt.field, tt.wantErr)
+		})
+	}
+}
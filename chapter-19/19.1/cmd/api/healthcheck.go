@@ -1,17 +1,172 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"greelight.techkunstler.com/internal/data"
 )
 
+// poolStatsProvider reports the state of a database connection pool. *sql.DB
+// implements it.
+type poolStatsProvider interface {
+	Stats() sql.DBStats
+}
+
+// The poolSaturated() method reports whether the fraction of the database pool's
+// connections which are in use has reached the -readiness-pool-threshold, along with the
+// pool statistics it was based on. It's always false if the threshold is zero, or the
+// pool has no limit on open connections.
+
+func (app *application) poolSaturated() (bool, sql.DBStats) {
+	if app.dbPool == nil || app.config.readiness.poolThreshold <= 0 {
+		return false, sql.DBStats{}
+	}
+
+	stats := app.dbPool.Stats()
+	if stats.MaxOpenConnections <= 0 {
+		return false, stats
+	}
+
+	ratio := float64(stats.InUse) / float64(stats.MaxOpenConnections)
+	return ratio >= app.config.readiness.poolThreshold, stats
+}
+
+// readinessCheckTimeout is how long readinessHandler() waits for the database to answer
+// a ping, so that the readiness probe can never hang an orchestrator.
+const readinessCheckTimeout = time.Second
+
+// The readinessChecks() method returns the checks which an instance must pass to serve
+// requests: that the database can be reached within the timeout, and is at the
+// expected schema version. They're run by readinessHandler(), and by -run-selftest
+// along with its other checks.
+
+func (app *application) readinessChecks(timeout time.Duration) []dependencyCheck {
+	return []dependencyCheck{
+		{
+			name: "database",
+			check: func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+
+				return app.models.Ping(ctx)
+			},
+		},
+		{
+			name: "schema",
+			check: func() error {
+				version, dirty, err := app.models.Schema.Version()
+				if err != nil {
+					return err
+				}
+				if dirty {
+					return fmt.Errorf("migration %d is dirty", version)
+				}
+				if version != data.SchemaVersion {
+					return fmt.Errorf("got schema version %d; want %d", version, data.SchemaVersion)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// The readinessHandler() reports whether the instance should receive traffic. It returns
+// 503 Service Unavailable once shutdown has started, so that load balancers stop
+// routing requests to it while in-flight requests are allowed to finish. It also returns
+// 503 Service Unavailable, with the status "unavailable", if one of the readiness checks
+// fails, naming the dependency in the response and logging the error.
+//
+// It reports "degraded" when the database connection pool is close to exhaustion, so
+// that load can be shed before requests start queueing for connections. A degraded
+// instance returns 200 OK, unless -readiness-degraded-unavailable is set, in which case
+// it returns 503 Service Unavailable to take it out of the load balancer's rotation.
+// Both that response and a failed readiness check carry a Retry-After header, set by
+// -readiness-retry-after, so that orchestrators know when to check again. A draining
+// instance isn't coming back, so it doesn't get one.
+
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{"status": "ready"}
+	status := http.StatusOK
+
+	if app.draining.Load() {
+		env["status"], status = "draining", http.StatusServiceUnavailable
+	} else if name, err := app.failedCheck(app.readinessChecks(readinessCheckTimeout)); err != nil {
+		app.logError(r, fmt.Errorf("readiness: %s: %w", name, err))
+		env["status"], status = "unavailable", http.StatusServiceUnavailable
+		env["dependency"] = name
+		app.setReadinessRetryAfter(w)
+	} else if saturated, stats := app.poolSaturated(); saturated {
+		env["status"] = "degraded"
+		env["database_pool"] = map[string]int64{
+			"in_use":     int64(stats.InUse),
+			"max_open":   int64(stats.MaxOpenConnections),
+			"wait_count": stats.WaitCount,
+		}
+		if app.config.readiness.degradedUnavailable {
+			status = http.StatusServiceUnavailable
+			app.setReadinessRetryAfter(w)
+		}
+	}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The setReadinessRetryAfter() method sets the Retry-After header on a failed readiness
+// response to the -readiness-retry-after flag, rounded up to whole seconds. It does
+// nothing if the flag is zero.
+
+func (app *application) setReadinessRetryAfter(w http.ResponseWriter) {
+	if retryAfter := app.config.readiness.retryAfter; retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+}
+
+// The failedCheck() method runs the checks in order, and returns the name and error of
+// the first which fails, or a nil error if they all pass.
+
+func (app *application) failedCheck(checks []dependencyCheck) (string, error) {
+	for _, c := range checks {
+		err := c.check()
+		if err != nil {
+			return c.name, err
+		}
+	}
+	return "", nil
+}
+
+// The healthcheckHandler() reports the application status and version, and whether the
+// database can be reached. If it can't, the response is a 503 Service Unavailable.
+
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	// Ping the database, with a short timeout so that the healthcheck can never hang a
+	// load balancer.
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	status, available, database := http.StatusOK, "available", "available"
+
+	err := app.models.Ping(ctx)
+	if err != nil {
+		app.logError(r, err)
+		status, available, database = http.StatusServiceUnavailable, "unavailable", "unavailable"
+	}
 
 	// Declare an envelope map containing the data for the response. Notice that the way
 	// we've constructed this means the environment and version data will now be nested
 	// under a system_info key in the JSON response.
 
 	env := envelope{
-		"status": "available",
+		"status":   available,
+		"database": database,
 		"system_info": map[string]string{
 			"environment": app.config.env,
 			"version":     version,
@@ -26,7 +181,7 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 			"version":     version,
 		} */
 
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	err = app.writeJSON(w, status, env, nil)
 
 	if err != nil {
 		/* app.logger.Error(err.Error())
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+)
+
+// pingDriver is a database/sql driver whose connections do nothing except answer pings,
+// failing them if err is set.
+type pingDriver struct{ err error }
+
+func (d pingDriver) Open(name string) (driver.Conn, error) { return pingConn(d), nil }
+
+type pingConn struct{ err error }
+
+func (c pingConn) Ping(ctx context.Context) error { return c.err }
+func (c pingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c pingConn) Close() error              { return nil }
+func (c pingConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+// pingConnector adapts pingDriver to driver.Connector, so that it can be used with
+// sql.OpenDB() without registering it.
+type pingConnector struct{ d pingDriver }
+
+func (c pingConnector) Connect(ctx context.Context) (driver.Conn, error) { return c.d.Open("") }
+func (c pingConnector) Driver() driver.Driver                            { return c.d }
+
+func TestHealthcheckDatabase(t *testing.T) {
+	tests := []struct {
+		name       string
+		db         *sql.DB
+		wantStatus int
+		wantDB     string
+	}{
+		{
+			name:       "Available",
+			db:         sql.OpenDB(pingConnector{pingDriver{}}),
+			wantStatus: http.StatusOK,
+			wantDB:     "available",
+		},
+		{
+			name:       "Ping fails",
+			db:         sql.OpenDB(pingConnector{pingDriver{err: errors.New("connection refused")}}),
+			wantStatus: http.StatusServiceUnavailable,
+			wantDB:     "unavailable",
+		},
+		{
+			name:       "No database",
+			wantStatus: http.StatusServiceUnavailable,
+			wantDB:     "unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models = data.NewModels(tt.db, data.DefaultTimeouts)
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+			status, _, body := execute(t, http.HandlerFunc(app.healthcheckHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			assert.JSONField(t, []byte(body), "database", tt.wantDB)
+		})
+	}
+}
+
+func TestReadinessDependencies(t *testing.T) {
+	tests := []struct {
+		name       string
+		db         *sql.DB
+		wantStatus int
+		wantBody   string
+		wantDep    string
+	}{
+		{
+			name:       "Ready",
+			db:         newReadyDB(t),
+			wantStatus: http.StatusOK,
+			wantBody:   "ready",
+		},
+		{
+			name:       "Ping fails",
+			db:         sql.OpenDB(pingConnector{pingDriver{err: errors.New("connection refused")}}),
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "unavailable",
+			wantDep:    "database",
+		},
+		{
+			name: "Old schema",
+			db: sql.OpenDB(rowsConnector{
+				columns: []string{"version", "dirty"},
+				rows:    [][]driver.Value{{int64(data.SchemaVersion - 1), false}},
+			}),
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "unavailable",
+			wantDep:    "schema",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.db.Close()
+
+			app := newTestApplication(t)
+			app.models = data.NewModels(tt.db, data.DefaultTimeouts)
+
+			r := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			status, _, body := execute(t, http.HandlerFunc(app.readinessHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			assert.JSONField(t, []byte(body), "status", tt.wantBody)
+			if tt.wantDep != "" {
+				assert.JSONField(t, []byte(body), "dependency", tt.wantDep)
+			}
+		})
+	}
+}
+
+// mockPoolStats is a poolStatsProvider which returns fixed statistics.
+type mockPoolStats struct{ stats sql.DBStats }
+
+func (m mockPoolStats) Stats() sql.DBStats { return m.stats }
+
+func TestReadinessPoolSaturation(t *testing.T) {
+	tests := []struct {
+		name        string
+		threshold   float64
+		unavailable bool
+		stats       sql.DBStats
+		draining    bool
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			name:       "Below threshold",
+			threshold:  0.8,
+			stats:      sql.DBStats{MaxOpenConnections: 25, InUse: 19},
+			wantStatus: http.StatusOK,
+			wantBody:   "ready",
+		},
+		{
+			name:       "At threshold",
+			threshold:  0.8,
+			stats:      sql.DBStats{MaxOpenConnections: 25, InUse: 20, WaitCount: 3},
+			wantStatus: http.StatusOK,
+			wantBody:   "degraded",
+		},
+		{
+			name:        "Degraded is unavailable",
+			threshold:   0.8,
+			unavailable: true,
+			stats:       sql.DBStats{MaxOpenConnections: 25, InUse: 25},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantBody:    "degraded",
+		},
+		{
+			name:       "Check disabled",
+			stats:      sql.DBStats{MaxOpenConnections: 25, InUse: 25},
+			wantStatus: http.StatusOK,
+			wantBody:   "ready",
+		},
+		{
+			name:       "Unlimited pool",
+			threshold:  0.8,
+			stats:      sql.DBStats{InUse: 100},
+			wantStatus: http.StatusOK,
+			wantBody:   "ready",
+		},
+		{
+			name:       "Draining takes precedence",
+			threshold:  0.8,
+			stats:      sql.DBStats{MaxOpenConnections: 25, InUse: 25},
+			draining:   true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "draining",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models = data.NewModels(newReadyDB(t), data.DefaultTimeouts)
+			app.config.readiness.poolThreshold = tt.threshold
+			app.config.readiness.degradedUnavailable = tt.unavailable
+			app.dbPool = mockPoolStats{tt.stats}
+			app.draining.Store(tt.draining)
+
+			r := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			status, _, body := execute(t, http.HandlerFunc(app.readinessHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			assert.JSONField(t, []byte(body), "status", tt.wantBody)
+			if tt.wantBody == "degraded" {
+				assert.JSONField(t, []byte(body), "database_pool.in_use", tt.stats.InUse)
+				assert.JSONField(t, []byte(body), "database_pool.wait_count", tt.stats.WaitCount)
+			}
+		})
+	}
+}
+
+func TestReadinessRetryAfter(t *testing.T) {
+	saturated := sql.DBStats{MaxOpenConnections: 25, InUse: 25}
+	idle := sql.DBStats{MaxOpenConnections: 25, InUse: 1}
+	down := errors.New("connection refused")
+
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		pingErr    error
+		stats      sql.DBStats
+		draining   bool
+		wantStatus int
+		want       string
+	}{
+		{name: "Dependency failure", retryAfter: 5 * time.Second, pingErr: down, stats: idle, wantStatus: http.StatusServiceUnavailable, want: "5"},
+		{name: "Degraded", retryAfter: 5 * time.Second, stats: saturated, wantStatus: http.StatusServiceUnavailable, want: "5"},
+		{name: "Rounded up", retryAfter: 1500 * time.Millisecond, pingErr: down, stats: idle, wantStatus: http.StatusServiceUnavailable, want: "2"},
+		{name: "Disabled", retryAfter: 0, pingErr: down, stats: idle, wantStatus: http.StatusServiceUnavailable, want: ""},
+		{name: "Ready", retryAfter: 5 * time.Second, stats: idle, wantStatus: http.StatusOK, want: ""},
+		{name: "Draining", retryAfter: 5 * time.Second, stats: idle, draining: true, wantStatus: http.StatusServiceUnavailable, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models = data.NewModels(newReadyDB(t), data.DefaultTimeouts)
+			if tt.pingErr != nil {
+				db := sql.OpenDB(pingConnector{pingDriver{err: tt.pingErr}})
+				defer db.Close()
+				app.models = data.NewModels(db, data.DefaultTimeouts)
+			}
+			app.config.readiness.poolThreshold = 0.8
+			app.config.readiness.degradedUnavailable = true
+			app.config.readiness.retryAfter = tt.retryAfter
+			app.dbPool = mockPoolStats{tt.stats}
+			app.draining.Store(tt.draining)
+
+			r := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			status, headers, _ := execute(t, http.HandlerFunc(app.readinessHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			assert.Equal(t, headers.Get("Retry-After"), tt.want)
+		})
+	}
+}
+
+func TestReadinessRetryAfterDefaults(t *testing.T) {
+	// With the default flags, a dependency failure gets a Retry-After even though the
+	// degraded check is turned off.
+	db := sql.OpenDB(pingConnector{pingDriver{err: errors.New("connection refused")}})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+	app.config.readiness.retryAfter = 5 * time.Second
+
+	r := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	status, headers, body := execute(t, http.HandlerFunc(app.readinessHandler), r)
+
+	assert.Status(t, status, http.StatusServiceUnavailable)
+	assert.Equal(t, headers.Get("Retry-After"), "5")
+	assert.JSONField(t, []byte(body), "dependency", "database")
+}
@@ -1,21 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"expvar"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"greelight.techkunstler.com/internal/data"
 	"greelight.techkunstler.com/internal/validator"
 	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Define an envelope type.
 type envelope map[string]any
 
+// errBackgroundQueueFull is returned by background() and tryBackground() when the
+// maximum number of background tasks are already running.
+var errBackgroundQueueFull = errors.New("background task queue is full")
+
+// errEmptyBody is returned by readJSON() and readJSONArray() if the request body is
+// empty.
+var errEmptyBody = errors.New("body must not be empty")
+
+// backgroundQueueFull counts the number of background tasks which were rejected because
+// the queue was full.
+var backgroundQueueFull = expvar.NewInt("background_queue_full")
+
 func (app *application) readIDParam(r *http.Request) (int64, error) {
 
 	// When httprouter is parsing a request, any interpolated URL parameters will be stored
@@ -70,6 +94,277 @@ func (app *application) writeJSON(w http.ResponseWriter,
 	return nil
 }
 
+// The preferredFormat() helper picks the response format, "json", "xml" or "csv", from
+// the request's Accept header. Each format gets the quality of the most specific media
+// range matching it (application/xml and text/xml both count as XML), and ties go to
+// JSON and then XML, so JSON is the default for a missing Accept header or */*. Only
+// the list endpoint can send CSV; elsewhere it is treated as JSON.
+
+func preferredFormat(accept string) string {
+	qualities := make(map[string]float64)
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		qualities[mediaType] = q
+	}
+
+	// quality() returns the quality of the most specific range matching any of the
+	// given media types, or 0 if none do.
+	quality := func(mediaTypes ...string) float64 {
+		best := 0.0
+		for _, mediaType := range mediaTypes {
+			major, _, _ := strings.Cut(mediaType, "/")
+			for _, candidate := range []string{mediaType, major + "/*", "*/*"} {
+				if q, ok := qualities[candidate]; ok {
+					best = max(best, q)
+					break
+				}
+			}
+		}
+		return best
+	}
+
+	jsonQ := quality("application/json")
+	xmlQ := quality("application/xml", "text/xml")
+	csvQ := quality("text/csv")
+
+	switch {
+	case csvQ > jsonQ && csvQ > xmlQ:
+		return "csv"
+	case xmlQ > jsonQ:
+		return "xml"
+	default:
+		return "json"
+	}
+}
+
+// The writeResponse() helper sends the data as XML if the client prefers it, according
+// to its Accept header, and as JSON otherwise. Handlers whose responses can be sent as
+// XML use this, while the error helpers always send JSON using writeJSON().
+
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request,
+	status int, data envelope, headers http.Header) error {
+
+	// The response depends on the Accept header, so caches need to take it into account.
+	w.Header().Add("Vary", "Accept")
+
+	if preferredFormat(r.Header.Get("Accept")) != "xml" {
+		return app.writeJSON(w, status, data, headers)
+	}
+
+	x, err := xml.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	x = append([]byte(xml.Header), x...)
+	x = append(x, '\n')
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write(x)
+	return nil
+}
+
+// MarshalXML() encodes the envelope as a response element, containing an element named
+// after each key in key order, like the JSON object. encoding/xml can't encode maps, and
+// XML has no arrays, so a slice becomes an element containing one element for each item,
+// named after the key without its trailing "s": {"movies": [...]} is encoded as
+// <movies><movie>...</movie></movies>.
+
+func (env envelope) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: "response"}}
+
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		element := xml.StartElement{Name: xml.Name{Local: key}}
+
+		value := reflect.ValueOf(env[key])
+		if value.Kind() != reflect.Slice || value.Type().Elem().Kind() == reflect.Uint8 {
+			err = e.EncodeElement(env[key], element)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = e.EncodeToken(element)
+		if err != nil {
+			return err
+		}
+
+		item := xml.StartElement{Name: xml.Name{Local: strings.TrimSuffix(key, "s")}}
+		for i := range value.Len() {
+			err = e.EncodeElement(value.Index(i).Interface(), item)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = e.EncodeToken(element.End())
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// The fromTrustedProxy() helper reports whether the request was sent directly by one of
+// the proxies listed in the -trusted-proxies flag.
+
+func (app *application) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range app.config.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// The baseURL() helper returns the scheme and host the client used to reach the API,
+// like "https://api.example.com". The -base-url flag takes precedence if set. Otherwise
+// the X-Forwarded-Proto and X-Forwarded-Host headers are used when the request came
+// through a trusted proxy, falling back to the request's own TLS state and Host header.
+
+func (app *application) baseURL(r *http.Request) string {
+	if app.config.baseURL != "" {
+		return app.config.baseURL
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if app.fromTrustedProxy(r) {
+		// The headers may hold a comma-separated list if there are several proxies,
+		// in which case the first value is the one the client used.
+		if proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ","); proto != "" {
+			proto = strings.ToLower(strings.TrimSpace(proto))
+			if proto == "http" || proto == "https" {
+				scheme = proto
+			}
+		}
+		if fwdHost, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ","); fwdHost != "" {
+			host = strings.TrimSpace(fwdHost)
+		}
+	}
+
+	return scheme + "://" + host
+}
+
+// The resourceURL() helper returns the absolute canonical URL of a resource, like
+// "https://api.example.com/v1/movies/42" for resource "movies" and ID 42. Use it for
+// Location headers so that they are correct behind a reverse proxy.
+
+func (app *application) resourceURL(r *http.Request, resource string, id int64) string {
+	return fmt.Sprintf("%s/v1/%s/%d", app.baseURL(r), resource, id)
+}
+
+// The setETag() helper sets the ETag header for a movie response. A movie's version
+// changes every time it is updated, so the ID and version identify the representation,
+// like W/"42-3". The ETag is weak, because the same version can be sent as JSON or XML,
+// compressed or not, so the bytes aren't guaranteed to be the same. It returns the ETag,
+// for checking against the request with etagMatch().
+
+func (app *application) setETag(w http.ResponseWriter, movie *data.Movie) string {
+	etag := fmt.Sprintf(`W/"%d-%d"`, movie.ID, movie.Version)
+	w.Header().Set("ETag", etag)
+	return etag
+}
+
+// The etagMatch() helper reports whether an If-None-Match header value matches the given
+// ETag, meaning the client's cached copy is still current and it can be sent a 304 Not
+// Modified response instead of the full representation. The header can be * (which
+// matches any ETag) or a comma-separated list of ETags, which are compared using the
+// weak comparison from RFC 7232, ignoring any W/ prefix.
+
+func etagMatch(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate != "" && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// The readExpectedVersion() helper reads the X-Expected-Version request header, which
+// clients can send with an update to say which version of the record their change is
+// based on. It returns 0 if the header isn't present, as versions start at 1.
+
+func (app *application) readExpectedVersion(r *http.Request) (int32, error) {
+	value := r.Header.Get("X-Expected-Version")
+	if value == "" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid X-Expected-Version header: must be a positive integer")
+	}
+	return int32(version), nil
+}
+
+// The writeCreated() helper sends a 201 Created response containing the new resource.
+// If location is not empty it is sent in the Location header, to let the client know
+// which URL they can find the newly created resource at.
+
+func (app *application) writeCreated(w http.ResponseWriter, r *http.Request, location string, env envelope) {
+	headers := make(http.Header)
+	if location != "" {
+		headers.Set("Location", location)
+	}
+
+	err := app.writeJSON(w, http.StatusCreated, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 
 	// Use http.MaxBytesReader() to limit the size of the request body to 1MB
@@ -84,76 +379,19 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 
+	// Call UseNumber() so that when decoding into an any value (for example a
+	// map[string]any), numbers are kept as json.Number rather than being converted to a
+	// float64, which would silently lose precision for large integers. This has no
+	// effect on struct fields with a concrete numeric type. Use the jsonNumberToInt64()
+	// and jsonNumberToInt32() helpers to convert the values.
+	dec.UseNumber()
+
 	// Decode the request body into the target destination.
 	err := dec.Decode(dst)
-
 	if err != nil {
-		// If there is an error during decoding, start the triage...
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
-
-		// Add a ndwmaxBytesError variable.
-		var maxBytesError *http.MaxBytesError
-
-		switch {
-		// Use the errors.As() function to check whether the error has the type
-		// *json.SyntaxErro. If it does, then return a plain-english error message
-		// which includes the ocation of the problem.
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %x)", syntaxError)
-			// In some circumstances Decode() may also return an io.ErrUnexpectedEOF error
-			// for syntax errors in the JSON. So we check for this using errors.Is() and
-			// return a generic error message. There is an open issue regarding this a
-			// https://github.com/golang/go/issues/25956
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
-
-			// Likewise, catch any *json.UnmarshalTypeError errors. These occour when the
-			// JSON value is the wrong type for the target destination. If the eeor relates to a
-			// specific field, then we include that in our error message to mae it
-			// easier for the client to debug.
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)",
-				unmarshalTypeError.Offset)
-
-		// An io.EOF error will be returned by Decode() if the request body is empty. We
-		// check for this with errors.Is() and return a plain-english error message instead.
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
-
-		// If the JSON contains a field which cannot be mapped to the target destination
-		// then Decode() will now return an error message in the format "json: unknown
-		// field "<name>"". We can check for this . extract the field name from the error,
-		// and interpolate it into our custom error message. Note that there's an open
-		// issue at https://github.com//golang/go/issues/29035 regarding turning this
-		// into a distinct error type in the future.
-
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
-
-		// Use the errors.As() function to check whether the error has the type
-		// *http.MaxBytesError. If it does, then it means the request body exceed our
-		//size limit of 1MB and we return  aclear error message.
-		case errors.As(err, &maxBytesError):
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
-
-		// A json.InvalidUnmarshallError error will be returned if we pass something
-		// that is not a non-nil pointer to Decode(). We catch this and panic,
-		// rather than returning an error to ur handler. At the end of this chpater
-		// we will talk about panicking versus returing errors, and discuss why it's an
-		// appropriate thing to do in this specific situation.
-		case errors.As(err, &invalidUnmarshalError):
-			panic(err)
-		// for anything else, return the error message as-is
-		default:
-			return err
-		}
+		return triageJSONError(err)
 	}
+
 	// Way to handle multiple json values passed:
 	// Example: curl -d '{"title": "Moana"}{"title": "Top Gun"}' localhost:4000/v1/movies
 	// Call Decode() again, using a pointer to an empty anonymous struct as the destination. If the request body only contained a single JSON value this
@@ -166,6 +404,211 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	return nil
 }
 
+// The readJSONArray() helper is like readJSON(), but for batch endpoints which accept a
+// single top-level JSON array. Each element is decoded into a T with the same strict
+// rules, so unknown fields are rejected, and errors in an element say which one it was
+// by its index. It's a function rather than a method because methods can't have type
+// parameters.
+
+func readJSONArray[T any](w http.ResponseWriter, r *http.Request) ([]T, error) {
+	maxBytes := 1_048_576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+
+	// Read the opening bracket of the array. Anything else, including an object, is
+	// rejected.
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, triageJSONError(err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("body must contain a JSON array")
+	}
+
+	items := []T{}
+
+	for i := 0; dec.More(); i++ {
+		var item T
+
+		// The body can't end part way through the array, so an io.EOF error here means
+		// it was cut off rather than empty.
+		err := dec.Decode(&item)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, triageJSONError(err))
+		}
+
+		items = append(items, item)
+	}
+
+	// Read the closing bracket, and then check there's nothing after the array.
+	_, err = dec.Token()
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, triageJSONError(err)
+	}
+
+	// This mirrors the single object check in readJSON(): the decoder skips whitespace,
+	// so only a body which ends after the array gets an io.EOF error here. Anything
+	// else, whether another JSON value or garbage, means there's trailing data.
+	_, err = dec.Token()
+	if !errors.Is(err, io.EOF) {
+		return nil, errors.New("body must only contain a single JSON array")
+	}
+
+	return items, nil
+}
+
+// The triageJSONError() helper converts an error from decoding a request body into a
+// plain-english error message which is safe to send to the client.
+
+func triageJSONError(err error) error {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var invalidUnmarshalError *json.InvalidUnmarshalError
+
+	// Add a ndwmaxBytesError variable.
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	// Use the errors.As() function to check whether the error has the type
+	// *json.SyntaxErro. If it does, then return a plain-english error message
+	// which includes the ocation of the problem.
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+		// In some circumstances Decode() may also return an io.ErrUnexpectedEOF error
+		// for syntax errors in the JSON. So we check for this using errors.Is() and
+		// return a generic error message. There is an open issue regarding this a
+		// https://github.com/golang/go/issues/25956
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly-formed JSON")
+
+		// Likewise, catch any *json.UnmarshalTypeError errors. These occour when the
+		// JSON value is the wrong type for the target destination. If the eeor relates to a
+		// specific field, then we include that in our error message to mae it
+		// easier for the client to debug.
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field != "" {
+			return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+		}
+		return fmt.Errorf("body contains incorrect JSON type (at character %d)",
+			unmarshalTypeError.Offset)
+
+	// An io.EOF error will be returned by Decode() if the request body is empty. We
+	// check for this with errors.Is() and return a plain-english error message instead.
+	case errors.Is(err, io.EOF):
+		return errEmptyBody
+
+	// If the JSON contains a field which cannot be mapped to the target destination
+	// then Decode() will now return an error message in the format "json: unknown
+	// field "<name>"". We can check for this . extract the field name from the error,
+	// and interpolate it into our custom error message. Note that there's an open
+	// issue at https://github.com//golang/go/issues/29035 regarding turning this
+	// into a distinct error type in the future.
+
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return fmt.Errorf("body contains unknown key %s", fieldName)
+
+	// Use the errors.As() function to check whether the error has the type
+	// *http.MaxBytesError. If it does, then it means the request body exceed our
+	//size limit of 1MB and we return  aclear error message.
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+
+	// A json.InvalidUnmarshallError error will be returned if we pass something
+	// that is not a non-nil pointer to Decode(). We catch this and panic,
+	// rather than returning an error to ur handler. At the end of this chpater
+	// we will talk about panicking versus returing errors, and discuss why it's an
+	// appropriate thing to do in this specific situation.
+	case errors.As(err, &invalidUnmarshalError):
+		panic(err)
+	// for anything else, return the error message as-is
+	default:
+		return err
+	}
+}
+
+// The jsonNumberToInt64() helper converts a json.Number to an int64, returning an error
+// if it isn't an integer or is out of range.
+
+func jsonNumberToInt64(n json.Number) (int64, error) {
+	i, err := strconv.ParseInt(n.String(), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("must be an integer between %d and %d", math.MinInt64, math.MaxInt64)
+	}
+	return i, nil
+}
+
+// The jsonNumberToInt32() helper converts a json.Number to an int32, returning an error
+// if it isn't an integer or is out of range.
+
+func jsonNumberToInt32(n json.Number) (int32, error) {
+	i, err := strconv.ParseInt(n.String(), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("must be an integer between %d and %d", math.MinInt32, math.MaxInt32)
+	}
+	return int32(i), nil
+}
+
+// The checkQueryParams() helper records an error in the provided Validator instance if
+// the query string contains any keys which aren't in the allowed list, so that clients
+// can catch typos like ?sortt=. It only does this if the -strict-query-params flag is
+// set; otherwise unknown parameters are ignored.
+
+func (app *application) checkQueryParams(qs url.Values, allowed []string, v *validator.Validator) {
+	if !app.config.strictQueryParams {
+		return
+	}
+
+	var unknown []string
+	for key := range qs {
+		if !validator.PermittedValue(key, allowed...) {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		v.AddError("query", "must not contain unknown query parameters: "+strings.Join(unknown, ", "))
+	}
+}
+
+// The requestLocale() helper returns the language the client wants validation messages
+// in. This is taken from the ?lang= query string parameter if present, otherwise from
+// the configured locale header (Accept-Language by default). Only the primary language
+// subtag of the first preference is used, so "de-CH,de;q=0.9" gives "de".
+
+func (app *application) requestLocale(r *http.Request) string {
+	locale := r.URL.Query().Get("lang")
+	if locale == "" && app.config.localeHeader != "" {
+		locale = r.Header.Get(app.config.localeHeader)
+	}
+
+	locale, _, _ = strings.Cut(locale, ",")
+	locale, _, _ = strings.Cut(locale, ";")
+	locale, _, _ = strings.Cut(locale, "-")
+
+	return strings.ToLower(strings.TrimSpace(locale))
+}
+
+// The newValidator() helper returns a Validator which produces error messages in the
+// request's locale, falling back to English, and which collects at most the number of
+// errors set by the -max-validation-errors flag.
+
+func (app *application) newValidator(r *http.Request) *validator.Validator {
+	v := validator.NewLocalized(app.requestLocale(r))
+	v.MaxErrors = app.config.maxValidationErrors
+	return v
+}
+
 // The readString() helper returns a string value from the query string, or fht provided
 // default value if no matching key could be found.
 
@@ -204,6 +647,97 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return strings.Split(csv, ",")
 }
 
+// The readGenresFilter() helper reads the genres filter for list endpoints. If the
+// genres parameter is absent it returns an empty slice, which matches every movie. If
+// it is present but blank, the result depends on the -empty-genres-filter setting: an
+// empty slice for "all", or nil (which matches only movies with no genres) for "none".
+
+func (app *application) readGenresFilter(qs url.Values) []string {
+	if qs.Has("genres") && qs.Get("genres") == "" && app.config.emptyGenresFilter == "none" {
+		return nil
+	}
+
+	return app.readCSV(qs, "genres", []string{})
+}
+
+// genreList is used in place of a []string for the genres in a request body. Decoding
+// stops as soon as there are more than data.MaxGenres values and sets TooMany instead,
+// so that a malicious body with a huge genres array isn't decoded into memory in full.
+type genreList struct {
+	Values  []string
+	TooMany bool
+}
+
+func (g *genreList) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	// A JSON null leaves the genres unset, just like it would for a []string.
+	if tok == nil {
+		g.Values = nil
+		return nil
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return &json.UnmarshalTypeError{Value: fmt.Sprint(tok), Type: reflect.TypeOf(g.Values)}
+	}
+
+	g.Values = []string{}
+
+	for dec.More() {
+		if len(g.Values) == data.MaxGenres {
+			g.Values = nil
+			g.TooMany = true
+			return nil
+		}
+
+		var genre string
+		err := dec.Decode(&genre)
+		if err != nil {
+			return err
+		}
+		g.Values = append(g.Values, genre)
+	}
+
+	return nil
+}
+
+// A fieldMask holds the set of fields which an update request is restricted to. A nil
+// mask means that no restriction was given, so every field is included.
+type fieldMask map[string]bool
+
+func (m fieldMask) includes(field string) bool {
+	return m == nil || m[field]
+}
+
+// The readFieldMask() helper reads a comma-separated list of field names from the query
+// string. If no matching key could be found it returns a nil mask. Any field which isn't
+// in the knownFields list is recorded as an error in the provided Validator instance.
+
+func (app *application) readFieldMask(qs url.Values, key string, knownFields []string, v *validator.Validator) fieldMask {
+	fields := app.readCSV(qs, key, nil)
+	if fields == nil {
+		return nil
+	}
+
+	mask := make(fieldMask, len(fields))
+
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if !validator.PermittedValue(field, knownFields...) {
+			v.AddError(key, fmt.Sprintf("contains unknown field %q", field))
+			continue
+		}
+		mask[field] = true
+	}
+
+	return mask
+}
+
 // The readInt() helper reads a string value from the query string and converts it into an
 // integer before returning. If no matching key could be found it returns the provided
 // default value. If the value couldn't be converted to an integer, then we record an
@@ -233,12 +767,263 @@ func (app *application) readInt(qs url.Values,
 	return i
 }
 
-func (app *application) background(fn func()) {
+// The readBool() helper reads a boolean value from the query string. It accepts true or
+// 1 and false or 0, ignoring case, rather than everything strconv.ParseBool() does, so
+// that a typo like ?include_deleted=t is reported instead of quietly accepted. If no
+// matching key could be found it returns the provided default value. If the value is
+// anything else, then we record an error message in the provided Validator instance.
+
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	switch strings.ToLower(s) {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	default:
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+}
+
+// The readDate() helper reads a date from the query string, given either as an RFC 3339
+// timestamp, like 2024-01-02T15:04:05Z, or as a plain date, like 2024-01-02, which is
+// taken as midnight UTC. If no matching key could be found it returns the provided
+// default value. If the value couldn't be parsed as either, then we record an error
+// message in the provided Validator instance.
+
+func (app *application) readDate(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+
+	v.AddError(key, "must be a valid date")
+	return defaultValue
+}
+
+// The decodeQuery() helper populates the fields of the struct pointed to by dst from the
+// query string, using each field's query struct tag as the parameter name. Fields of
+// embedded structs are populated too. Absent or empty parameters leave the field
+// unchanged, so set any defaults before calling it. string, int, bool and []string
+// (comma separated) fields are supported, and values which can't be parsed are recorded
+// in the Validator, as with readInt() and readBool().
+
+func (app *application) decodeQuery(qs url.Values, dst any, v *validator.Validator) {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		panic("decodeQuery: dst must be a pointer to a struct")
+	}
+	app.decodeQueryStruct(qs, rv.Elem(), v)
+}
+
+func (app *application) decodeQueryStruct(qs url.Values, rv reflect.Value, v *validator.Validator) {
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field, fv := rt.Field(i), rv.Field(i)
+
+		key, ok := field.Tag.Lookup("query")
+		if !ok {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				app.decodeQueryStruct(qs, fv, v)
+			}
+			continue
+		}
+
+		switch {
+		case fv.Kind() == reflect.String:
+			fv.SetString(app.readString(qs, key, fv.String()))
+		case fv.Kind() == reflect.Int:
+			fv.SetInt(int64(app.readInt(qs, key, int(fv.Int()), v)))
+		case fv.Kind() == reflect.Bool:
+			fv.SetBool(app.readBool(qs, key, fv.Bool(), v))
+		case fv.Type() == reflect.TypeOf([]string(nil)):
+			fv.Set(reflect.ValueOf(app.readCSV(qs, key, fv.Interface().([]string))))
+		default:
+			panic(fmt.Sprintf("decodeQuery: unsupported type %s for field %s", fv.Type(), field.Name))
+		}
+	}
+}
+
+// streamFlushRows is the number of rows streamRows() writes between flushes.
+const streamFlushRows = 100
+
+// The streamRows() helper streams a large result set to the client a row at a time,
+// without holding it all in memory. It calls fetch to run the query, and then encode for
+// each row, which should scan the row and write it to w. Every streamFlushRows rows, and
+// at the end, the response is flushed so that the client sees progress and the server
+// doesn't buffer the whole response. The caller must set any response headers first.
+//
+// Nothing is written until fetch has succeeded, so if it fails the client gets the usual
+// 500 response. The fetch function can therefore write a preamble, like a CSV header
+// row, once its query has succeeded. An error after that can only be logged, as the
+// status code has already been sent, and the client is left with a truncated response.
+//
+// Encoders which buffer their output, like csv.Writer, should flush it into w after each
+// row. The http.ResponseWriter does its own buffering, so this is cheap.
+
+func (app *application) streamRows(w http.ResponseWriter, r *http.Request, fetch func() (*sql.Rows, error), encode func(*sql.Rows) error) {
+	rows, err := fetch()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	rc := http.NewResponseController(w)
+
+	// flush() flushes the response, which is only possible if the underlying
+	// http.ResponseWriter supports it. If it doesn't, the response is sent as the
+	// buffer fills up instead.
+	flush := func() error {
+		err := rc.Flush()
+		if errors.Is(err, http.ErrNotSupported) {
+			return nil
+		}
+		return err
+	}
+
+	for n := 1; rows.Next(); n++ {
+		err = encode(rows)
+		if err != nil {
+			app.logError(r, fmt.Errorf("streaming row %d: %w", n, err))
+			return
+		}
+
+		if n%streamFlushRows == 0 {
+			err = flush()
+			if err != nil {
+				app.logError(r, fmt.Errorf("streaming row %d: %w", n, err))
+				return
+			}
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		app.logError(r, fmt.Errorf("streaming rows: %w", err))
+		return
+	}
+
+	err = flush()
+	if err != nil {
+		app.logError(r, fmt.Errorf("streaming rows: %w", err))
+	}
+}
+
+// The background() helper runs fn in a new goroutine, tracked by the application
+// WaitGroup so that graceful shutdown waits for it. If the maximum number of background
+// tasks are already running, the caller blocks until one of them finishes, but for no
+// longer than the -background-wait flag allows. After that it gives up, increments the
+// background_queue_full metric and returns errBackgroundQueueFull, which handlers
+// translate into a 503 response using serviceUnavailableResponse(). Use this for work
+// which should wait its turn, like sending a welcome email.
+
+func (app *application) background(fn func()) error {
+	err := app.reserveBackground()
+	if err != nil {
+		return err
+	}
+	app.runBackground(fn)
+	return nil
+}
+
+// The tryBackground() helper is the non-blocking variant of background(). If there is
+// no free slot it doesn't start fn, increments the background_queue_full metric and
+// returns errBackgroundQueueFull, which handlers can translate into a 503 response using
+// serviceUnavailableResponse(). Use this for non-critical work which can shed load.
+
+func (app *application) tryBackground(fn func()) error {
+	err := app.tryReserveBackground()
+	if err != nil {
+		return err
+	}
+	app.runBackground(fn)
+	return nil
+}
+
+// The reserveBackground() helper takes a background slot in the same way as
+// background(), without starting a task in it. Handlers which write to the database
+// before queueing an email use it to find out that the queue is full before they change
+// anything. The slot must then be passed to runBackground(), or given back with
+// releaseBackground().
+
+func (app *application) reserveBackground() error {
+	if app.backgroundSlots == nil {
+		return nil
+	}
+
+	// Take a free slot straight away if there is one, as a timer which has already
+	// fired would otherwise compete with it.
+	select {
+	case app.backgroundSlots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(app.config.background.wait)
+	defer timer.Stop()
+
+	select {
+	case app.backgroundSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		backgroundQueueFull.Add(1)
+		return errBackgroundQueueFull
+	}
+}
+
+// The tryReserveBackground() helper is the non-blocking variant of reserveBackground().
+
+func (app *application) tryReserveBackground() error {
+	if app.backgroundSlots == nil {
+		return nil
+	}
+
+	select {
+	case app.backgroundSlots <- struct{}{}:
+		return nil
+	default:
+		backgroundQueueFull.Add(1)
+		return errBackgroundQueueFull
+	}
+}
+
+// The releaseBackground() helper gives back a slot taken by reserveBackground() or
+// tryReserveBackground() which won't be used, for example because the handler failed
+// before it could queue its task.
+
+func (app *application) releaseBackground() {
+	if app.backgroundSlots != nil {
+		<-app.backgroundSlots
+	}
+}
+
+// The runBackground() helper runs fn in a slot which has already been reserved, and
+// releases the slot when fn returns.
+
+func (app *application) runBackground(fn func()) {
 	// Launch a background goroutine.
 	app.wg.Add(1)
 
 	go func() {
 		defer app.wg.Done()
+		// Release the slot which was reserved for fn.
+		defer app.releaseBackground()
 		defer func() {
 			if err := recover(); err != nil {
 				app.logger.Error(fmt.Sprintf("%v", err))
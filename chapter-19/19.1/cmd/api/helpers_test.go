@@ -0,0 +1,792 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestTryBackgroundQueueFull(t *testing.T) {
+	app := newTestApplication(t)
+	app.backgroundSlots = make(chan struct{}, 1)
+
+	// Occupy the only slot with a task which blocks until we release it.
+	release := make(chan struct{})
+	err := app.background(func() {
+		<-release
+	})
+	assert.NilError(t, err)
+
+	before := backgroundQueueFull.Value()
+
+	ran := false
+	err = app.tryBackground(func() {
+		ran = true
+	})
+	if !errors.Is(err, errBackgroundQueueFull) {
+		t.Errorf("got error %v; want %v", err, errBackgroundQueueFull)
+	}
+	if got := backgroundQueueFull.Value(); got != before+1 {
+		t.Errorf("got background_queue_full %d; want %d", got, before+1)
+	}
+
+	close(release)
+	app.wg.Wait()
+
+	if ran {
+		t.Error("rejected task was run")
+	}
+
+	// Once the slot has been released, new tasks are accepted again.
+	err = app.tryBackground(func() {})
+	if err != nil {
+		t.Errorf("got error %v; want nil", err)
+	}
+	app.wg.Wait()
+}
+
+func TestBackgroundQueueFull(t *testing.T) {
+	app := newTestApplication(t)
+	app.backgroundSlots = make(chan struct{}, 1)
+	app.config.background.wait = 20 * time.Millisecond
+
+	release := make(chan struct{})
+	err := app.background(func() {
+		<-release
+	})
+	assert.NilError(t, err)
+
+	before := backgroundQueueFull.Value()
+
+	// With the only slot taken, background() waits briefly and then gives up.
+	start := time.Now()
+	err = app.background(func() {
+		t.Error("rejected task was run")
+	})
+	if !errors.Is(err, errBackgroundQueueFull) {
+		t.Errorf("got error %v; want %v", err, errBackgroundQueueFull)
+	}
+	if elapsed := time.Since(start); elapsed < app.config.background.wait {
+		t.Errorf("gave up after %s; want at least %s", elapsed, app.config.background.wait)
+	}
+	if got := backgroundQueueFull.Value(); got != before+1 {
+		t.Errorf("got background_queue_full %d; want %d", got, before+1)
+	}
+
+	// A slot which frees up during the wait is taken.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(release)
+	}()
+	app.config.background.wait = time.Second
+	err = app.background(func() {})
+	assert.NilError(t, err)
+	app.wg.Wait()
+}
+
+func TestReadJSONEmptyBody(t *testing.T) {
+	app := newTestApplication(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(""))
+	err := app.readJSON(httptest.NewRecorder(), r, &struct{}{})
+	assert.Equal(t, err, errEmptyBody)
+}
+
+func TestReadJSONArray(t *testing.T) {
+	type item struct {
+		Title string `json:"title"`
+		Year  int32  `json:"year"`
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		want    []item
+		wantErr string
+	}{
+		{
+			name: "Valid",
+			body: `[{"title": "Moana", "year": 2016}, {"title": "Up", "year": 2009}]`,
+			want: []item{{Title: "Moana", Year: 2016}, {Title: "Up", Year: 2009}},
+		},
+		{
+			name: "Empty array",
+			body: `[]`,
+			want: []item{},
+		},
+		{
+			name:    "Unknown field",
+			body:    `[{"title": "Moana"}, {"title": "Up", "rating": 5}]`,
+			wantErr: `item 1: body contains unknown key "rating"`,
+		},
+		{
+			name:    "Wrong type",
+			body:    `[{"title": "Moana", "year": "2016"}]`,
+			wantErr: `item 0: body contains incorrect JSON type for field "year"`,
+		},
+		{
+			name:    "Truncated",
+			body:    `[{"title": "Moana"}`,
+			wantErr: "item 1: body contains badly-formed JSON (at character 19)",
+		},
+		{
+			name:    "Object",
+			body:    `{"title": "Moana"}`,
+			wantErr: "body must contain a JSON array",
+		},
+		{
+			name:    "Empty body",
+			body:    ``,
+			wantErr: "body must not be empty",
+		},
+		{
+			name:    "Trailing array",
+			body:    `[{"title": "Moana"}] [{"title": "Up"}]`,
+			wantErr: "body must only contain a single JSON array",
+		},
+		{
+			name:    "Trailing garbage",
+			body:    `[{"title": "Moana"}] garbage`,
+			wantErr: "body must only contain a single JSON array",
+		},
+		{
+			name:    "Trailing object",
+			body:    `[{"title": "Moana"}]{}`,
+			wantErr: "body must only contain a single JSON array",
+		},
+		{
+			name: "Trailing whitespace",
+			body: "[{\"title\": \"Moana\"}] \n\t\r\n",
+			want: []item{{Title: "Moana"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+
+			got, err := readJSONArray[item](httptest.NewRecorder(), r)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("got nil error; want %q", tt.wantErr)
+				}
+				assert.Equal(t, err.Error(), tt.wantErr)
+				return
+			}
+
+			assert.NilError(t, err)
+			assert.Equal(t, got, tt.want)
+		})
+	}
+}
+
+func TestReadJSONUseNumber(t *testing.T) {
+	app := newTestApplication(t)
+
+	// 2^53 + 1 can't be represented exactly by a float64.
+	body := `{"id": 9007199254740993, "year": 2016}`
+
+	r, err := http.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var input map[string]any
+	err = app.readJSON(httptest.NewRecorder(), r, &input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, ok := input["id"].(json.Number)
+	if !ok {
+		t.Fatalf("got id of type %T; want json.Number", input["id"])
+	}
+
+	id, err := jsonNumberToInt64(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 9007199254740993 {
+		t.Errorf("got id %d; want %d", id, int64(9007199254740993))
+	}
+
+	year, err := jsonNumberToInt32(input["year"].(json.Number))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if year != 2016 {
+		t.Errorf("got year %d; want 2016", year)
+	}
+
+	// Values which don't fit into an int32 should be rejected.
+	_, err = jsonNumberToInt32(n)
+	if err == nil {
+		t.Error("got nil error converting an out of range number to int32")
+	}
+}
+
+func TestWriteCreated(t *testing.T) {
+	app := newTestApplication(t)
+
+	r, err := http.NewRequest(http.MethodPost, "/v1/movies", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.writeCreated(w, r, "/v1/movies/7", envelope{"movie": map[string]any{"id": 7}})
+	})
+
+	code, headers, body := execute(t, handler, r)
+
+	if code != http.StatusCreated {
+		t.Errorf("got status %d; want %d", code, http.StatusCreated)
+	}
+	if got := headers.Get("Location"); got != "/v1/movies/7" {
+		t.Errorf("got Location %q; want %q", got, "/v1/movies/7")
+	}
+
+	js := decodeJSON(t, body)
+	if _, ok := js["movie"]; !ok {
+		t.Errorf("response missing created resource: %s", body)
+	}
+}
+
+func TestRequestLocale(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name   string
+		url    string
+		header string
+		want   string
+	}{
+		{name: "Query parameter", url: "/?lang=de", want: "de"},
+		{name: "Header with region and weights", url: "/", header: "de-CH,de;q=0.9,en;q=0.8", want: "de"},
+		{name: "Query parameter wins", url: "/?lang=en", header: "de", want: "en"},
+		{name: "Neither", url: "/", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				r.Header.Set("Accept-Language", tt.header)
+			}
+
+			if got := app.requestLocale(r); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadGenresFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		query string
+		want  []string
+	}{
+		{name: "Absent", mode: "none", query: "", want: []string{}},
+		{name: "Blank matches all", mode: "all", query: "genres=", want: []string{}},
+		{name: "Blank matches none", mode: "none", query: "genres=", want: nil},
+		{name: "Values", mode: "none", query: "genres=drama,war", want: []string{"drama", "war"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.emptyGenresFilter = tt.mode
+
+			qs, err := url.ParseQuery(tt.query)
+			assert.NilError(t, err)
+
+			assert.Equal(t, app.readGenresFilter(qs), tt.want)
+		})
+	}
+}
+
+func TestReadBool(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		defaultValue bool
+		want         bool
+		wantErr      bool
+	}{
+		{name: "Absent", query: "", defaultValue: true, want: true},
+		{name: "Empty", query: "partial=", defaultValue: true, want: true},
+		{name: "True", query: "partial=true", want: true},
+		{name: "One", query: "partial=1", want: true},
+		{name: "Upper case", query: "partial=TRUE", want: true},
+		{name: "False", query: "partial=false", defaultValue: true, want: false},
+		{name: "Zero", query: "partial=0", defaultValue: true, want: false},
+		{name: "Abbreviated", query: "partial=t", defaultValue: true, want: true, wantErr: true},
+		{name: "Yes", query: "partial=yes", want: false, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			qs, err := url.ParseQuery(tt.query)
+			assert.NilError(t, err)
+
+			v := validator.New()
+			assert.Equal(t, app.readBool(qs, "partial", tt.defaultValue, v), tt.want)
+
+			if tt.wantErr {
+				assert.Equal(t, v.Errors, map[string]string{"partial": "must be a boolean value"})
+			} else {
+				assert.Equal(t, v.Valid(), true)
+			}
+		})
+	}
+}
+
+func TestReadDate(t *testing.T) {
+	fallback := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		query   string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "Absent", query: "", want: fallback},
+		{name: "Date", query: "created_after=2024-03-15", want: time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{name: "RFC 3339", query: "created_after=2024-03-15T09:30:00Z", want: time.Date(2024, 3, 15, 9, 30, 0, 0, time.UTC)},
+		{name: "Offset", query: "created_after=2024-03-15T09:30:00%2B02:00", want: time.Date(2024, 3, 15, 7, 30, 0, 0, time.UTC)},
+		{name: "Invalid day", query: "created_after=2024-02-30", want: fallback, wantErr: true},
+		{name: "Not a date", query: "created_after=yesterday", want: fallback, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			qs, err := url.ParseQuery(tt.query)
+			assert.NilError(t, err)
+
+			v := validator.New()
+			got := app.readDate(qs, "created_after", fallback, v)
+			if !got.Equal(tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+
+			if tt.wantErr {
+				assert.Equal(t, v.Errors, map[string]string{"created_after": "must be a valid date"})
+			} else {
+				assert.Equal(t, v.Valid(), true)
+			}
+		})
+	}
+}
+
+func TestResourceURL(t *testing.T) {
+	proxy := netip.MustParsePrefix("10.0.0.0/8")
+
+	tests := []struct {
+		name           string
+		baseURL        string
+		trustedProxies []netip.Prefix
+		remoteAddr     string
+		tls            bool
+		headers        map[string]string
+		want           string
+	}{
+		{
+			name:       "Direct",
+			remoteAddr: "203.0.113.7:51000",
+			want:       "http://api.example.com/v1/movies/42",
+		},
+		{
+			name:       "Direct over TLS",
+			remoteAddr: "203.0.113.7:51000",
+			tls:        true,
+			want:       "https://api.example.com/v1/movies/42",
+		},
+		{
+			name:           "Trusted proxy",
+			trustedProxies: []netip.Prefix{proxy},
+			remoteAddr:     "10.1.2.3:51000",
+			headers:        map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "movies.example.org"},
+			want:           "https://movies.example.org/v1/movies/42",
+		},
+		{
+			name:           "Trusted proxy chain",
+			trustedProxies: []netip.Prefix{proxy},
+			remoteAddr:     "10.1.2.3:51000",
+			headers:        map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "movies.example.org, internal:4000"},
+			want:           "https://movies.example.org/v1/movies/42",
+		},
+		{
+			name:           "Trusted proxy terminating TLS",
+			trustedProxies: []netip.Prefix{proxy},
+			remoteAddr:     "10.1.2.3:51000",
+			headers:        map[string]string{"X-Forwarded-Proto": "HTTPS"},
+			want:           "https://api.example.com/v1/movies/42",
+		},
+		{
+			name:           "Trusted proxy over IPv6",
+			trustedProxies: []netip.Prefix{proxy},
+			remoteAddr:     "[::ffff:10.1.2.3]:51000",
+			headers:        map[string]string{"X-Forwarded-Proto": "https"},
+			want:           "https://api.example.com/v1/movies/42",
+		},
+		{
+			name:           "Trusted proxy with unknown scheme",
+			trustedProxies: []netip.Prefix{proxy},
+			remoteAddr:     "10.1.2.3:51000",
+			headers:        map[string]string{"X-Forwarded-Proto": "javascript"},
+			want:           "http://api.example.com/v1/movies/42",
+		},
+		{
+			name:       "No trusted proxies",
+			remoteAddr: "10.1.2.3:51000",
+			headers:    map[string]string{"X-Forwarded-Proto": "https"},
+			want:       "http://api.example.com/v1/movies/42",
+		},
+		{
+			name:           "Untrusted proxy",
+			trustedProxies: []netip.Prefix{proxy},
+			remoteAddr:     "203.0.113.7:51000",
+			headers:        map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.net"},
+			want:           "http://api.example.com/v1/movies/42",
+		},
+		{
+			name:           "Base URL override",
+			baseURL:        "https://public.example.com",
+			trustedProxies: []netip.Prefix{proxy},
+			remoteAddr:     "10.1.2.3:51000",
+			headers:        map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "movies.example.org"},
+			want:           "https://public.example.com/v1/movies/42",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.baseURL = tt.baseURL
+			app.config.trustedProxies = tt.trustedProxies
+
+			target := "http://api.example.com/v1/movies"
+			if tt.tls {
+				target = "https://api.example.com/v1/movies"
+			}
+
+			r := httptest.NewRequest(http.MethodPost, target, nil)
+			r.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			assert.Equal(t, app.resourceURL(r, "movies", 42), tt.want)
+		})
+	}
+}
+
+func TestFailedValidationResponseOmitted(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.maxValidationErrors = 2
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := app.newValidator(r)
+		for _, key := range []string{"title", "year", "runtime"} {
+			v.AddError(key, "must be provided")
+		}
+		app.failedValidationResponse(w, r, v)
+	})
+
+	status, _, body := execute(t, h, httptest.NewRequest(http.MethodPost, "/v1/movies", nil))
+	assert.Status(t, status, http.StatusUnprocessableEntity)
+
+	js := decodeJSON(t, body)
+	assert.Equal(t, len(js["error"].(map[string]any)), 2)
+	assert.Equal(t, js["note"], any("additional errors omitted"))
+
+	// Below the limit there is no note.
+	app.config.maxValidationErrors = 10
+
+	status, _, body = execute(t, h, httptest.NewRequest(http.MethodPost, "/v1/movies", nil))
+	assert.Status(t, status, http.StatusUnprocessableEntity)
+
+	js = decodeJSON(t, body)
+	assert.Equal(t, len(js["error"].(map[string]any)), 3)
+	if _, ok := js["note"]; ok {
+		t.Errorf("got note %v; want none", js["note"])
+	}
+}
+
+func TestDecodeQuery(t *testing.T) {
+	type movieFilters struct {
+		Title    string   `query:"title"`
+		Genres   []string `query:"genres"`
+		Featured bool     `query:"featured"`
+		Internal string
+		data.Filters
+	}
+
+	app := newTestApplication(t)
+
+	qs, err := url.ParseQuery("title=moana&genres=animation,musical&featured=true&page=abc&page_size=5&year_from=2010&Internal=x")
+	assert.NilError(t, err)
+
+	input := movieFilters{Filters: data.Filters{Page: 1, PageSize: 20, Sort: "id"}}
+
+	v := validator.New()
+	app.decodeQuery(qs, &input, v)
+
+	want := movieFilters{
+		Title:    "moana",
+		Genres:   []string{"animation", "musical"},
+		Featured: true,
+		// The invalid page is recorded as an error and the default kept. Absent
+		// parameters and untagged fields are left alone.
+		Filters: data.Filters{Page: 1, PageSize: 5, Sort: "id", YearFrom: 2010},
+	}
+	assert.Equal(t, input, want)
+	assert.Equal(t, v.Errors, map[string]string{"page": "must be an integer value"})
+}
+
+// flushRecorder is a httptest.ResponseRecorder which records the length of the body
+// each time the response is flushed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []int
+}
+
+func (rr *flushRecorder) Flush() {
+	rr.flushes = append(rr.flushes, rr.Body.Len())
+	rr.ResponseRecorder.Flush()
+}
+
+func TestStreamRows(t *testing.T) {
+	app := newTestApplication(t)
+	// Answer the query with the integers 1 to 250, in a single column.
+	rc := rowsConnector{columns: []string{"n"}}
+	for n := range 2*streamFlushRows + 50 {
+		rc.rows = append(rc.rows, []driver.Value{int64(n + 1)})
+	}
+
+	db := sql.OpenDB(rc)
+	defer db.Close()
+
+	rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies.csv", nil)
+
+	app.streamRows(rr, r,
+		func() (*sql.Rows, error) {
+			return db.QueryContext(r.Context(), "SELECT n")
+		},
+		func(rows *sql.Rows) error {
+			var n int
+			err := rows.Scan(&n)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(rr, "%d\n", n)
+			return err
+		})
+
+	assert.Equal(t, rr.Code, http.StatusOK)
+
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	assert.Equal(t, len(lines), 2*streamFlushRows+50)
+	assert.Equal(t, lines[len(lines)-1], strconv.Itoa(2*streamFlushRows+50))
+
+	// The response is flushed after every streamFlushRows rows, and once more at the
+	// end, with more of the body each time.
+	if len(rr.flushes) != 3 {
+		t.Fatalf("got %d flushes; want 3", len(rr.flushes))
+	}
+	for i := 1; i < len(rr.flushes); i++ {
+		if rr.flushes[i] <= rr.flushes[i-1] {
+			t.Errorf("flush %d: body length %d; want more than %d", i+1, rr.flushes[i], rr.flushes[i-1])
+		}
+	}
+	assert.Equal(t, rr.flushes[2], rr.Body.Len())
+}
+
+func TestStreamRowsFetchError(t *testing.T) {
+	app := newTestApplication(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies.csv", nil)
+	rr := httptest.NewRecorder()
+
+	app.streamRows(rr, r,
+		func() (*sql.Rows, error) {
+			return nil, errors.New("connection refused")
+		},
+		func(rows *sql.Rows) error {
+			t.Error("encode called after fetch failed")
+			return nil
+		})
+
+	assert.Status(t, rr.Code, http.StatusInternalServerError)
+}
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{name: "Empty", ifNoneMatch: "", etag: `W/"7-3"`, want: false},
+		{name: "Weak match", ifNoneMatch: `W/"7-3"`, etag: `W/"7-3"`, want: true},
+		{name: "Strong header, weak ETag", ifNoneMatch: `"7-3"`, etag: `W/"7-3"`, want: true},
+		{name: "Weak header, strong ETag", ifNoneMatch: `W/"7-3"`, etag: `"7-3"`, want: true},
+		{name: "Different", ifNoneMatch: `W/"7-2"`, etag: `W/"7-3"`, want: false},
+		{name: "Unquoted", ifNoneMatch: `7-3`, etag: `W/"7-3"`, want: false},
+		{name: "Wildcard", ifNoneMatch: `*`, etag: `W/"7-3"`, want: true},
+		{name: "Wildcard with spaces", ifNoneMatch: ` * `, etag: `W/"7-3"`, want: true},
+		{name: "List", ifNoneMatch: `"7-1", W/"7-2", W/"7-3"`, etag: `W/"7-3"`, want: true},
+		{name: "List without spaces", ifNoneMatch: `W/"7-1",W/"7-3"`, etag: `W/"7-3"`, want: true},
+		{name: "List without match", ifNoneMatch: `W/"7-1", W/"7-2"`, etag: `W/"7-3"`, want: false},
+		{name: "Empty list items", ifNoneMatch: `, ,`, etag: `W/"7-3"`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, etagMatch(tt.ifNoneMatch, tt.etag), tt.want)
+		})
+	}
+}
+
+func TestPreferredFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: "json"},
+		{accept: "*/*", want: "json"},
+		{accept: "application/json", want: "json"},
+		{accept: "application/xml", want: "xml"},
+		{accept: "text/xml", want: "xml"},
+		{accept: "application/xml, application/json", want: "json"},
+		{accept: "application/json;q=0.5, application/xml", want: "xml"},
+		{accept: "application/xml;q=0.9, */*;q=0.1", want: "xml"},
+		{accept: "application/*, application/json;q=0", want: "xml"},
+		{accept: "text/html", want: "json"},
+		{accept: "text/csv", want: "csv"},
+		{accept: "text/csv;q=0.5, application/json", want: "json"},
+		{accept: "text/*", want: "xml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, preferredFormat(tt.accept), tt.want)
+		})
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	app := newTestApplication(t)
+
+	movie := &data.Movie{
+		ID:      1,
+		Title:   "Amélie",
+		Year:    2001,
+		Runtime: 122,
+		Genres:  []string{"comedy", "romance"},
+		Tags:    data.Tags{"language": "french"},
+		Version: 1,
+	}
+	metadata := data.Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 1}
+
+	t.Run("JSON", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+		rr := httptest.NewRecorder()
+
+		err := app.writeResponse(rr, r, http.StatusOK, envelope{"movie": movie}, nil)
+		assert.NilError(t, err)
+
+		assert.Equal(t, rr.Header().Get("Content-Type"), "application/json")
+		assert.Equal(t, rr.Header().Values("Vary"), []string{"Accept"})
+		assert.StringContains(t, rr.Body.String(), `"title": "Amélie"`)
+	})
+
+	t.Run("XML", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+		r.Header.Set("Accept", "application/xml")
+		rr := httptest.NewRecorder()
+
+		err := app.writeResponse(rr, r, http.StatusOK, envelope{"movie": movie}, nil)
+		assert.NilError(t, err)
+
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.Equal(t, rr.Header().Get("Content-Type"), "application/xml")
+
+		var got struct {
+			XMLName xml.Name `xml:"response"`
+			Movie   struct {
+				ID      int64    `xml:"id"`
+				Title   string   `xml:"title"`
+				Runtime string   `xml:"runtime"`
+				Genres  []string `xml:"genres>genre"`
+				Tags    []struct {
+					Key   string `xml:"key,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"tags>tag"`
+				Version int32 `xml:"version"`
+			} `xml:"movie"`
+		}
+		err = xml.Unmarshal(rr.Body.Bytes(), &got)
+		assert.NilError(t, err)
+
+		assert.Equal(t, got.Movie.ID, int64(1))
+		assert.Equal(t, got.Movie.Title, "Amélie")
+		assert.Equal(t, got.Movie.Runtime, "122 mins")
+		assert.Equal(t, got.Movie.Genres, []string{"comedy", "romance"})
+		assert.Equal(t, len(got.Movie.Tags), 1)
+		assert.Equal(t, got.Movie.Tags[0].Key, "language")
+		assert.Equal(t, got.Movie.Tags[0].Value, "french")
+		assert.Equal(t, got.Movie.Version, int32(1))
+	})
+
+	t.Run("XML list", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+		r.Header.Set("Accept", "application/xml")
+		rr := httptest.NewRecorder()
+
+		err := app.writeResponse(rr, r, http.StatusOK, envelope{
+			"movies":   data.ViewMovies([]*data.Movie{movie, {ID: 2, Title: "Moana"}}, data.MovieViewPublic),
+			"metadata": metadata,
+		}, nil)
+		assert.NilError(t, err)
+
+		var got struct {
+			Movies []struct {
+				ID    int64  `xml:"id"`
+				Title string `xml:"title"`
+			} `xml:"movies>movie"`
+			Metadata data.Metadata `xml:"metadata"`
+		}
+		err = xml.Unmarshal(rr.Body.Bytes(), &got)
+		assert.NilError(t, err)
+
+		assert.Equal(t, len(got.Movies), 2)
+		assert.Equal(t, got.Movies[1].Title, "Moana")
+		assert.Equal(t, got.Metadata, metadata)
+	})
+}
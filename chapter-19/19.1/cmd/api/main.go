@@ -2,13 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// Import the pq driver so that it can register itsel with the database/sql
@@ -18,6 +27,7 @@ import (
 	_ "github.com/lib/pq"
 	"greelight.techkunstler.com/internal/data"
 	"greelight.techkunstler.com/internal/mailer"
+	"greelight.techkunstler.com/internal/validator"
 	"greelight.techkunstler.com/internal/vcs"
 )
 
@@ -33,33 +43,203 @@ var (
 type config struct {
 	port int
 	env  string
-	db   struct {
+	// The certificate and key files to serve HTTPS with. If these aren't set the server
+	// uses plain HTTP.
+	tls struct {
+		certFile   string
+		keyFile    string
+		minVersion uint16
+	}
+	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  time.Duration
+		timeouts     data.Timeouts
 	}
 	// Add a new limiter struct containing fields for the requests-per-second and burst
 	// values, and a boolean field which we can use to enable/disable rate limiting
 	// altotether.
 
+	// The backend is "memory" for per-instance limits, or "redis" for limits shared
+	// through the Redis server given by the -limiter-redis-dsn flag. The rps and burst
+	// values in the limiter file, if there is one, take precedence over the flags, and
+	// are re-read on SIGHUP.
 	limiter struct {
 		rps     float64
 		burst   int
 		enabled bool
+		backend string
+		redis   redisOptions
+		file    string
 	}
 
 	smtp struct {
-		host     string
-		port     int
-		username string
-		password string
-		sender   string
+		host          string
+		port          int
+		username      string
+		password      string
+		sender        string
+		verifyOnStart bool
 	}
 
 	cors struct {
 		trustedOrigins []string
 	}
+
+	// The public base URL of the API, like https://api.example.com, used to build
+	// absolute resource URLs. If it isn't set, the URL is worked out from each request,
+	// using the X-Forwarded-Proto and X-Forwarded-Host headers if (and only if) the
+	// request came from one of the trusted proxies.
+	baseURL        string
+	trustedProxies []netip.Prefix
+
+	// The base URL of the API documentation. If set, rate limit and authentication
+	// error responses include a "more_info" link to the page for the error.
+	errorDocsBaseURL string
+
+	// The maximum number of background tasks (like sending emails) which may run at
+	// the same time. Once this is reached app.background() blocks until a slot frees up,
+	// for up to the wait duration, and app.tryBackground() fails fast instead.
+	background struct {
+		maxTasks int
+		wait     time.Duration
+	}
+
+	// The maximum number of requests which may be handled at the same time, across all
+	// clients. Requests beyond this get a 503 Service Unavailable response. Zero means
+	// no limit.
+	maxInFlight int
+
+	// The ID of this process, sent in the X-Served-By response header when enabled so
+	// that clients and logs can tell which instance handled a request. This is off by
+	// default as it leaks infrastructure detail.
+	instance struct {
+		id                    string
+		servedByHeaderEnabled bool
+	}
+
+	// Email domains which can't be used to register an account.
+	blockedEmailDomains []string
+
+	// The logical names of endpoints (see endpointNames) which respond with a 503 Service
+	// Unavailable, for example to temporarily turn off writes.
+	disabledEndpoints []string
+
+	// The endpoints deprecated with the -deprecated-endpoints flag, by name, in addition
+	// to those in the deprecatedEndpoints registry.
+	deprecatedEndpoints map[string]deprecation
+
+	// Feature flag values from the -feature flags, and the path of a file to read more
+	// from. The file is re-read when the process receives a SIGHUP signal, but the
+	// -feature flags always take precedence over it. See featureDefaults for the flags.
+	features     map[string]bool
+	featuresFile string
+
+	// The pagination limits for list endpoints.
+	filters data.FilterConfig
+
+	// Whether the API explorer at /docs, and the OpenAPI document it loads from
+	// /v1/openapi.json, are served. This is off by default, so that production servers
+	// don't advertise their API unless asked to.
+	docsEnabled bool
+
+	// Whether list endpoints reject unknown query string parameters.
+	strictQueryParams bool
+
+	// Whether movie genres must be in the canonical genre list.
+	strictGenres bool
+
+	// Whether duplicate movie genres are silently removed, instead of being rejected.
+	dedupeGenres bool
+
+	// Whether movie genres are sorted alphabetically before they are stored and when
+	// they are read, so that clients always see them in the same order.
+	sortGenres bool
+
+	// Whether the title search ignores accents. This needs the unaccent extension in
+	// the database.
+	searchAccentInsensitive bool
+
+	// How list endpoints treat a genres parameter which is present but blank, like
+	// ?genres=. With "all" (the default) it is ignored, the same as if it were absent.
+	// With "none" it matches only movies which have no genres (which, as the database
+	// requires at least one genre, means no movies at all).
+	emptyGenresFilter string
+
+	// Whether anonymous clients can list movies. They get a reduced projection of each
+	// movie, while authenticated users still need the "movies:read" permission and get
+	// the full record.
+	publicReads bool
+
+	// Whether to check the application's dependencies and exit with the result, rather
+	// than serving requests.
+	runSelfTest bool
+
+	// Whether a PATCH request for a movie which doesn't exist creates it, provided the
+	// body is a complete and valid movie. Clients can also opt in per request with the
+	// "Prefer: create-if-missing" header.
+	patchUpsert bool
+
+	// The request header which carries the client's preferred language for validation
+	// messages.
+	localeHeader string
+
+	// The minimum title similarity (0 to 1) for two movies to be reported as likely
+	// duplicates.
+	duplicatesThreshold float64
+
+	// Responses which take longer than this carry an X-Response-Time-Warning header.
+	// Zero disables the warning.
+	responseTimeBudget time.Duration
+
+	// Whether HTTP keep-alives are disabled.
+	disableKeepAlives bool
+
+	// Whether per-route request metrics are collected and served in the Prometheus text
+	// format at GET /metrics.
+	prometheusMetrics bool
+
+	// The maximum number of validation errors sent in a response. Zero means unlimited.
+	maxValidationErrors int
+
+	// The fraction (0.0 to 1.0) of successful requests which are logged. Errors and slow
+	// requests are always logged.
+	requestLogSampleRate float64
+
+	// Whether request and response bodies are logged at debug level. This is only
+	// allowed outside production, as bodies can hold personal data.
+	logBodies bool
+
+	// Settings for the readiness endpoint. It reports "degraded" once the fraction of
+	// the database pool's connections in use reaches poolThreshold (zero disables the
+	// check), and if degradedUnavailable is set, it fails with a 503 when it does. The
+	// 503 response tells clients to retry after retryAfter (zero leaves the header out).
+	readiness struct {
+		poolThreshold       float64
+		degradedUnavailable bool
+		retryAfter          time.Duration
+	}
+
+	// How long to keep serving requests after a shutdown signal, with the readiness
+	// endpoint reporting "not ready", before the server is shut down. This gives load
+	// balancers time to stop routing traffic to the instance.
+	shutdownDrainDelay time.Duration
+
+	// The maximum number of writes (create/update/delete) a user can make per day. Zero
+	// means unlimited.
+	dailyWriteQuota int
+
+	// How long a request is remembered for duplicate detection. An identical request
+	// from the same user within the window is rejected. Zero disables the check.
+	duplicateRequestWindow time.Duration
+
+	// Settings for movie cover image uploads. These have their own size limit, separate
+	// from the 1MB limit on JSON request bodies.
+	uploads struct {
+		maxBytes  int64
+		coversDir string
+	}
 }
 
 type application struct {
@@ -68,14 +248,55 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup
+	// The time at which the process started, used to report uptime.
+	startTime time.Time
+	// A counting semaphore bounding the number of running background tasks.
+	backgroundSlots chan struct{}
+	// A counting semaphore bounding the number of requests being handled, or nil if
+	// there is no limit.
+	inFlightSlots chan struct{}
+	// Per-user counts of today's write requests.
+	writeQuota *dailyQuota
+	// The hashes of recent create requests, or nil if duplicate detection is disabled.
+	recentRequests *recentRequests
+	// Set once shutdown has started, so that the readiness endpoint fails.
+	draining atomic.Bool
+	// The current feature flag values.
+	featureFlags *featureFlags
+	// The Prometheus metrics collector, or nil if -metrics-prometheus isn't set.
+	prometheus *promCollector
+	// The rate limiter store used by the rateLimit() middleware.
+	limiterStore rateLimiterStore
+	// The store for failed authentications by IP address, used by authenticate(). Like
+	// limiterStore, it's shared between instances when -limiter-backend=redis.
+	authFailures rateLimiterStore
+	// The database connection pool, whose statistics the readiness endpoint checks.
+	dbPool poolStatsProvider
 }
 
 func main() {
+	// Record the process start time as early as possible so that the uptime reported
+	// by the debug endpoint is accurate.
+	startTime := time.Now()
 
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 4000, "API Server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.tls.certFile, "tls-cert", "", "TLS certificate file (enables HTTPS together with -tls-key)")
+	flag.StringVar(&cfg.tls.keyFile, "tls-key", "", "TLS private key file")
+
+	// The minimum TLS version defaults to 1.2, and can be raised to 1.3.
+	cfg.tls.minVersion = tls.VersionTLS12
+	flag.Func("tls-min-version", "Minimum TLS version (1.2|1.3)", func(val string) error {
+		v, err := parseTLSVersion(val)
+		if err != nil {
+			return err
+		}
+		cfg.tls.minVersion = v
+		return nil
+	})
+
 	// Read the DSN value from the db-dsn command-line flag into the config struct. We
 	// default to using our development DSN if no flag is provided.
 
@@ -88,12 +309,31 @@ func main() {
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "Postgress max idle connection")
 	flag.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreeSQL max idel timeout")
 
+	// Read the timeouts for each kind of database operation.
+	flag.DurationVar(&cfg.db.timeouts.Read, "db-read-timeout", data.DefaultTimeouts.Read, "PostgreSQL read query timeout")
+	flag.DurationVar(&cfg.db.timeouts.Write, "db-write-timeout", data.DefaultTimeouts.Write, "PostgreSQL write query timeout")
+	flag.DurationVar(&cfg.db.timeouts.Bulk, "db-bulk-timeout", data.DefaultTimeouts.Bulk, "PostgreSQL bulk operation timeout")
+
 	// Create command line flags to read the setting values into the config struct.
 	// notice that we use true as default for the 'enabled' setting?
 
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum request per second.")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.backend, "limiter-backend", "memory", "Rate limiter store (memory|redis)")
+	flag.StringVar(&cfg.limiter.file, "limiter-file", "", "File of rate limiter settings (rps=N and burst=N lines), re-read on SIGHUP")
+
+	// The Redis DSN is parsed as soon as the flag is read, so that a bad value stops
+	// the application from starting.
+	cfg.limiter.redis, _ = parseRedisDSN("redis://localhost:6379/0")
+	flag.Func("limiter-redis-dsn", "Redis DSN for the redis rate limiter backend (default redis://localhost:6379/0)", func(val string) error {
+		opts, err := parseRedisDSN(val)
+		if err != nil {
+			return err
+		}
+		cfg.limiter.redis = opts
+		return nil
+	})
 
 	// Read the SMTP server configuration settings into the config struct, using the
 	// Mailtrap settings as the default values. IMPORTANT: If you're folliwng along,
@@ -106,19 +346,165 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "a8692e460679e1", "SMTP password")
 
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.techkunstler.com>", "SMTP sender")
+	flag.BoolVar(&cfg.smtp.verifyOnStart, "smtp-verify-on-start", false, "Check the SMTP server can be reached at startup")
 
 	// Use the flag.Func() to process the -cors-trusted-origins command line flag
 	// In this we use the strings.Fields() functionto split the flag value into a
 	// slice based on whitespace characters and assign it to our config struct.
 	// Importantly, if the -cors-trusted-origins flag is not present, contains the empty string
 	// or contains only whitespace, then string.Fields() will return an empty
-	// []string slice.
+	// []string slice. The flag can be repeated, and the origins from each are combined.
+
+	flag.Func("cors-trusted-origins", "Trusted CORS origins (space seperated, repeatable)", func(val string) error {
+		cfg.cors.trustedOrigins = append(cfg.cors.trustedOrigins, strings.Fields(val)...)
+		return nil
+	})
+
+	flag.IntVar(&cfg.background.maxTasks, "background-max-tasks", 100, "Maximum number of concurrent background tasks (0 = unlimited)")
+	flag.DurationVar(&cfg.background.wait, "background-wait", time.Second, "How long to wait for a free background task slot before failing the request")
+
+	flag.IntVar(&cfg.maxInFlight, "max-in-flight", 0, "Maximum number of requests handled at the same time (0 = unlimited)")
+
+	flag.StringVar(&cfg.instance.id, "instance-id", "", "Instance ID for the X-Served-By header (defaults to the hostname)")
+	flag.BoolVar(&cfg.instance.servedByHeaderEnabled, "served-by-header", false, "Send the X-Served-By response header")
+
+	flag.IntVar(&cfg.dailyWriteQuota, "daily-write-quota", 0, "Maximum writes per user per day (0 = unlimited)")
+	flag.DurationVar(&cfg.duplicateRequestWindow, "duplicate-request-window", 0, "Reject identical create requests from the same user within this window (e.g. 5s, 0 = disabled)")
+
+	flag.Func("blocked-email-domains", "Email domains not allowed at registration (space separated)", func(val string) error {
+		cfg.blockedEmailDomains = strings.Fields(val)
+		return nil
+	})
+
+	flag.Func("base-url", "Public base URL of the API, like https://api.example.com", func(val string) error {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("must be an absolute http or https URL")
+		}
+		cfg.baseURL = strings.TrimSuffix(val, "/")
+		return nil
+	})
+
+	flag.Func("error-docs-base-url", "Base URL of the error documentation, linked from error responses", func(val string) error {
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("must be an absolute http or https URL")
+		}
+		cfg.errorDocsBaseURL = strings.TrimSuffix(val, "/")
+		return nil
+	})
 
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space seperated)", func(val string) error {
-		cfg.cors.trustedOrigins = strings.Fields(val)
+	flag.Func("trusted-proxies", "Proxy IP addresses or CIDR ranges whose X-Forwarded-* headers are trusted (comma separated)", func(val string) error {
+		for _, s := range strings.Split(val, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+
+			// Accept a bare IP address as a single-address range.
+			if !strings.Contains(s, "/") {
+				addr, err := netip.ParseAddr(s)
+				if err != nil {
+					return err
+				}
+				cfg.trustedProxies = append(cfg.trustedProxies, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return err
+			}
+			cfg.trustedProxies = append(cfg.trustedProxies, prefix)
+		}
 		return nil
 	})
 
+	// The -feature flag can be repeated to set several feature flags.
+	cfg.features = make(map[string]bool)
+	flag.Func("feature", "Set a feature flag, like movies-duplicates=false (repeatable)", func(val string) error {
+		name, on, err := parseFeature(val)
+		if err != nil {
+			return err
+		}
+		cfg.features[name] = on
+		return nil
+	})
+	flag.StringVar(&cfg.featuresFile, "features-file", "", "File of feature flags, one name=value per line, re-read on SIGHUP")
+
+	flag.Func("disabled-endpoints", "Endpoints to disable, like movies:create (comma separated)", func(val string) error {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !slices.Contains(endpointNames, name) {
+				return fmt.Errorf("unknown endpoint %q", name)
+			}
+			cfg.disabledEndpoints = append(cfg.disabledEndpoints, name)
+		}
+		return nil
+	})
+
+	cfg.deprecatedEndpoints = make(map[string]deprecation)
+	flag.Func("deprecated-endpoints", "Endpoints to mark as deprecated, like movies:csv or movies:csv=2027-01-01 with a sunset date (comma separated)", func(val string) error {
+		for _, s := range strings.Split(val, ",") {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			name, d, err := parseDeprecation(s)
+			if err != nil {
+				return err
+			}
+			cfg.deprecatedEndpoints[name] = d
+		}
+		return nil
+	})
+
+	flag.BoolVar(&cfg.disableKeepAlives, "disable-keep-alives", false, "Disable HTTP keep-alives")
+	flag.IntVar(&cfg.maxValidationErrors, "max-validation-errors", validator.DefaultMaxErrors, "Maximum number of validation errors in a response (0 = unlimited)")
+	flag.Float64Var(&cfg.requestLogSampleRate, "request-log-sample-rate", 1, "Fraction of successful requests to log (0.0-1.0)")
+	flag.BoolVar(&cfg.logBodies, "log-bodies", false, "Log request and response bodies at debug level, with secrets redacted (not allowed in production)")
+	flag.DurationVar(&cfg.shutdownDrainDelay, "shutdown-drain-delay", 0, "Time to keep serving with readiness failing before shutting down (e.g. 10s)")
+	flag.Float64Var(&cfg.readiness.poolThreshold, "readiness-pool-threshold", 0, "Fraction of database connections in use (0.0-1.0) at which readiness reports degraded (0 = disabled)")
+	flag.BoolVar(&cfg.readiness.degradedUnavailable, "readiness-degraded-unavailable", false, "Fail the readiness check with a 503 when it reports degraded")
+	flag.DurationVar(&cfg.readiness.retryAfter, "readiness-retry-after", 5*time.Second, "Retry-After sent when the readiness check fails on a dependency or because it is degraded (0 = none)")
+
+	flag.IntVar(&cfg.filters.MaxPage, "filters-max-page", data.DefaultFilterConfig.MaxPage, "Maximum page number for list endpoints")
+	flag.IntVar(&cfg.filters.MaxPageSize, "filters-max-page-size", data.DefaultFilterConfig.MaxPageSize, "Maximum page size for list endpoints")
+	flag.IntVar(&cfg.filters.DefaultPageSize, "filters-default-page-size", data.DefaultFilterConfig.DefaultPageSize, "Default page size for list endpoints")
+
+	flag.BoolVar(&cfg.docsEnabled, "docs-enabled", false, "Serve the API explorer at /docs and the OpenAPI document at /v1/openapi.json")
+
+	flag.BoolVar(&cfg.strictQueryParams, "strict-query-params", false, "Reject unknown query string parameters")
+
+	flag.BoolVar(&cfg.strictGenres, "strict-genres", false, "Reject movie genres which aren't in the canonical list")
+
+	flag.BoolVar(&cfg.dedupeGenres, "dedupe-genres", false, "Normalize movie genres and remove duplicates instead of rejecting them")
+
+	flag.BoolVar(&cfg.sortGenres, "sort-genres", false, "Store and return movie genres in alphabetical order")
+
+	flag.BoolVar(&cfg.searchAccentInsensitive, "search-accent-insensitive", false, "Ignore accents in the title search (needs the unaccent extension)")
+
+	flag.StringVar(&cfg.emptyGenresFilter, "empty-genres-filter", "all", "What a blank ?genres= matches (all|none)")
+
+	flag.BoolVar(&cfg.publicReads, "public-reads", false, "Allow anonymous clients to list movies (id, title and year only)")
+
+	flag.BoolVar(&cfg.patchUpsert, "patch-upsert", false, "Create missing movies on PATCH when the body is a complete movie")
+
+	flag.StringVar(&cfg.localeHeader, "locale-header", "Accept-Language", "Request header to read the client locale from (empty to disable)")
+
+	flag.Float64Var(&cfg.duplicatesThreshold, "duplicates-threshold", 0.6, "Minimum title similarity (0-1) for duplicate detection")
+
+	flag.DurationVar(&cfg.responseTimeBudget, "response-time-budget", 500*time.Millisecond, "Response time above which a warning header is sent (0 = disabled)")
+
+	flag.Int64Var(&cfg.uploads.maxBytes, "max-upload-bytes", 5*1024*1024, "Maximum size of a cover image upload in bytes")
+	flag.StringVar(&cfg.uploads.coversDir, "covers-dir", "./covers", "Directory to store movie cover images in")
+
+	flag.BoolVar(&cfg.runSelfTest, "run-selftest", false, "Check the database, schema, permissions and mailer, then exit")
+
+	flag.BoolVar(&cfg.prometheusMetrics, "metrics-prometheus", false, "Serve per-route request metrics in the Prometheus format at /metrics")
+
 	// Create a new version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -127,13 +513,95 @@ func main() {
 		fmt.Printf("Version:\t%s\n", version)
 		os.Exit(0)
 	}
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// Bodies are logged at debug level, so logging them needs the debug level turned on.
+	var logOptions slog.HandlerOptions
+	if cfg.logBodies {
+		logOptions.Level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &logOptions))
+
+	if cfg.logBodies && cfg.env == "production" {
+		logger.Error("-log-bodies can't be used in production")
+		os.Exit(1)
+	}
+
+	if cfg.duplicatesThreshold < 0 || cfg.duplicatesThreshold > 1 {
+		logger.Error("-duplicates-threshold must be between 0 and 1")
+		os.Exit(1)
+	}
+
+	if cfg.uploads.maxBytes < 1 {
+		logger.Error("-max-upload-bytes must be greater than zero")
+		os.Exit(1)
+	}
+
+	if cfg.emptyGenresFilter != "all" && cfg.emptyGenresFilter != "none" {
+		logger.Error("-empty-genres-filter must be all or none")
+		os.Exit(1)
+	}
+
+	if cfg.limiter.backend != "memory" && cfg.limiter.backend != "redis" {
+		logger.Error("-limiter-backend must be memory or redis")
+		os.Exit(1)
+	}
+
+	if cfg.maxValidationErrors < 0 {
+		logger.Error("-max-validation-errors must not be negative")
+		os.Exit(1)
+	}
+
+	if cfg.requestLogSampleRate < 0 || cfg.requestLogSampleRate > 1 {
+		logger.Error("-request-log-sample-rate must be between 0 and 1")
+		os.Exit(1)
+	}
+
+	if cfg.background.wait < 0 {
+		logger.Error("-background-wait must not be negative")
+		os.Exit(1)
+	}
+
+	if cfg.shutdownDrainDelay < 0 {
+		logger.Error("-shutdown-drain-delay must not be negative")
+		os.Exit(1)
+	}
+
+	if cfg.duplicateRequestWindow < 0 {
+		logger.Error("-duplicate-request-window must not be negative")
+		os.Exit(1)
+	}
+
+	if cfg.readiness.poolThreshold < 0 || cfg.readiness.poolThreshold > 1 {
+		logger.Error("-readiness-pool-threshold must be between 0 and 1")
+		os.Exit(1)
+	}
+
+	if cfg.readiness.retryAfter < 0 {
+		logger.Error("-readiness-retry-after must not be negative")
+		os.Exit(1)
+	}
+
+	// The default page size must itself be a valid page size.
+	if cfg.filters.DefaultPageSize < 1 || cfg.filters.DefaultPageSize > cfg.filters.MaxPageSize {
+		logger.Error("-filters-default-page-size must be between 1 and -filters-max-page-size")
+		os.Exit(1)
+	}
+
+	// If no instance ID was given, fall back to the hostname, and failing that a random
+	// short ID generated once at startup.
+	if cfg.instance.id == "" {
+		cfg.instance.id = defaultInstanceID()
+	}
 
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the application immediately.
 
 	db, err := openDB(cfg)
 	if err != nil {
+		// In self-test mode, report the failure in the same format as the other checks.
+		if cfg.runSelfTest {
+			runSelfTest(os.Stdout, []dependencyCheck{{name: "database", check: func() error { return err }}})
+			os.Exit(1)
+		}
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
@@ -146,12 +614,88 @@ func main() {
 
 	logger.Info("database connection pool established")
 
+	// Publish the application version and the current Unix time in the expvar
+	// variables served at GET /v1/debug/vars.
+	expvar.NewString("version").Set(version)
+	expvar.Publish("timestamp", expvar.Func(func() any {
+		return time.Now().Unix()
+	}))
+
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
+		models: data.NewModels(db, cfg.db.timeouts),
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username,
 			cfg.smtp.password, cfg.smtp.sender),
+		startTime:  startTime,
+		writeQuota: newDailyQuota(cfg.dailyWriteQuota),
+		dbPool:     db,
+	}
+
+	// A limit of zero (or less) means background tasks are unbounded, which we represent
+	// with a nil semaphore.
+	if cfg.background.maxTasks > 0 {
+		app.backgroundSlots = make(chan struct{}, cfg.background.maxTasks)
+	}
+
+	// Likewise, a nil semaphore means the number of in-flight requests is unbounded.
+	if cfg.maxInFlight > 0 {
+		app.inFlightSlots = make(chan struct{}, cfg.maxInFlight)
+	}
+
+	if cfg.duplicateRequestWindow > 0 {
+		app.recentRequests = newRecentRequests(cfg.duplicateRequestWindow)
+	}
+
+	if cfg.prometheusMetrics {
+		app.prometheus = newPromCollector()
+	}
+
+	app.models.Movies.AccentInsensitive = cfg.searchAccentInsensitive
+	app.models.Movies.SortGenres = cfg.sortGenres
+
+	features, err := app.loadFeatures()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	app.featureFlags = newFeatureFlags(features)
+
+	app.limiterStore = app.newRateLimiterStore("ratelimit")
+	app.authFailures = app.newRateLimiterStore("authfailures")
+	if cfg.limiter.file != "" {
+		rps, burst, err := app.loadLimiterSettings()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		app.limiterStore.SetLimit(rps, burst)
+		app.authFailures.SetLimit(rps, burst)
+	}
+
+	// In self-test mode, check the dependencies and exit with the result instead of
+	// serving requests.
+	if cfg.runSelfTest {
+		ok := runSelfTest(os.Stdout, app.dependencyChecks())
+
+		// os.Exit() doesn't run deferred functions, so close the pool ourselves.
+		db.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// If requested, check that the SMTP server can be reached. A failure here isn't fatal,
+	// as the rest of the API still works, but we log a warning so that operators know
+	// emails will fail before the first user registers.
+	if cfg.smtp.verifyOnStart {
+		err = app.mailer.Verify()
+		if err != nil {
+			logger.Warn("SMTP server verification failed, emails will not be sent", "host", cfg.smtp.host, "port", cfg.smtp.port, "error", err.Error())
+		} else {
+			logger.Info("SMTP server verified", "host", cfg.smtp.host, "port", cfg.smtp.port)
+		}
 	}
 
 	err = app.server()
@@ -161,6 +705,37 @@ func main() {
 	}
 }
 
+// The parseTLSVersion() function converts a version string like "1.2" into the matching
+// crypto/tls constant.
+
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q (must be 1.2 or 1.3)", s)
+	}
+}
+
+// The defaultInstanceID() function returns the hostname of the machine, or a random
+// 8-character hex ID if the hostname can't be determined.
+
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err == nil && hostname != "" {
+		return hostname
+	}
+
+	b := make([]byte, 4)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
 // The openDB() function retusn a sql.DB connection pool.
 
 func openDB(cfg config) (*sql.DB, error) {
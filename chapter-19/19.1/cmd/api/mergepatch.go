@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+
+	"greelight.techkunstler.com/internal/data"
+)
+
+// mergePatchContentType is the media type of a JSON merge patch (RFC 7386).
+const mergePatchContentType = "application/merge-patch+json"
+
+// The isMergePatch() helper reports whether the request body is a JSON merge patch,
+// going by its Content-Type header.
+
+func isMergePatch(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == mergePatchContentType
+}
+
+// The readMovieMergePatch() helper reads a JSON merge patch from the request body and
+// applies it to a copy of the movie, which it returns. See applyMovieMergePatch() for
+// how the patch is applied.
+
+func (app *application) readMovieMergePatch(w http.ResponseWriter, r *http.Request, movie *data.Movie, mask fieldMask) (*data.Movie, error) {
+	var patch map[string]json.RawMessage
+
+	err := app.readJSON(w, r, &patch)
+	if err != nil {
+		return nil, err
+	}
+
+	// A patch which isn't an object would replace the whole movie, which makes no sense
+	// for a record, so it's rejected.
+	if patch == nil {
+		return nil, errors.New("body must contain a JSON object")
+	}
+
+	return applyMovieMergePatch(movie, patch, mask)
+}
+
+// The applyMovieMergePatch() function applies a JSON merge patch to a copy of the movie,
+// following RFC 7386: fields which are absent are left as they are, a null value clears
+// the field, and any other value replaces it. The tags are an object, so the patch is
+// merged into them key by key, and a null value removes a single tag. Fields which
+// aren't in the field mask are skipped. Clearing a required field, like the title, is
+// caught by validation afterwards.
+
+func applyMovieMergePatch(movie *data.Movie, patch map[string]json.RawMessage, mask fieldMask) (*data.Movie, error) {
+	updated := movie.WithUpdates(data.MovieUpdate{})
+
+	// Apply the keys in order, so that the error for a bad patch is always the same.
+	keys := make([]string, 0, len(patch))
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !slices.Contains(movieUpdateFields, key) {
+			return nil, fmt.Errorf("body contains unknown key %q", key)
+		}
+		if !mask.includes(key) {
+			continue
+		}
+
+		value := patch[key]
+		null := bytes.Equal(value, []byte("null"))
+
+		var err error
+
+		switch key {
+		case "title":
+			updated.Title = ""
+			if !null {
+				err = json.Unmarshal(value, &updated.Title)
+			}
+		case "year":
+			updated.Year = 0
+			if !null {
+				err = json.Unmarshal(value, &updated.Year)
+			}
+		case "runtime":
+			updated.Runtime = 0
+			if !null {
+				err = json.Unmarshal(value, &updated.Runtime)
+			}
+		case "genres":
+			updated.Genres = nil
+			if !null {
+				err = json.Unmarshal(value, &updated.Genres)
+			}
+		case "featured":
+			updated.Featured = false
+			if !null {
+				err = json.Unmarshal(value, &updated.Featured)
+			}
+		case "tags":
+			if null {
+				updated.Tags = nil
+			} else {
+				updated.Tags, err = mergeTags(updated.Tags, value)
+			}
+		}
+
+		if err != nil {
+			// The runtime has its own format, and says what's wrong with it.
+			if errors.Is(err, data.ErrInvalidRuntimeFormat) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("body contains incorrect JSON type for key %q", key)
+		}
+	}
+
+	return updated, nil
+}
+
+// The mergeTags() function merges a patch, which must be a JSON object, into the tags,
+// returning the result. A null value removes the tag, and a string sets it.
+
+func mergeTags(tags data.Tags, value json.RawMessage) (data.Tags, error) {
+	var patch map[string]json.RawMessage
+
+	err := json.Unmarshal(value, &patch)
+	if err != nil || patch == nil {
+		return nil, errors.New("tags must be an object")
+	}
+
+	if tags == nil {
+		tags = data.Tags{}
+	}
+
+	for key, value := range patch {
+		if bytes.Equal(value, []byte("null")) {
+			delete(tags, key)
+			continue
+		}
+
+		var s string
+		err := json.Unmarshal(value, &s)
+		if err != nil {
+			return nil, err
+		}
+		tags[key] = s
+	}
+
+	return tags, nil
+}
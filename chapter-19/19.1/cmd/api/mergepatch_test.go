@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+)
+
+func TestApplyMovieMergePatch(t *testing.T) {
+	movie := func() *data.Movie {
+		return &data.Movie{
+			ID:       7,
+			Title:    "Moana",
+			Year:     2016,
+			Runtime:  107,
+			Genres:   []string{"animation", "adventure"},
+			Featured: true,
+			Tags:     data.Tags{"studio": "disney", "lang": "en"},
+			Version:  5,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		patch   string
+		mask    fieldMask
+		want    func(m *data.Movie)
+		wantErr string
+	}{
+		{
+			name:  "Update a field",
+			patch: `{"title": "Moana 2"}`,
+			want:  func(m *data.Movie) { m.Title = "Moana 2" },
+		},
+		{
+			name:  "Clear with null",
+			patch: `{"featured": null, "genres": null}`,
+			want: func(m *data.Movie) {
+				m.Featured = false
+				m.Genres = nil
+			},
+		},
+		{
+			name:  "Merge tags",
+			patch: `{"tags": {"lang": null, "rating": "PG"}}`,
+			want:  func(m *data.Movie) { m.Tags = data.Tags{"studio": "disney", "rating": "PG"} },
+		},
+		{
+			name:  "Clear tags",
+			patch: `{"tags": null}`,
+			want:  func(m *data.Movie) { m.Tags = nil },
+		},
+		{
+			name:  "Field mask",
+			patch: `{"title": "Moana 2", "year": 2024}`,
+			mask:  fieldMask{"year": true},
+			want:  func(m *data.Movie) { m.Year = 2024 },
+		},
+		{
+			name:  "Empty",
+			patch: `{}`,
+			want:  func(m *data.Movie) {},
+		},
+		{
+			name:    "Unknown key",
+			patch:   `{"rating": "PG"}`,
+			wantErr: `body contains unknown key "rating"`,
+		},
+		{
+			name:    "Wrong type",
+			patch:   `{"year": "2016"}`,
+			wantErr: `body contains incorrect JSON type for key "year"`,
+		},
+		{
+			name:    "Bad runtime",
+			patch:   `{"runtime": "107 minutes"}`,
+			wantErr: data.ErrInvalidRuntimeFormat.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch map[string]json.RawMessage
+			err := json.Unmarshal([]byte(tt.patch), &patch)
+			assert.NilError(t, err)
+
+			original := movie()
+
+			got, err := applyMovieMergePatch(original, patch, tt.mask)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			assert.NilError(t, err)
+
+			want := movie()
+			tt.want(want)
+			assert.Equal(t, got, want)
+
+			// The fetched movie is left as it was, so the changes can be reported.
+			assert.Equal(t, original, movie())
+		})
+	}
+}
+
+func TestUpdateMovieHandlerMergePatch(t *testing.T) {
+	// Emulate movie 7, and record the arguments of the UPDATE statement.
+	var updateArgs []driver.NamedValue
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			if strings.HasPrefix(strings.TrimSpace(query), "UPDATE") {
+				updateArgs = args
+				return []string{"updated_at", "version"}, [][]driver.Value{{time.Now(), int64(6)}}
+			}
+
+			return []string{"id", "created_at", "title", "year", "runtime", "genres", "featured",
+					"tags", "updated_at", "deleted_at", "version"},
+				[][]driver.Value{{int64(7), time.Now(), "Moana", int64(2016), int64(107),
+					[]byte("{animation}"), true, []byte(`{"studio": "disney"}`), time.Now(), nil, int64(5)}}
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	send := func(contentType, body string) (int, string) {
+		t.Helper()
+		updateArgs = nil
+
+		r := httptest.NewRequest(http.MethodPatch, "/v1/movies/7", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey,
+			httprouter.Params{{Key: "id", Value: "7"}}))
+		r.Header.Set("Content-Type", contentType)
+
+		status, _, resp := execute(t, http.HandlerFunc(app.updateMovieHandler), r)
+		return status, resp
+	}
+
+	t.Run("Update and clear", func(t *testing.T) {
+		status, body := send("application/merge-patch+json", `{"title": "Moana 2", "featured": null, "tags": null}`)
+
+		assert.Status(t, status, http.StatusOK)
+		assert.JSONField(t, []byte(body), "movie.title", "Moana 2")
+		assert.JSONField(t, []byte(body), "movie.year", 2016)
+
+		// The featured flag is the fifth argument of the UPDATE statement.
+		if updateArgs == nil {
+			t.Fatal("movie wasn't updated")
+		}
+		assert.Equal(t, updateArgs[4].Value, driver.Value(false))
+
+		changes := decodeJSON(t, body)["changes"].(map[string]any)
+		for _, field := range []string{"title", "featured", "tags"} {
+			if _, ok := changes[field]; !ok {
+				t.Errorf("changes %v don't include %q", changes, field)
+			}
+		}
+	})
+
+	t.Run("Clear a required field", func(t *testing.T) {
+		status, body := send("application/merge-patch+json", `{"title": null}`)
+
+		assert.Status(t, status, http.StatusUnprocessableEntity)
+		assert.JSONField(t, []byte(body), "error.title", "must be provided")
+		if updateArgs != nil {
+			t.Error("movie was updated")
+		}
+	})
+
+	t.Run("Not an object", func(t *testing.T) {
+		status, _ := send("application/merge-patch+json", `null`)
+		assert.Status(t, status, http.StatusBadRequest)
+	})
+
+	t.Run("Plain JSON ignores null", func(t *testing.T) {
+		status, body := send("application/json", `{"title": null, "year": 2017}`)
+
+		assert.Status(t, status, http.StatusOK)
+		assert.JSONField(t, []byte(body), "movie.title", "Moana")
+		assert.JSONField(t, []byte(body), "movie.year", 2017)
+	})
+}
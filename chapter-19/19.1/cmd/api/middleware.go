@@ -1,15 +1,24 @@
 package main
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"expvar"
 	"fmt"
-	"golang.org/x/time/rate"
 	"greelight.techkunstler.com/internal/data"
 	"greelight.techkunstler.com/internal/validator"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"mime"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -40,95 +49,321 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
+// The composeMiddleware() helper wraps h in the given middleware. The first middleware is
+// the outermost, so it sees each request first and each response last, and
+// composeMiddleware(h, a, b) is the same as a(b(h)).
 
-	// Define a client struct to hold the rate limiter and last seen time for each clinet.
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+func composeMiddleware(h http.Handler, mw ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
 	}
+	return h
+}
 
-	//  Declare a mutex and a map to hold clien'ts IP addresses and
-	// rate limiters
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+// totalRequestsReceived, totalResponsesSent, totalResponsesSentByStatus and
+// totalProcessingTime are updated by the metrics() middleware, and published at
+// GET /v1/debug/vars along with the other expvar variables. The by-status map is keyed
+// by the status code as a string, like "404".
+var (
+	totalRequestsReceived      = expvar.NewInt("total_requests_received")
+	totalResponsesSent         = expvar.NewInt("total_responses_sent")
+	totalResponsesSentByStatus = expvar.NewMap("total_responses_sent_by_status")
+	totalProcessingTime        = expvar.NewInt("total_processing_time_μs")
+)
 
-	// Launch a background goroutine which removes old entries from the clients map
-	// once every minute.
+// metricsResponseWriter wraps a http.ResponseWriter to record the status code of the
+// response for the metrics() middleware. The status code starts as 200 OK, which is what
+// is sent if the handler calls Write() without calling WriteHeader() first.
+type metricsResponseWriter struct {
+	wrapped       http.ResponseWriter
+	statusCode    int
+	headerWritten bool
+}
 
-	go func() {
-		for {
-			time.Sleep(time.Minute)
+func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
+	return &metricsResponseWriter{
+		wrapped:    w,
+		statusCode: http.StatusOK,
+	}
+}
 
-			// Lock the mutext to prevent any rate limiter check from happening
-			// while the cleanup is in progress.
+func (mw *metricsResponseWriter) Header() http.Header {
+	return mw.wrapped.Header()
+}
 
-			mu.Lock()
+func (mw *metricsResponseWriter) WriteHeader(statusCode int) {
+	mw.wrapped.WriteHeader(statusCode)
 
-			// Loop through all clients. If they haven't been seen within the last
-			// three minutes, delete the corresponding entry from the map
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
-			mu.Unlock()
+	if !mw.headerWritten {
+		mw.statusCode = statusCode
+		mw.headerWritten = true
+	}
+}
+
+func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
+	mw.headerWritten = true
+	return mw.wrapped.Write(b)
+}
+
+// Flush() passes the flush on to the underlying http.ResponseWriter if it supports it,
+// so that streaming responses still work through the metrics() middleware.
+func (mw *metricsResponseWriter) Flush() {
+	if f, ok := mw.wrapped.(http.Flusher); ok {
+		mw.headerWritten = true
+		f.Flush()
+	}
+}
+
+// Unwrap() lets http.ResponseController reach the underlying http.ResponseWriter.
+func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return mw.wrapped
+}
+
+// The metrics() middleware counts the requests received and responses sent, both in
+// total and by status code, and adds up the time spent processing them in microseconds.
+// If the -metrics-prometheus flag is set, it also records each request in the Prometheus
+// collector, labelled with the name of the route it matched. It should be the outermost
+// middleware, so that the time taken by the rest of the chain is included.
+
+func (app *application) metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		totalRequestsReceived.Add(1)
+
+		var route *string
+		if app.prometheus != nil {
+			r, route = app.contextWithRouteName(r)
+		}
+
+		mw := newMetricsResponseWriter(w)
+		next.ServeHTTP(mw, r)
+
+		// On the way back up the middleware chain, the response has been sent.
+		elapsed := time.Since(start)
+
+		totalResponsesSent.Add(1)
+		totalResponsesSentByStatus.Add(strconv.Itoa(mw.statusCode), 1)
+		totalProcessingTime.Add(elapsed.Microseconds())
+
+		if app.prometheus != nil {
+			app.prometheus.observe(r.Method, *route, mw.statusCode, elapsed)
+		}
+	})
+}
+
+// requestsRejectedInFlight counts the requests refused by the limitInFlight() middleware.
+var requestsRejectedInFlight = expvar.NewInt("requests_rejected_in_flight")
+
+// The limitInFlight() middleware bounds the total number of requests being handled at
+// once, to the number set by the -max-in-flight flag, so that a burst of traffic from
+// many clients can't overwhelm the server. Unlike rateLimit(), which limits each client,
+// this protects the capacity of the server as a whole. A request which arrives when the
+// limit has been reached is refused with a 503 straight away, rather than queued.
+
+func (app *application) limitInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.inFlightSlots == nil {
+			next.ServeHTTP(w, r)
+			return
 		}
-	}()
 
-	// The function we are returing is a closure, which 'closes over' the limiter variable. */
+		select {
+		case app.inFlightSlots <- struct{}{}:
+			defer func() { <-app.inFlightSlots }()
+			next.ServeHTTP(w, r)
+		default:
+			requestsRejectedInFlight.Add(1)
+			app.overloadedResponse(w, r)
+		}
+	})
+}
 
+// The logRequestContext() middleware gives each request an ID, which is sent back to the
+// client in the X-Request-ID header, and stores a logger carrying the request ID, method
+// and URI in the request context. Handlers should log using app.requestLogger(r) so
+// that these attributes are included automatically.
+
+func (app *application) logRequestContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID, err := newRequestID()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 
-		if app.config.limiter.enabled {
+		w.Header().Set("X-Request-ID", requestID)
 
-			// Extract the client's IP add from the request.
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				app.serverErrorResponse(w, r, err)
-				return
-			}
+		logger := app.logger.With(
+			"request_id", requestID,
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+		)
 
-			// Lock the mutext to prevent this code from being executed concurrently.
-			mu.Lock()
+		r = app.contextSetLogger(r, logger)
+		next.ServeHTTP(w, r)
+	})
+}
 
-			// Check to see if the IP address already exists in the map.
-			// If it doesn't, then initialize a new rate limiter and
-			// add the IP add and limiter to the map.
+// requestsTotal and requestsLogged count the requests seen by the logRequest()
+// middleware and how many of them were logged, so the effect of sampling can be seen.
+var (
+	requestsTotal  = expvar.NewInt("requests_total")
+	requestsLogged = expvar.NewInt("requests_logged")
+)
 
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(
-						rate.Limit(app.config.limiter.rps),
-						app.config.limiter.burst,
-					),
-				}
+// statusRecorder wraps a http.ResponseWriter to record the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rw *statusRecorder) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *statusRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Unwrap() lets http.ResponseController reach the underlying http.ResponseWriter.
+func (rw *statusRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// The logRequest() middleware logs a "completed request" entry with the status and
+// duration of every request, using the request-scoped logger, so it must be wrapped in
+// logRequestContext(). Only the fraction of successful requests given by the
+// -request-log-sample-rate flag are logged, but error responses (4xx and 5xx) and
+// requests slower than the response time budget always are.
+
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &statusRecorder{ResponseWriter: w}
 
+		next.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+
+		requestsTotal.Add(1)
+
+		slow := app.config.responseTimeBudget > 0 && elapsed > app.config.responseTimeBudget
+		sampled := mathrand.Float64() < app.config.requestLogSampleRate
+
+		if status < 400 && !slow && !sampled {
+			return
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400 || slow:
+			level = slog.LevelWarn
+		}
+
+		requestsLogged.Add(1)
+		app.requestLogger(r).Log(r.Context(), level, "completed request",
+			"status", status, "duration_ms", elapsed.Milliseconds())
+	})
+}
+
+// newRequestID() returns a random 16-character hex string.
+func newRequestID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// The rateLimit() middleware limits the rate of requests from each client, identified by
+// rateLimitKey(), using the store selected by the -limiter-backend flag. If the store
+// can't be reached the error is logged and the request is allowed, so that an outage of
+// a shared store doesn't take the API down with it.
+
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	// The store is normally created at startup, so that reloadLimiter() can reach it,
+	// but tests may leave it unset.
+	store := app.limiterStore
+	if store == nil {
+		store = app.newRateLimiterStore("ratelimit")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if app.config.limiter.enabled {
+
+			key, err := app.rateLimitKey(r)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
 			}
 
-			clients[ip].lastSeen = time.Now()
-			// Call limiter.Allow() to see if the request is permitted, and if its not
-			// then we call the rateLimitExceeded Response() helper to return a 429 Too many
-			// Requests response
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
+			// Ask the store whether the request is permitted, and if it's not then
+			// call the rateLimitExceededResponse() helper to return a 429 Too Many
+			// Requests response.
+			allowed, err := store.Allow(r.Context(), key)
+			if err != nil {
+				app.logError(r, err)
+			} else if !allowed {
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
-			// Very importatntly, unlock the mutext before calling the next handler in
-			// the chain. Notice that we DON't use defer to unlock the mutex, as that
-			// would mean that mutext isn't unlocked until all the handlers downstream of this
-			// middleware have also returned.
-			mu.Unlock()
 		}
 		next.ServeHTTP(w, r)
 
 	})
 }
 
+// The rateLimitKey() helper returns the key which identifies the client for rate
+// limiting. Authenticated users are limited by their user ID, so that users sharing an
+// IP address (for example behind a NAT) don't use up each other's allowance. Anonymous
+// clients are limited by their IP address. It must run after authenticate(); if there's
+// no user in the request context, the IP address is used.
+
+func (app *application) rateLimitKey(r *http.Request) (string, error) {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if ok && !user.IsAnonymous() {
+		return "user:" + strconv.FormatInt(user.ID, 10), nil
+	}
+
+	// Extract the client's IP add from the request.
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	return ip, nil
+}
+
+// The authenticate() middleware looks up the user for the bearer token in the
+// Authorization header, if there is one, and adds them to the request context.
+//
+// rateLimit() runs afterwards, so requests with a bad token never reach it as a user,
+// yet each one costs a database lookup. So when rate limiting is enabled, failed
+// authentications are limited here by IP address, at the same rate as requests, and a
+// client which has used up its allowance is turned away before its token is looked up.
+// The failures are counted in app.authFailures, which is shared between instances when
+// -limiter-backend=redis. If it can't be reached the error is logged and the request
+// is let through, as in rateLimit(). Tests which don't set app.authFailures get no
+// limiting.
+
 func (app *application) authenticate(next http.Handler) http.Handler {
+	failures := app.authFailures
+	limited := app.config.limiter.enabled && failures != nil
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Authorization" header to the response. This indicates to any caches that the response may vary
 		// based on the value of the Authorization header in the request.
@@ -150,14 +385,40 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		// Otherwise, we expect the value of the Authorization header to be in the
+		// Turn away clients which have failed to authenticate too often, before their
+		// token is looked up.
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+		if limited {
+			blocked, err := failures.Blocked(r.Context(), ip)
+			if err != nil {
+				app.logError(r, err)
+			} else if blocked {
+				app.rateLimitExceededResponse(w, r)
+				return
+			}
+		}
+
+		// invalidToken() records a failed authentication for the client's IP address,
+		// and sends the invalidAuthenticationTokenResponse().
+		invalidToken := func() {
+			if limited {
+				_, err := failures.Allow(r.Context(), ip)
+				if err != nil {
+					app.logError(r, err)
+				}
+			}
+			app.invalidAuthenticationTokenResponse(w, r)
+		}
+
+		// We expect the value of the Authorization header to be in the
 		// format "Bearer <token>". We try to split this into its constituent parts, and if
 		// the header isn't in the expected format we return a 401 Unauthorized response
 		// using the invalidAuthenticationTokenResponse() helper.
 
 		headerParts := strings.Split(authorizationHeader, " ")
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidAuthenticationTokenResponse(w, r)
+			invalidToken()
 			return
 		}
 
@@ -173,7 +434,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// that we'd normally use.
 
 		if data.ValidateTokenPlainText(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
+			invalidToken()
 			return
 		}
 
@@ -186,7 +447,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
+				invalidToken()
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
@@ -194,9 +455,10 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// call the contextSetUser() helper to add the user information to the request
-		// context
+		// context, and add the user ID to the request-scoped logger.
 
 		r = app.contextSetUser(r, user)
+		r = app.contextSetLogger(r, app.requestLogger(r).With("user_id", user.ID))
 		// Call the next handler in the chain
 		next.ServeHTTP(w, r)
 	})
@@ -267,6 +529,167 @@ func (app *application) requiredPermission(code string, next http.HandlerFunc) h
 	return app.requireActivatedUser(fn)
 }
 
+// The endpoint() middleware tags a route with a logical name from endpointNames, and
+// sends a 503 Service Unavailable response if the operator has disabled it with the
+// -disabled-endpoints flag. Use it as the outermost wrapper on each route, so disabled
+// endpoints are rejected before any authentication or database work. If the endpoint has
+// been deprecated, every response from it, including the error responses, is marked
+// with markDeprecated().
+
+func (app *application) endpoint(name string, next http.HandlerFunc) http.HandlerFunc {
+	// A name which isn't in the list is a programming error, and would mean the route
+	// couldn't be disabled, so fail loudly when the routes are built.
+	if !slices.Contains(endpointNames, name) {
+		panic("unknown endpoint name: " + name)
+	}
+
+	disabled := slices.Contains(app.config.disabledEndpoints, name)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Record the name for the metrics() middleware to use as the route label.
+		app.contextSetRouteName(r, name)
+
+		if disabled {
+			app.endpointDisabledResponse(w, r)
+			return
+		}
+		next(w, r)
+	})
+
+	if d, ok := app.deprecation(name); ok {
+		return app.markDeprecated(d, h)
+	}
+	return h
+}
+
+// The publicReadPermission() middleware lets anonymous users through when the
+// -public-reads flag is set, and otherwise behaves like requiredPermission(). Anonymous
+// requests are given the public movie view, so handlers should render movies with the
+// view from contextGetMovieView().
+
+func (app *application) publicReadPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	permitted := app.requiredPermission(code, next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.publicReads && app.contextGetUser(r).IsAnonymous() {
+			r = app.contextSetMovieView(r, data.MovieViewPublic)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		permitted.ServeHTTP(w, r)
+	})
+}
+
+// The requireWriteQuota() middleware counts a write request against the authenticated
+// user's daily quota, and rejects it with a 429 Too Many Requests response once the quota
+// has been used up. It must be used after the user has been authenticated, so wrap it
+// inside requiredPermission().
+
+func (app *application) requireWriteQuota(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		ok, resetAt := app.writeQuota.allow(user.ID, time.Now())
+		if !ok {
+			app.writeQuotaExceededResponse(w, r, resetAt)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requireContentType() middleware rejects requests whose Content-Type header (ignoring
+// any parameters, like the multipart boundary) isn't one of the allowed media types,
+// sending a 415 Unsupported Media Type response. Use it on upload and import endpoints.
+
+func (app *application) requireContentType(allowed []string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !validator.PermittedValue(mediaType, allowed...) {
+			app.unsupportedMediaTypeResponse(w, r, allowed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseTimeWriter wraps a http.ResponseWriter so that the X-Response-Time headers
+// can be added at the moment the handler writes the response headers, which is the
+// last point at which headers can still be changed.
+type responseTimeWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	budget      time.Duration
+	wroteHeader bool
+}
+
+func (rw *responseTimeWriter) WriteHeader(statusCode int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+
+		elapsed := time.Since(rw.start)
+		rw.Header().Set("X-Response-Time", strconv.FormatInt(elapsed.Milliseconds(), 10))
+
+		if rw.budget > 0 && elapsed > rw.budget {
+			rw.Header().Set("X-Response-Time-Warning", "true")
+		}
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *responseTimeWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *responseTimeWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap() lets http.ResponseController reach the underlying http.ResponseWriter.
+func (rw *responseTimeWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// The responseTime() middleware adds an X-Response-Time header to every response,
+// containing the number of milliseconds the handler took before it started writing the
+// response. If this exceeds the configured budget, an X-Response-Time-Warning: true
+// header is added too, giving clients a lightweight signal that the request was slow.
+
+func (app *application) responseTime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseTimeWriter{
+			ResponseWriter: w,
+			start:          time.Now(),
+			budget:         app.config.responseTimeBudget,
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// The servedBy() middleware adds an X-Served-By header containing the instance ID to
+// every response, if it has been enabled with the -served-by-header flag.
+
+func (app *application) servedBy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.instance.servedByHeaderEnabled {
+			w.Header().Set("X-Served-By", app.config.instance.id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Chapter 17 stuff CORS
 
 func (app *application) enableCORS(next http.Handler) http.Handler {
@@ -290,15 +713,14 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 
 					if r.Method == http.MethodOptions &&
 						r.Header.Get("Access-Control-Request-Method") != "" {
-						// Set the necessary preflight response headers,
+						// Set the necessary preflight response headers. These are listed
+						// explicitly, rather than using "*", because browsers don't accept
+						// the wildcard for credentialed requests, and it never covers the
+						// Authorization header.
 						w.Header().Set("Access-Control-Allow-Methods",
-							"*")
+							"OPTIONS, PUT, PATCH, DELETE")
 						w.Header().Set("Access-Control-Allow-Headers",
-							"*")
-						/* w.Header().Set("Access-Control-Allow-Methods",
-							"GET,POST,OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers",
-							"Authorization, content-Type") */
+							"Authorization, Content-Type")
 						// Write the headers along with a 200 OK status
 						// and return from the middleware with no further action.
 						w.WriteHeader(http.StatusOK)
@@ -312,3 +734,226 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// compressMinSize is the smallest response body, in bytes, which the compress()
+// middleware compresses. Below this the saving is too small to be worth the CPU time and
+// the gzip header and footer.
+const compressMinSize = 1024
+
+// incompressibleTypes are the media types (or, ending in "/", the top-level types) of
+// response bodies which are already compressed, so compressing them again would waste
+// CPU time for no gain.
+var incompressibleTypes = []string{
+	"image/", "audio/", "video/", "font/woff", "font/woff2",
+	"application/gzip", "application/x-gzip", "application/zip", "application/zstd",
+	"application/pdf",
+}
+
+// The negotiateEncoding() helper picks the content encoding to use for a response from
+// the request's Accept-Encoding header. It prefers gzip over deflate, and returns an
+// empty string if the client accepts neither. An encoding (or "*") with q=0 is refused.
+
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		if name, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		qualities[coding] = q
+	}
+
+	for _, coding := range []string{"gzip", "deflate"} {
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > 0 {
+			return coding
+		}
+	}
+	return ""
+}
+
+// compressWriter wraps a http.ResponseWriter to compress the response body. It holds
+// back the status code and buffers the start of the body until it has seen enough to
+// decide whether compression is worthwhile, and only then sends the headers. The
+// handler's Content-Type and Content-Encoding headers are checked at that point, so
+// they must be set before the body is written, as usual.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding   string
+	statusCode int
+	buf        []byte
+	decided    bool
+	zw         io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	// Informational responses are sent straight away, as there can be several of them.
+	if statusCode >= 100 && statusCode < 200 {
+		cw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	if cw.statusCode == 0 {
+		cw.statusCode = statusCode
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.decided {
+		if cw.zw != nil {
+			return cw.zw.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= compressMinSize {
+		err := cw.decide(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush() sends whatever has been written so far. A handler which flushes is streaming
+// its response, so it is compressed even if the body is still small, as more is likely
+// to follow.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap() lets http.ResponseController reach the underlying http.ResponseWriter.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close() finishes the response once the handler has returned, sending the headers and
+// any buffered body if that hasn't happened yet, and writing the compressed stream's
+// footer.
+func (cw *compressWriter) close() error {
+	if !cw.decided {
+		err := cw.decide(len(cw.buf) >= compressMinSize)
+		if err != nil {
+			return err
+		}
+	}
+	if cw.zw != nil {
+		return cw.zw.Close()
+	}
+	return nil
+}
+
+// decide() sends the headers, compressing the body if want is true and the response is
+// suitable, and then writes out the buffered body.
+func (cw *compressWriter) decide(want bool) error {
+	cw.decided = true
+
+	if cw.statusCode == 0 {
+		cw.statusCode = http.StatusOK
+	}
+
+	if want && cw.compressible() {
+		cw.Header().Set("Content-Encoding", cw.encoding)
+		cw.Header().Del("Content-Length")
+
+		// Despite its name, the HTTP deflate encoding is the zlib format (RFC 1950)
+		// rather than a raw deflate stream.
+		if cw.encoding == "gzip" {
+			cw.zw = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.zw = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.statusCode)
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.zw != nil {
+		_, err = cw.zw.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// compressible() reports whether the response can be compressed: it must be allowed to
+// have a body, mustn't be encoded already, and mustn't be of an already-compressed type.
+func (cw *compressWriter) compressible() bool {
+	if cw.statusCode == http.StatusNoContent || cw.statusCode == http.StatusNotModified {
+		return false
+	}
+	if cw.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(cw.Header().Get("Content-Type"))
+
+	// SVG images are text, so they're worth compressing despite being images.
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+
+	for _, t := range incompressibleTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return false
+		}
+	}
+	return true
+}
+
+// The compress() middleware compresses response bodies with gzip or deflate, if the
+// client accepts either in its Accept-Encoding header. Small bodies, bodies which are
+// already compressed and responses to HEAD and range requests are sent as they are.
+// Every response carries a "Vary: Accept-Encoding" header, so that caches keep the
+// compressed and uncompressed versions apart.
+
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		next.ServeHTTP(cw, r)
+
+		// By now the client has gone or the response is complete, so all we can do with
+		// an error is log it.
+		err := cw.close()
+		if err != nil {
+			app.requestLogger(r).Error("failed to finish compressed response", "error", err.Error())
+		}
+	})
+}
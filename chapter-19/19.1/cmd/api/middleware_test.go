@@ -0,0 +1,845 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+)
+
+func TestServedBy(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.instance.id = "api-1"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		app.config.instance.servedByHeaderEnabled = true
+
+		// The header should be present and identical across requests handled by the
+		// same instance.
+		for range 2 {
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, headers, _ := execute(t, app.servedBy(next), r)
+			if got := headers.Get("X-Served-By"); got != "api-1" {
+				t.Errorf("got X-Served-By %q; want %q", got, "api-1")
+			}
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		app.config.instance.servedByHeaderEnabled = false
+
+		r, err := http.NewRequest(http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, headers, _ := execute(t, app.servedBy(next), r)
+		if got := headers.Get("X-Served-By"); got != "" {
+			t.Errorf("got X-Served-By %q; want no header", got)
+		}
+	})
+}
+
+func TestRequireWriteQuota(t *testing.T) {
+	app := newTestApplication(t)
+	app.writeQuota = newDailyQuota(2)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	user := &data.User{ID: 1, Activated: true}
+
+	// The first two writes are within the quota, the third exceeds it.
+	wantCodes := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+
+	for i, want := range wantCodes {
+		r, err := http.NewRequest(http.MethodPost, "/v1/movies", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = app.contextSetUser(r, user)
+
+		code, headers, body := execute(t, app.requireWriteQuota(next), r)
+		if code != want {
+			t.Fatalf("request %d: got status %d; want %d", i+1, code, want)
+		}
+
+		if code == http.StatusTooManyRequests {
+			if headers.Get("Retry-After") == "" {
+				t.Error("missing Retry-After header")
+			}
+			if !strings.Contains(body, "quota resets at") {
+				t.Errorf("got body %q; want it to mention the reset time", body)
+			}
+		}
+	}
+
+	// Other users have their own quota.
+	r, err := http.NewRequest(http.MethodPost, "/v1/movies", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = app.contextSetUser(r, &data.User{ID: 2, Activated: true})
+
+	code, _, _ := execute(t, app.requireWriteQuota(next), r)
+	if code != http.StatusOK {
+		t.Errorf("got status %d for another user; want %d", code, http.StatusOK)
+	}
+}
+
+func TestDailyQuotaResets(t *testing.T) {
+	q := newDailyQuota(1)
+
+	day := time.Date(2024, 8, 1, 23, 59, 0, 0, time.UTC)
+
+	if ok, _ := q.allow(1, day); !ok {
+		t.Fatal("first write was rejected")
+	}
+	if ok, _ := q.allow(1, day); ok {
+		t.Fatal("second write on the same day was allowed")
+	}
+
+	// Just after midnight the quota is available again.
+	if ok, _ := q.allow(1, day.Add(2*time.Minute)); !ok {
+		t.Error("write after midnight was rejected")
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	app := newTestApplication(t)
+
+	allowed := []string{"image/jpeg", "image/png"}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	tests := []struct {
+		name        string
+		contentType string
+		wantCode    int
+	}{
+		{
+			name:        "Allowed type",
+			contentType: "image/png",
+			wantCode:    http.StatusOK,
+		},
+		{
+			name:        "Allowed type with parameters",
+			contentType: "image/jpeg; charset=binary",
+			wantCode:    http.StatusOK,
+		},
+		{
+			name:        "Unsupported type",
+			contentType: "application/pdf",
+			wantCode:    http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "Missing type",
+			contentType: "",
+			wantCode:    http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "/", strings.NewReader("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Content-Type", tt.contentType)
+
+			code, headers, _ := execute(t, app.requireContentType(allowed, next), r)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d", code, tt.wantCode)
+			}
+
+			if code == http.StatusUnsupportedMediaType {
+				if got := headers.Get("Accept-Post"); got != "image/jpeg, image/png" {
+					t.Errorf("got Accept-Post %q; want %q", got, "image/jpeg, image/png")
+				}
+			}
+		})
+	}
+}
+
+func TestLogRequestContext(t *testing.T) {
+	app := newTestApplication(t)
+
+	var buf bytes.Buffer
+	app.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.requestLogger(r).Info("handling request")
+		w.Write([]byte("OK"))
+	})
+
+	r, err := http.NewRequest(http.MethodGet, "/v1/movies?page=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, headers, _ := execute(t, app.logRequestContext(next), r)
+
+	requestID := headers.Get("X-Request-ID")
+	if requestID == "" {
+		t.Fatal("missing X-Request-ID header")
+	}
+
+	var entry map[string]any
+	err = json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("invalid log entry %q: %v", buf.String(), err)
+	}
+
+	if entry["request_id"] != requestID {
+		t.Errorf("got request_id %v; want %q", entry["request_id"], requestID)
+	}
+	if entry["method"] != http.MethodGet || entry["uri"] != "/v1/movies?page=2" {
+		t.Errorf("got method %v and uri %v", entry["method"], entry["uri"])
+	}
+}
+
+func TestResponseTime(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.responseTimeBudget = 20 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		wantWarning string
+	}{
+		{
+			name:        "Within budget",
+			delay:       0,
+			wantWarning: "",
+		},
+		{
+			name:        "Over budget",
+			delay:       30 * time.Millisecond,
+			wantWarning: "true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+				w.Write([]byte("OK"))
+			})
+
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, headers, _ := execute(t, app.responseTime(next), r)
+
+			ms, err := strconv.Atoi(headers.Get("X-Response-Time"))
+			if err != nil {
+				t.Fatalf("got non-numeric X-Response-Time %q", headers.Get("X-Response-Time"))
+			}
+			if ms < int(tt.delay.Milliseconds()) {
+				t.Errorf("got X-Response-Time %d; want at least %d", ms, tt.delay.Milliseconds())
+			}
+
+			if got := headers.Get("X-Response-Time-Warning"); got != tt.wantWarning {
+				t.Errorf("got X-Response-Time-Warning %q; want %q", got, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestDisabledEndpoints(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.disabledEndpoints = []string{"movies:create"}
+
+	routes := app.routes()
+
+	// POST /v1/movies is disabled, so it is rejected before authentication.
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(`{}`))
+	status, _, body := execute(t, routes, r)
+
+	assert.Status(t, status, http.StatusServiceUnavailable)
+	assert.JSONField(t, []byte(body), "error", "this endpoint has been temporarily disabled, please try again later")
+
+	// GET /v1/movies still works, so an anonymous request gets as far as the
+	// authentication check.
+	r = httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+	status, _, _ = execute(t, routes, r)
+
+	assert.Status(t, status, http.StatusUnauthorized)
+}
+
+func TestEndpointUnknownName(t *testing.T) {
+	app := newTestApplication(t)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for an unknown endpoint name")
+		}
+	}()
+
+	app.endpoint("movies:explode", func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func TestRateLimitMoreInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		docsURL  string
+		wantLink bool
+	}{
+		{name: "Unset", docsURL: ""},
+		{name: "Configured", docsURL: "https://docs.example.com/api", wantLink: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.limiter.enabled = true
+			app.config.limiter.rps = 0.001
+			app.config.limiter.burst = 1
+			app.config.errorDocsBaseURL = tt.docsURL
+
+			h := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			// The first request uses up the burst, so the second one is rejected.
+			status, _, _ := execute(t, h, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Status(t, status, http.StatusOK)
+
+			status, _, body := execute(t, h, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Status(t, status, http.StatusTooManyRequests)
+
+			js := decodeJSON(t, body)
+			assert.Equal(t, js["error"], any("rate limit exceeded"))
+
+			link, ok := js["more_info"]
+			if !tt.wantLink {
+				if ok {
+					t.Errorf("got more_info %v; want none", link)
+				}
+				return
+			}
+			assert.Equal(t, link, any("https://docs.example.com/api/errors/rate-limit"))
+		})
+	}
+}
+
+func TestLogRequestSampling(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        float64
+		wantSuccess int
+	}{
+		{name: "Rate 0", rate: 0, wantSuccess: 0},
+		{name: "Rate 1", rate: 1, wantSuccess: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.requestLogSampleRate = tt.rate
+
+			var buf bytes.Buffer
+			app.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/fail" {
+					app.serverErrorResponse(w, r, errors.New("boom"))
+					return
+				}
+				w.Write([]byte("OK"))
+			})
+			h := app.logRequestContext(app.logRequest(next))
+
+			totalBefore, loggedBefore := requestsTotal.Value(), requestsLogged.Value()
+
+			for range 10 {
+				execute(t, h, httptest.NewRequest(http.MethodGet, "/ok", nil))
+			}
+			execute(t, h, httptest.NewRequest(http.MethodGet, "/fail", nil))
+
+			statuses := map[float64]int{}
+			for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+				var entry map[string]any
+				err := json.Unmarshal(line, &entry)
+				assert.NilError(t, err)
+
+				if entry["msg"] == "completed request" {
+					statuses[entry["status"].(float64)]++
+				}
+			}
+
+			assert.Equal(t, statuses[http.StatusOK], tt.wantSuccess)
+			assert.Equal(t, statuses[http.StatusInternalServerError], 1)
+
+			assert.Equal(t, requestsTotal.Value()-totalBefore, int64(11))
+			assert.Equal(t, requestsLogged.Value()-loggedBefore, int64(tt.wantSuccess+1))
+		})
+	}
+}
+
+func TestEnableCORS(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.cors.trustedOrigins = []string{"https://app.example.com", "https://admin.example.com"}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	tests := []struct {
+		name          string
+		method        string
+		origin        string
+		preflight     bool
+		wantOrigin    string
+		wantPreflight bool
+	}{
+		{name: "No origin", method: http.MethodGet},
+		{name: "Trusted origin", method: http.MethodGet, origin: "https://admin.example.com", wantOrigin: "https://admin.example.com"},
+		{name: "Untrusted origin", method: http.MethodGet, origin: "https://evil.example.net"},
+		{name: "Trusted preflight", method: http.MethodOptions, origin: "https://app.example.com", preflight: true, wantOrigin: "https://app.example.com", wantPreflight: true},
+		{name: "Untrusted preflight", method: http.MethodOptions, origin: "https://evil.example.net", preflight: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/movies", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+			}
+
+			status, headers, body := execute(t, app.enableCORS(next), r)
+
+			assert.Status(t, status, http.StatusOK)
+			assert.Equal(t, headers.Get("Access-Control-Allow-Origin"), tt.wantOrigin)
+			assert.Equal(t, headers.Values("Vary"), []string{"Origin", "Access-Control-Request-Method"})
+
+			if tt.wantPreflight {
+				assert.Equal(t, headers.Get("Access-Control-Allow-Methods"), "OPTIONS, PUT, PATCH, DELETE")
+				assert.Equal(t, headers.Get("Access-Control-Allow-Headers"), "Authorization, Content-Type")
+				assert.Equal(t, body, "")
+				return
+			}
+
+			// Anything other than a trusted preflight request reaches the handler.
+			assert.Equal(t, body, "OK")
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	app := newTestApplication(t)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Write([]byte("OK"))
+	})
+
+	received, sent, processing := totalRequestsReceived.Value(), totalResponsesSent.Value(), totalProcessingTime.Value()
+
+	for range 3 {
+		execute(t, app.metrics(next), httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+	}
+
+	assert.Equal(t, totalRequestsReceived.Value()-received, int64(3))
+	assert.Equal(t, totalResponsesSent.Value()-sent, int64(3))
+
+	if elapsed := totalProcessingTime.Value() - processing; elapsed < 3000 {
+		t.Errorf("got total processing time %dμs; want at least 3000μs", elapsed)
+	}
+
+	// The counters are served by the expvar handler.
+	_, _, body := execute(t, expvar.Handler(), httptest.NewRequest(http.MethodGet, "/v1/debug/vars", nil))
+	assert.StringContains(t, body, `"total_requests_received": `)
+	assert.StringContains(t, body, `"total_processing_time_μs": `)
+}
+
+func TestMetricsByStatus(t *testing.T) {
+	app := newTestApplication(t)
+
+	// responsesWithStatus() returns the number of responses sent with the status code.
+	responsesWithStatus := func(code string) int64 {
+		if n, ok := totalResponsesSentByStatus.Get(code).(*expvar.Int); ok {
+			return n.Value()
+		}
+		return 0
+	}
+
+	notFound, ok := responsesWithStatus("404"), responsesWithStatus("200")
+
+	h := app.metrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			app.notFoundResponse(w, r)
+			return
+		}
+		// Write without calling WriteHeader(), so the status is an implicit 200.
+		w.Write([]byte("OK"))
+	}))
+
+	execute(t, h, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	execute(t, h, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	execute(t, h, httptest.NewRequest(http.MethodGet, "/ok", nil))
+
+	assert.Equal(t, responsesWithStatus("404")-notFound, int64(2))
+	assert.Equal(t, responsesWithStatus("200")-ok, int64(1))
+}
+
+func TestMetricsResponseWriterFlush(t *testing.T) {
+	app := newTestApplication(t)
+
+	var flushed bool
+	h := app.metrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("response writer doesn't implement http.Flusher")
+		}
+		w.Write([]byte("chunk"))
+		f.Flush()
+		flushed = true
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream", nil))
+
+	assert.Equal(t, flushed, true)
+	assert.Equal(t, rr.Flushed, true)
+}
+
+func TestComposeMiddleware(t *testing.T) {
+	var trace []string
+
+	// traced() returns a middleware which records when a request enters and leaves it.
+	traced := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				trace = append(trace, name+" in")
+				next.ServeHTTP(w, r)
+				trace = append(trace, name+" out")
+			})
+		}
+	}
+
+	h := composeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace = append(trace, "handler")
+	}), traced("a"), traced("b"), traced("c"))
+
+	execute(t, h, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, trace, []string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"})
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 1
+
+	h := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// request() sends a request from the same IP address as the given user.
+	request := func(user *data.User) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = app.contextSetUser(r, user)
+		status, _, _ := execute(t, h, r)
+		return status
+	}
+
+	alice := &data.User{ID: 1}
+	bob := &data.User{ID: 2}
+
+	// Each user has their own allowance, even though they share an IP address.
+	assert.Status(t, request(alice), http.StatusOK)
+	assert.Status(t, request(bob), http.StatusOK)
+	assert.Status(t, request(alice), http.StatusTooManyRequests)
+
+	// Anonymous clients are limited by IP address, separately from the users.
+	assert.Status(t, request(data.AnonymousUser), http.StatusOK)
+	assert.Status(t, request(data.AnonymousUser), http.StatusTooManyRequests)
+}
+
+func TestAuthenticateLimitsFailures(t *testing.T) {
+	// No token matches a user, and count the lookups.
+	lookups := 0
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			lookups++
+			return []string{"id", "created_at", "name", "email", "password_hash", "activated", "version"}, nil
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 2
+	app.authFailures = newMemoryLimiterStore(app.config.limiter.rps, app.config.limiter.burst)
+
+	h := app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remoteAddr, authorization string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Authorization", authorization)
+		status, _, _ := execute(t, h, r)
+		return status
+	}
+
+	bogus := "Bearer " + strings.Repeat("A", 26)
+
+	// The first failures use up the allowance, and after that the client is turned
+	// away without its token being looked up.
+	assert.Status(t, request("192.0.2.1:1234", bogus), http.StatusUnauthorized)
+	assert.Status(t, request("192.0.2.1:1234", "Basic abc"), http.StatusUnauthorized)
+	assert.Status(t, request("192.0.2.1:1234", bogus), http.StatusTooManyRequests)
+	assert.Equal(t, lookups, 1)
+
+	// Other IP addresses, and anonymous requests, aren't affected.
+	assert.Status(t, request("192.0.2.2:1234", bogus), http.StatusUnauthorized)
+	assert.Status(t, request("192.0.2.1:1234", ""), http.StatusOK)
+}
+
+func TestAuthenticateFailuresStoreError(t *testing.T) {
+	// No token matches a user.
+	db := sql.OpenDB(rowsConnector{
+		columns: []string{"id", "created_at", "name", "email", "password_hash", "activated", "version"},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+	app.config.limiter.enabled = true
+	app.authFailures = newRedisLimiterStore(&mockScripter{err: errRedisUnavailable}, 2, 4)
+
+	h := app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// With the shared store down, the token is still checked rather than the client
+	// being turned away.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+strings.Repeat("A", 26))
+	status, _, _ := execute(t, h, r)
+
+	assert.Status(t, status, http.StatusUnauthorized)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: ""},
+		{acceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "deflate", want: "deflate"},
+		{acceptEncoding: "deflate, gzip", want: "gzip"},
+		{acceptEncoding: "GZIP;q=0.5", want: "gzip"},
+		{acceptEncoding: "gzip;q=0, deflate", want: "deflate"},
+		{acceptEncoding: "br", want: ""},
+		{acceptEncoding: "*", want: "gzip"},
+		{acceptEncoding: "*;q=0", want: ""},
+		{acceptEncoding: "gzip;q=nonsense", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			assert.Equal(t, negotiateEncoding(tt.acceptEncoding), tt.want)
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication(t)
+
+	large := strings.Repeat(`{"title":"Moana","year":2016}`, 100)
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		contentType    string
+		body           string
+		wantEncoding   string
+	}{
+		{name: "Gzip", acceptEncoding: "gzip, deflate", contentType: "application/json", body: large, wantEncoding: "gzip"},
+		{name: "Deflate", acceptEncoding: "deflate", contentType: "application/json", body: large, wantEncoding: "deflate"},
+		{name: "Not accepted", contentType: "application/json", body: large},
+		{name: "Small body", acceptEncoding: "gzip", contentType: "application/json", body: `{"status":"available"}`},
+		{name: "Already compressed", acceptEncoding: "gzip", contentType: "image/png", body: large},
+		{name: "SVG", acceptEncoding: "gzip", contentType: "image/svg+xml", body: large, wantEncoding: "gzip"},
+		{name: "HEAD", method: http.MethodHead, acceptEncoding: "gzip", contentType: "application/json", body: large},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(tt.body))
+			}))
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, r)
+
+			assert.Equal(t, rr.Code, http.StatusCreated)
+			assert.Equal(t, rr.Header().Get("Content-Encoding"), tt.wantEncoding)
+			assert.Equal(t, rr.Header().Values("Vary"), []string{"Accept-Encoding"})
+
+			var body io.Reader = rr.Body
+			switch tt.wantEncoding {
+			case "gzip":
+				assert.Equal(t, rr.Header().Get("Content-Length"), "")
+				zr, err := gzip.NewReader(rr.Body)
+				assert.NilError(t, err)
+				body = zr
+			case "deflate":
+				zr, err := zlib.NewReader(rr.Body)
+				assert.NilError(t, err)
+				body = zr
+			}
+
+			got, err := io.ReadAll(body)
+			assert.NilError(t, err)
+			assert.Equal(t, string(got), tt.body)
+		})
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The handler flushes a small first chunk, which must reach the client straight away
+	// even though it's below compressMinSize.
+	var flushed []byte
+	rr := httptest.NewRecorder()
+	h := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first chunk"))
+		w.(http.Flusher).Flush()
+		flushed = bytes.Clone(rr.Body.Bytes())
+		w.Write([]byte(", second chunk"))
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(rr, r)
+
+	assert.Equal(t, rr.Header().Get("Content-Encoding"), "gzip")
+	assert.Equal(t, rr.Flushed, true)
+
+	zr, err := gzip.NewReader(bytes.NewReader(flushed))
+	assert.NilError(t, err)
+	first := make([]byte, len("first chunk"))
+	_, err = io.ReadFull(zr, first)
+	assert.NilError(t, err)
+	assert.Equal(t, string(first), "first chunk")
+
+	zr, err = gzip.NewReader(rr.Body)
+	assert.NilError(t, err)
+	got, err := io.ReadAll(zr)
+	assert.NilError(t, err)
+	assert.Equal(t, string(got), "first chunk, second chunk")
+}
+
+func TestCompressMetrics(t *testing.T) {
+	app := newTestApplication(t)
+
+	responsesWithStatus := func(code string) int64 {
+		if n, ok := totalResponsesSentByStatus.Get(code).(*expvar.Int); ok {
+			return n.Value()
+		}
+		return 0
+	}
+
+	accepted := responsesWithStatus("202")
+
+	// The compress() middleware holds back the status code until it has seen the body,
+	// but the metrics() middleware must still record the one the handler sent.
+	h := composeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.writeJSON(w, http.StatusAccepted, envelope{"padding": strings.Repeat("x", compressMinSize)}, nil)
+	}), app.metrics, app.compress)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	status, headers, _ := execute(t, h, r)
+
+	assert.Equal(t, status, http.StatusAccepted)
+	assert.Equal(t, headers.Get("Content-Encoding"), "gzip")
+	assert.Equal(t, responsesWithStatus("202")-accepted, int64(1))
+}
+
+func TestLimitInFlight(t *testing.T) {
+	app := newTestApplication(t)
+	app.inFlightSlots = make(chan struct{}, 2)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	h := app.limitInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("OK"))
+	}))
+
+	// Fill both slots with requests which block until they are released.
+	statuses := make(chan int, 2)
+	for range 2 {
+		go func() {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/slow", nil))
+			statuses <- rr.Code
+		}()
+		<-entered
+	}
+
+	// Any more requests are refused while the slots are full.
+	status, headers, body := execute(t, h, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Status(t, status, http.StatusServiceUnavailable)
+	assert.Equal(t, headers.Get("Retry-After"), "1")
+	assert.StringContains(t, body, "too many requests")
+
+	// The in-flight requests complete normally, and free up their slots.
+	close(release)
+	assert.Equal(t, <-statuses, http.StatusOK)
+	assert.Equal(t, <-statuses, http.StatusOK)
+
+	status, _, _ = execute(t, h, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Status(t, status, http.StatusOK)
+}
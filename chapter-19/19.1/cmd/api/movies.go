@@ -1,30 +1,41 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/csv"
 	// "encoding/json"
 	"errors"
 	"fmt"
 	"greelight.techkunstler.com/internal/data"
 	"greelight.techkunstler.com/internal/validator"
 	"net/http"
-	// "time"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// createMovieInput holds a new movie in a request body. It's shared by the create and
+// batch create handlers.
+type createMovieInput struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"` // Make this field a data.Runtime type.
+	Genres  genreList    `json:"genres"`
+	Tags    data.Tags    `json:"tags"`
+}
+
 // Add a createMovieHandler for the "POST /v1/movies" endpoint. For now we simply
 // return a plain-text placeholder response.
 
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
-	// Decrae an anonymus struct to hold the information that we expect to be in the
+	// Declare a createMovieInput struct to hold the information that we expect to be in the
 	// HTTP request body (note that the field names and types in the struct are subset
 	//of the move sturct that we created earlier).
 	// This struct will be our *target decode destination*
 
-	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"` // Make this field a data.Runtime type.
-		Genres  []string     `json:"genres"`
-	}
+	var input createMovieInput
 
 	/* // Initialize a new json.Decoder instance which reads from the request body, and then use the Decode() method to decode the body contents in to the input struct.
 	// Importantly, notice that when we call Decode() we pass a *pointer* to the input struct as the target decode destination. If there was an error during decoding, we
@@ -45,20 +56,29 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Initialize a new Validator instance.
+	v := app.newValidator(r)
+
+	// If the client sent too many genres, decoding stopped early and there's nothing
+	// sensible to validate, so reject the request straight away.
+	if input.Genres.TooMany {
+		data.AddTooManyGenresError(v)
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
 	// Copy the values from the input struct to a new Movie struct.
 	movie := &data.Movie{
 		Title:   input.Title,
 		Year:    input.Year,
 		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Genres:  input.Genres.Values,
+		Tags:    input.Tags,
 	}
 
-	// Initialize a new Validator instance.
-	v := validator.New()
-
 	// Use the Valid() method to see if any of the checks failed. If they did, then use the failedValidationResponse() helper to send a response to the clien,
-	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	if app.validateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
@@ -71,22 +91,140 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// When sending a HTTP response, we want to include a location header to let the client know which URL they can find the newly created resource at. We make an empty
-	// http.Header map and then use the Set() method to add a new Location header,
-	// interpolating the system-generated ID for our new movie in the URL.
-	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	// Write a JSON response with a 201 Created status code, the movie data in the
+	// response body, and a Location header interpolating the system-generated ID for
+	// our new movie in the URL.
+	app.writeCreated(w, r, app.resourceURL(r, "movies", movie.ID), envelope{"movie": movie})
+}
+
+// The validateMovie() helper runs data.ValidateMovie() and, if the -strict-genres flag is
+// set, also checks that the genres are all in the canonical list. If the -dedupe-genres
+// flag is set, the genres are normalized and any duplicates removed first, so that
+// ["drama", "Drama"] becomes ["drama"] rather than failing validation. If the
+// -sort-genres flag is set, the genres are sorted too, so that they are stored in
+// alphabetical order.
+
+func (app *application) validateMovie(v *validator.Validator, movie *data.Movie) {
+	if app.config.dedupeGenres {
+		movie.Genres = data.NormalizeGenres(movie.Genres)
+	}
+	if app.config.sortGenres {
+		slices.Sort(movie.Genres)
+	}
 
-	// Write a JSON response with a 201 Created status code, themovie data in the
-	// response body, and the location header.
+	data.ValidateMovie(v, movie)
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	if app.config.strictGenres {
+		data.ValidateCanonicalGenres(v, movie.Genres)
+	}
+}
+
+// maxMovieBatch is the most movies which can be created with one batch request.
+const maxMovieBatch = 100
+
+// The createMoviesBatchHandler() handler creates the movies in a JSON array in the
+// request body. By default the batch is all or nothing: if any of the movies is invalid,
+// the errors are sent back keyed by the movie's index in the array, like
+// "movies[2].year", and none of them are created. Otherwise they are inserted in a
+// single transaction. With ?partial=true each movie is handled on its own instead, see
+// createMoviesPartial().
+
+func (app *application) createMoviesBatchHandler(w http.ResponseWriter, r *http.Request) {
+	v := app.newValidator(r)
+
+	partial := app.readPartialParam(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	inputs, err := readJSONArray[createMovieInput](w, r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v.Check(len(inputs) >= 1, "movies", "must contain at least one movie")
+	v.Check(len(inputs) <= maxMovieBatch, "movies", fmt.Sprintf("must not contain more than %d movies", maxMovieBatch))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	movies := make([]*data.Movie, len(inputs))
+	validators := make([]*validator.Validator, len(inputs))
+
+	for i, input := range inputs {
+		movies[i] = &data.Movie{
+			Title:   input.Title,
+			Year:    input.Year,
+			Runtime: input.Runtime,
+			Genres:  input.Genres.Values,
+			Tags:    input.Tags,
+		}
+
+		// Validate each movie on its own, just as createMovieHandler() would.
+		validators[i] = app.newValidator(r)
+		if input.Genres.TooMany {
+			data.AddTooManyGenresError(validators[i])
+		} else {
+			app.validateMovie(validators[i], movies[i])
+		}
+	}
+
+	if partial {
+		app.createMoviesPartial(w, r, movies, validators)
+		return
+	}
+
+	// Copy any errors across with the movie's index in front of the key.
+	for i, mv := range validators {
+		for key, message := range mv.Errors {
+			v.AddError(fmt.Sprintf("movies[%d].%s", i, key), message)
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	err = app.models.Movies.InsertBatch(movies)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
-	// passing in the v.Errors map.
-	fmt.Fprintf(w, "%+v\n", input)
+	// There's no single URL for the new movies, so there's no Location header.
+	app.writeCreated(w, r, "", envelope{"movies": movies})
+}
+
+// The createMoviesPartial() helper creates a batch of movies in partial mode. Each movie
+// is inserted on its own, outside of a transaction, so that the valid movies are created
+// even if others in the batch are invalid or fail to insert. The response is a 207
+// Multi-Status listing the outcome for each movie, with the errors from its validator,
+// or the new movie.
+
+func (app *application) createMoviesPartial(w http.ResponseWriter, r *http.Request, movies []*data.Movie, validators []*validator.Validator) {
+	results := app.processBatch(len(movies), func(i int) batchItemResult {
+		if !validators[i].Valid() {
+			return batchItemResult{Status: http.StatusUnprocessableEntity, Error: validators[i].Errors}
+		}
+
+		err := app.models.Movies.Insert(movies[i])
+		if err != nil {
+			// As with serverErrorResponse(), the details are logged but not sent.
+			app.logError(r, err)
+			return batchItemResult{
+				Status: http.StatusInternalServerError,
+				Error:  "the server encountered a problem and couldn't create this movie",
+			}
+		}
+
+		return batchItemResult{Status: http.StatusCreated, Resource: movies[i]}
+	})
+
+	app.writeMultiStatus(w, r, results)
 }
 
 // Add a showMoivew handler for the "GET /v1/movies/:id" endpoint. For now, we retrive the
@@ -99,11 +237,41 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Admins can fetch a soft-deleted movie by setting include_deleted=true. The response
+	// then has "deleted": true so that clients can render it differently.
+	v := app.newValidator(r)
+
+	includeDeleted := app.readBool(r.URL.Query(), "include_deleted", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	if includeDeleted {
+		user := app.contextGetUser(r)
+
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include("admin:read") {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
 	// Call the Get() method to fetch the data for a specific movie. We also need to use
 	// the errors.Is() function to check if it returns a data.ErrRecordNotFound error,
 	// in which case we send a 404 Not Found response to the client.
 
-	movie, err := app.models.Movies.Get(id)
+	var movie *data.Movie
+	if includeDeleted {
+		movie, err = app.models.Movies.GetIncludingDeleted(id)
+	} else {
+		movie, err = app.models.Movies.Get(id)
+	}
 
 	if err != nil {
 		switch {
@@ -129,10 +297,21 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		Version:   1,
 	} */
 
+	// Send the movie's ETag, and if the client already has this version of the movie,
+	// send a 304 Not Modified response with no body instead of the movie. The Vary
+	// header must be the same as for a full response.
+	etag := app.setETag(w, movie)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Add("Vary", "Accept")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	// Encode the struct to JSON and send it as the HTTP response.
 	// Create an envelope {"movie": movie} instance and pass it to writeJSON(), instead of
 	// passing the plain movie struct.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	// The movie can be sent as XML, if the client asks for it in the Accept header.
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie.View(app.contextGetMovieView(r))}, nil)
 
 	if err != nil {
 		/* app.logger.Error(err.Error())
@@ -142,6 +321,60 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 
 }
 
+// movieUpdateFields lists the fields of a movie which can be changed by an update, using
+// their JSON names.
+var movieUpdateFields = []string{"title", "year", "runtime", "genres", "featured", "tags"}
+
+// movieUpdateInput holds the fields of a partial movie update. Use pointers for the
+// Title, year and Runtime fields so that we can tell a field which wasn't provided apart
+// from its zero value. Tags replace the movie's existing tags, and an empty object
+// removes them all.
+type movieUpdateInput struct {
+	Title    *string       `json:"title"`
+	Year     *int32        `json:"year"`
+	Runtime  *data.Runtime `json:"runtime"`
+	Genres   []string      `json:"genres"`
+	Featured *bool         `json:"featured"`
+	Tags     data.Tags     `json:"tags"`
+}
+
+// masked() converts the input to a data.MovieUpdate, dropping any fields which aren't
+// included in the field mask.
+
+func (input movieUpdateInput) masked(mask fieldMask) data.MovieUpdate {
+	// If the input.Title Value is nil then we know that no corresponding "title" key
+	// value pair was provided in the JSON request body, and the nil is passed on so
+	// that the movie's title is left unchanged.
+
+	var u data.MovieUpdate
+
+	if mask.includes("title") {
+		u.Title = input.Title
+	}
+
+	if mask.includes("year") {
+		u.Year = input.Year
+	}
+
+	if mask.includes("runtime") {
+		u.Runtime = input.Runtime
+	}
+
+	if mask.includes("genres") {
+		u.Genres = input.Genres
+	}
+
+	if mask.includes("featured") {
+		u.Featured = input.Featured
+	}
+
+	if mask.includes("tags") {
+		u.Tags = input.Tags
+	}
+
+	return u
+}
+
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the movie ID from the URL.
 
@@ -151,66 +384,101 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Clients can opt in to optimistic concurrency control by sending the version of the
+	// movie they fetched in the X-Expected-Version header. If it's no longer the current
+	// version, the update fails with an edit conflict rather than overwriting the
+	// changes made in between.
+	expectedVersion, err := app.readExpectedVersion(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
 	// Fetch the existing movie record from the database, sending a 404 Not Found
-	// response to the client if we couldn't find a matching record.
+	// response to the client if we couldn't find a matching record. If patch upserts
+	// are enabled we carry on with a nil movie instead, and create it below.
 	movie, err := app.models.Movies.Get(id)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && app.patchUpsertEnabled(r):
+			movie = nil
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+			return
 		default:
 			app.serverErrorResponse(w, r, err)
-
+			return
 		}
-		return
 	}
 
-	// Use pointers for the Title, year and Runtime fields.
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
-	}
+	v := app.newValidator(r)
 
-	// Read the JSON request body data into the input struct.
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
+	// Read the optional field_mask query string parameter. If present, only the fields
+	// it lists are copied onto the movie record, even if others are in the body.
+	mask := app.readFieldMask(r.URL.Query(), "field_mask", movieUpdateFields, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	// If the input.Title Value is nil then we know that no corresponding "title" key
-	// value pair was provided in the JSON request body. So we move on and leave the movie
-	// record unchanged. Otherwise, we update the movie record with the new title
-	// value. Importantly, because input.Title is a now a pointer to a string, we need to dereference the pointer using
-	// * operator to get the underlying value, before assigning it to our movie record.
-
-	if input.Title != nil {
-		movie.Title = *input.Title
-	}
+	// Apply the changes to a copy of the movie, leaving the fetched record untouched
+	// so that we can report which fields were changed in the response. A body sent as
+	// application/merge-patch+json is a JSON merge patch (RFC 7386), where a null value
+	// clears a field. Otherwise, it's read into the input struct, where a null value is
+	// the same as leaving the field out.
+	var updated *data.Movie
+
+	if isMergePatch(r) {
+		// A missing movie which is being created starts out empty.
+		base := movie
+		if base == nil {
+			base = &data.Movie{}
+		}
 
-	if input.Year != nil {
-		movie.Year = *input.Year
-	}
+		updated, err = app.readMovieMergePatch(w, r, base, mask)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	} else {
+		var input movieUpdateInput
+
+		// Read the JSON request body data into the input struct.
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
 
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
+		if movie == nil {
+			updated = newMovieFromPatch(input.masked(mask))
+		} else {
+			updated = movie.WithUpdates(input.masked(mask))
+		}
 	}
 
-	if input.Genres != nil {
-		movie.Genres = input.Genres
+	if movie == nil {
+		app.createMovieFromPatch(w, r, updated, v)
+		return
 	}
 
 	// Validate the updted movie record, ending the client a 422 Unprocessable Entity
 	// response if any checks fail.
-	v := validator.New()
-
-	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	if app.validateMovie(v, updated); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
+	// Work out which fields the request actually modified before we save the record.
+	changes := data.DiffMovies(movie, updated)
+
+	// Update() only saves the record if its version still matches, so checking against
+	// the client's expected version, rather than the one we just fetched, makes sure
+	// the client hasn't missed any changes since it fetched the movie.
+	if expectedVersion != 0 {
+		updated.Version = expectedVersion
+	}
+
 	/* // Pass the updated movie record to our new Update() method.
 	err = app.models.Movies.Update(movie)
 	if err != nil {
@@ -219,7 +487,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	} */
 
 	// Intercept any errEditConflict error and call the new editConflictResponse() helper
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(updated)
 	if err != nil {
 
 		switch {
@@ -231,14 +499,66 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Write the updated movie record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	// Write the updated movie record in a JSON response, along with the changes.
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": updated, "changes": changes}, nil)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// The patchUpsertEnabled() helper reports whether a PATCH request for a missing movie
+// should create it, either because the -patch-upsert flag is set or because the client
+// sent a "Prefer: create-if-missing" header.
+
+func (app *application) patchUpsertEnabled(r *http.Request) bool {
+	if app.config.patchUpsert {
+		return true
+	}
+
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "create-if-missing") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// The createMovieFromPatch() helper creates the movie built from the body of a PATCH
+// request for a movie which doesn't exist. Unlike an update, every field must be
+// provided, so a partial body is rejected with the usual "must be provided" validation
+// errors. The new movie gets the next available ID rather than the one in the URL, and
+// the Location header tells the client where to find it.
+
+func (app *application) createMovieFromPatch(w http.ResponseWriter, r *http.Request, movie *data.Movie, v *validator.Validator) {
+	if app.validateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !app.config.patchUpsert {
+		w.Header().Set("Preference-Applied", "create-if-missing")
+	}
+
+	app.writeCreated(w, r, app.resourceURL(r, "movies", movie.ID), envelope{"movie": movie})
+}
+
+// newMovieFromPatch() returns a new movie with just the fields provided in the update.
+
+func newMovieFromPatch(u data.MovieUpdate) *data.Movie {
+	var movie data.Movie
+	return movie.WithUpdates(u)
+}
+
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the movie ID from the URL
 
@@ -271,69 +591,253 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
-	// To keep things consistent with our other handlers, we'll define an input struct
-	// to hold the expected values from the request query string.
-	// Embed the new Filters struct
-	var input struct {
-		Title  string
-		Genres []string
-		data.Filters
+// The restoreMovieHandler() handler brings back a movie which has been deleted, and
+// sends it in the response. It sends a 404 Not Found response if the movie doesn't exist
+// or hasn't been deleted.
+
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Movies.Restore(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	// Initialize a new Validator instance.
 
-	v := validator.New()
+	v := app.newValidator(r)
 
-	// Cal r.URL.Query() to get the url.Values map containing the query string data.
-	qs := r.URL.Query()
+	// Read the title, genres and filters from the query string, and send a response
+	// containing the errors if any of them are invalid.
+	input := app.readMovieFilters(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// A CSV export, requested with GET /v1/movies.csv or an Accept: text/csv header,
+	// streams every matching movie rather than a page of them.
+	if strings.HasSuffix(r.URL.Path, ".csv") || preferredFormat(r.Header.Get("Accept")) == "csv" {
+		app.writeMoviesCSV(w, r, input.Title, input.Genres, input.Filters)
+		return
+	}
+
+	// Call the GetAll() method to retrievethe movies, passing in the various filter
+	// parameters.
+
+	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Send a JSON (or, if the client asks for it, XML) response containing the movie data.
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movies": data.ViewMovies(movies, app.contextGetMovieView(r)), "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// movieFiltersInput holds the title, genres and filters which select the movies for
+// listMoviesHandler() and countMoviesHandler().
+type movieFiltersInput struct {
+	Title  string `query:"title"`
+	Genres []string
+	data.Filters
+}
+
+// The readMovieFilters() helper reads the title, genres and filters which
+// listMoviesHandler() and countMoviesHandler() accept from the query string, and
+// validates them, recording any errors in the validator.
 
-	// Use our helpers to extract the title and genres query string values, falling back
-	// to defaults of an empty string and empty slice respectively. If they are not
-	// provided by theclient.
+func (app *application) readMovieFilters(qs url.Values, v *validator.Validator) movieFiltersInput {
+	// To keep things consistent with our other handlers, we'll define an input struct
+	// to hold the expected values from the request query string.
+	// Embed the new Filters struct
+	var input movieFiltersInput
 
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	// In strict mode, reject any query string parameters this endpoint doesn't support.
+	app.checkQueryParams(qs, []string{"title", "genres", "genres_match", "page", "page_size", "sort", "year_from", "year_to", "tag", "created_after"}, v)
 
-	// Get the page and page_size query string values as integers. notice that we set the default
-	// page value to 1 and default page_size to 20, and that we pass the
-	// validator instance as the final argument here.
+	// Set the defaults for the parameters the client doesn't provide: page 1 of the
+	// default page size, sorted by ascending movie ID, with no year range, matching
+	// movies with all of the requested genres. Then decode the title, pagination, sort,
+	// year range, tag and genres match parameters over the top, using the query struct
+	// tags. Any values which can't be parsed are recorded in the validator.
 
-	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Page = 1
+	input.Filters.PageSize = app.config.filters.DefaultPageSize
+	input.Filters.Sort = "id"
+	input.Filters.GenresMatch = data.GenresMatchAll
 
-	// Extract the sort query string value, falling back to "id" if it is not
-	// provided. by the client (which will impy an ascending sort on movie ID).
+	app.decodeQuery(qs, &input, v)
 
-	input.Filters.Sort = app.readString(qs, "sort", "id")
+	// The genres filter has its own rules for a blank value, so it's read separately.
+	input.Genres = app.readGenresFilter(qs)
+	// Likewise, decodeQuery() doesn't handle dates, so the created_after filter is read
+	// separately too.
+	input.Filters.CreatedAfter = app.readDate(qs, "created_after", time.Time{}, v)
 	// Add the supported sort values for this endpoint to the sort safelist.
 	input.Filters.SortSafeList = []string{"id", "title", "year",
 		"runtime", "-id", "-title",
 		"-year", "-runtime"}
-	// Check the validator instance for any errors and use the failedValidationResponse()
-	// helper to send the client a response if necessary.
-	// Execute the validateion checks on the Filters struct and send a response containing the errors if necessary
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	// Execute the validateion checks on the Filters struct.
+	app.config.filters.Validate(v, input.Filters)
+
+	return input
+}
+
+// The writeMoviesCSV() helper streams the movies matching the filters as CSV, ignoring
+// the pagination, with a header row naming the columns. The genres are joined with "|"
+// in a single cell. Anonymous clients only get the id, title and year columns, as in
+// the public view of the list endpoint.
+
+func (app *application) writeMoviesCSV(w http.ResponseWriter, r *http.Request, title string, genres []string, filters data.Filters) {
+	public := app.contextGetMovieView(r) == data.MovieViewPublic
+
+	header := []string{"id", "title", "year", "runtime", "genres", "version"}
+	if public {
+		header = header[:3]
+	}
+
+	cw := csv.NewWriter(w)
+
+	// The headers are only set once the query has succeeded, so that an error response
+	// isn't saved as movies.csv by the client.
+	fetch := func() (*sql.Rows, error) {
+		rows, err := app.models.Movies.ExportRows(r.Context(), title, genres, filters)
+		if err != nil {
+			return nil, err
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="movies.csv"`)
+		w.Header().Add("Vary", "Accept")
+
+		cw.Write(header)
+		cw.Flush()
+		return rows, cw.Error()
+	}
+
+	encode := func(rows *sql.Rows) error {
+		movie, err := app.models.Movies.ScanExportRow(rows)
+		if err != nil {
+			return err
+		}
+
+		record := []string{strconv.FormatInt(movie.ID, 10), movie.Title, strconv.Itoa(int(movie.Year))}
+		if !public {
+			record = append(record,
+				strconv.Itoa(int(movie.Runtime)),
+				strings.Join(movie.Genres, "|"),
+				strconv.Itoa(int(movie.Version)))
+		}
+
+		cw.Write(record)
+		cw.Flush()
+		return cw.Error()
+	}
+
+	app.streamRows(w, r, fetch, encode)
+}
+
+// The countMoviesHandler() returns the number of movies matching the filters supported
+// by listMoviesHandler(), without fetching the movies themselves. It accepts the same
+// query string parameters, so a count always matches the listing's total_records.
+
+func (app *application) countMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := app.newValidator(r)
+
+	input := app.readMovieFilters(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	// Call the GetAll() method to retrievethe movies, passing in the various filter
-	// parameters.
+	count, err := app.models.Movies.Count(input.Title, input.Genres, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	err = app.writeJSON(w, http.StatusOK, envelope{"count": count}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listDuplicateMoviesHandler() returns groups of movies which are likely to be
+// duplicates, based on their titles being similar and their years matching.
+
+func (app *application) listDuplicateMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	groups, err := app.models.Movies.FindDuplicates(app.config.duplicatesThreshold)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Send a JSON response containing the move data.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"duplicates": groups}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
+}
+
+// The listFeaturedMoviesHandler() returns the movies which editors have flagged as
+// featured, most recently updated first. Only the page and page_size query string
+// parameters are supported.
+
+func (app *application) listFeaturedMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+
+	v := app.newValidator(r)
+
+	qs := r.URL.Query()
+
+	app.checkQueryParams(qs, []string{"page", "page_size"}, v)
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", app.config.filters.DefaultPageSize, v)
+
+	// The featured listing has a fixed sort order, so this is the only permitted value.
+	filters.Sort = "-updated_at"
+	filters.SortSafeList = []string{"-updated_at"}
+
+	if app.config.filters.Validate(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
 
-	// Dump the contents of the input struct in a HTTP response.
+	movies, metadata, err := app.models.Movies.GetFeatured(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	fmt.Fprintf(w, "%+v\n", input)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -0,0 +1,904 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestMovieUpdateInputFieldMask(t *testing.T) {
+	app := newTestApplication(t)
+
+	title := "Moana 2"
+	year := int32(2024)
+	runtime := data.Runtime(100)
+
+	input := movieUpdateInput{
+		Title:   &title,
+		Year:    &year,
+		Runtime: &runtime,
+		Genres:  []string{"animation"},
+	}
+
+	v := validator.New()
+	mask := app.readFieldMask(url.Values{"field_mask": {"title,year"}}, "field_mask", movieUpdateFields, v)
+	if !v.Valid() {
+		t.Fatalf("unexpected validation errors: %v", v.Errors)
+	}
+
+	movie := &data.Movie{
+		Title:   "Moana",
+		Year:    2016,
+		Runtime: 107,
+		Genres:  []string{"animation", "adventure"},
+	}
+
+	movie = movie.WithUpdates(input.masked(mask))
+
+	// Only the masked fields should have changed, even though the input included
+	// runtime and genres too.
+	if movie.Title != title || movie.Year != year {
+		t.Errorf("masked fields not applied: got title %q, year %d", movie.Title, movie.Year)
+	}
+	if movie.Runtime != 107 {
+		t.Errorf("got runtime %d; want unchanged 107", movie.Runtime)
+	}
+	if !slices.Equal(movie.Genres, []string{"animation", "adventure"}) {
+		t.Errorf("got genres %v; want unchanged", movie.Genres)
+	}
+
+	// Without a mask every provided field is applied.
+	movie = movie.WithUpdates(input.masked(nil))
+	if movie.Runtime != runtime {
+		t.Errorf("got runtime %d; want %d", movie.Runtime, runtime)
+	}
+}
+
+func TestReadFieldMaskUnknownField(t *testing.T) {
+	app := newTestApplication(t)
+
+	v := validator.New()
+	app.readFieldMask(url.Values{"field_mask": {"title,rating"}}, "field_mask", movieUpdateFields, v)
+
+	if v.Valid() {
+		t.Fatal("expected a validation error for an unknown field")
+	}
+	if got := v.Errors["field_mask"]; got != `contains unknown field "rating"` {
+		t.Errorf("got error %q", got)
+	}
+}
+
+func TestListMoviesStrictQueryParams(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.strictQueryParams = true
+
+	r, err := http.NewRequest(http.MethodGet, "/v1/movies?title=moana&sortt=-year", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, body := execute(t, http.HandlerFunc(app.listMoviesHandler), r)
+
+	assert.Status(t, code, http.StatusUnprocessableEntity)
+	assert.JSONField(t, []byte(body), "error.query", "must not contain unknown query parameters: sortt")
+}
+
+func TestCheckQueryParamsLenient(t *testing.T) {
+	app := newTestApplication(t)
+
+	qs := url.Values{"title": {"moana"}, "sortt": {"-year"}}
+	allowed := []string{"title", "sort"}
+
+	// By default unknown parameters are ignored.
+	v := validator.New()
+	app.checkQueryParams(qs, allowed, v)
+	if !v.Valid() {
+		t.Errorf("got errors %v in lenient mode; want none", v.Errors)
+	}
+
+	app.config.strictQueryParams = true
+
+	v = validator.New()
+	app.checkQueryParams(qs, allowed, v)
+	if v.Valid() {
+		t.Error("got no errors in strict mode; want one")
+	}
+}
+
+func TestShowMovieHandlerIncludeDeleted(t *testing.T) {
+	app := newTestApplication(t)
+
+	// An invalid include_deleted value is rejected before the database is touched.
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies/1?include_deleted=maybe", nil)
+	r = app.contextSetUser(r, data.AnonymousUser)
+	r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey,
+		httprouter.Params{{Key: "id", Value: "1"}}))
+
+	status, _, body := execute(t, http.HandlerFunc(app.showMovieHandler), r)
+
+	assert.Status(t, status, http.StatusUnprocessableEntity)
+	assert.JSONField(t, []byte(body), "error.include_deleted", "must be a boolean value")
+}
+
+func TestPatchUpsertEnabled(t *testing.T) {
+	tests := []struct {
+		name   string
+		flag   bool
+		prefer []string
+		want   bool
+	}{
+		{name: "Disabled", want: false},
+		{name: "Flag", flag: true, want: true},
+		{name: "Prefer header", prefer: []string{"create-if-missing"}, want: true},
+		{name: "Prefer list", prefer: []string{"return=minimal, Create-If-Missing"}, want: true},
+		{name: "Other preference", prefer: []string{"return=minimal"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.patchUpsert = tt.flag
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", nil)
+			for _, p := range tt.prefer {
+				r.Header.Add("Prefer", p)
+			}
+
+			if got := app.patchUpsertEnabled(r); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchUpsertMovies(t *testing.T) {
+	app := newTestApplication(t)
+
+	title := "Moana"
+	year := int32(2016)
+	runtime := data.Runtime(107)
+	genres := []string{"animation", "adventure"}
+
+	t.Run("Patch update", func(t *testing.T) {
+		existing := &data.Movie{ID: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: genres, Version: 1}
+
+		newTitle := "Moana 2"
+		updated := existing.WithUpdates(data.MovieUpdate{Title: &newTitle})
+
+		v := validator.New()
+		app.validateMovie(v, updated)
+		assert.Equal(t, v.Errors, map[string]string{})
+
+		assert.Equal(t, updated.ID, int64(1))
+		assert.Equal(t, updated.Title, newTitle)
+		assert.Equal(t, updated.Year, year)
+	})
+
+	t.Run("Patch create", func(t *testing.T) {
+		movie := newMovieFromPatch(data.MovieUpdate{Title: &title, Year: &year, Runtime: &runtime, Genres: genres})
+
+		v := validator.New()
+		app.validateMovie(v, movie)
+		assert.Equal(t, v.Errors, map[string]string{})
+
+		assert.Equal(t, movie.ID, int64(0))
+		assert.Equal(t, movie.Title, title)
+		assert.Equal(t, movie.Genres, genres)
+	})
+
+	t.Run("Patch incomplete create", func(t *testing.T) {
+		movie := newMovieFromPatch(data.MovieUpdate{Title: &title})
+
+		v := validator.New()
+		app.validateMovie(v, movie)
+
+		for _, key := range []string{"year", "runtime", "genres"} {
+			assert.Equal(t, v.Errors[key], "must be provided")
+		}
+	})
+}
+
+func TestPublicReads(t *testing.T) {
+	movies := []*data.Movie{
+		{ID: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Version: 1},
+	}
+
+	app := newTestApplication(t)
+	app.config.publicReads = true
+
+	t.Run("Anonymous", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+		r = app.contextSetMovieView(r, data.MovieViewPublic)
+
+		js, err := json.Marshal(envelope{"movies": data.ViewMovies(movies, app.contextGetMovieView(r))})
+		assert.NilError(t, err)
+		assert.JSONField(t, js, "movies", []map[string]any{{"id": 1, "title": "Moana", "year": 2016}})
+	})
+
+	t.Run("Authenticated", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+		r = app.contextSetUser(r, &data.User{ID: 1, Activated: true})
+
+		js, err := json.Marshal(envelope{"movies": data.ViewMovies(movies, app.contextGetMovieView(r))})
+		assert.NilError(t, err)
+		assert.JSONField(t, js, "movies", movies)
+	})
+
+	t.Run("Anonymous allowed through", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+		r = app.contextSetUser(r, data.AnonymousUser)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, app.contextGetMovieView(r), data.MovieViewPublic)
+			w.WriteHeader(http.StatusTeapot)
+		})
+
+		status, _, _ := execute(t, app.publicReadPermission("movies:read", next), r)
+		assert.Status(t, status, http.StatusTeapot)
+
+		// With public reads turned off, anonymous users must authenticate.
+		app.config.publicReads = false
+		status, _, _ = execute(t, app.publicReadPermission("movies:read", next), r)
+		assert.Status(t, status, http.StatusUnauthorized)
+	})
+}
+
+func TestCreateMovieHandlerTooManyGenres(t *testing.T) {
+	app := newTestApplication(t)
+
+	// Build a body with as many genres as will fit in the 1MB body limit.
+	genres := strings.TrimSuffix(strings.Repeat(`"a",`, 200_000), ",")
+	body := `{"title":"Moana","year":2016,"runtime":"107 mins","genres":[` + genres + `]}`
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+
+	// The request is rejected by the decoding guard, before validation or the
+	// database are reached.
+	status, _, resp := execute(t, http.HandlerFunc(app.createMovieHandler), r)
+
+	assert.Status(t, status, http.StatusUnprocessableEntity)
+	assert.JSONField(t, []byte(resp), "error.genres", "must not contain more than 5 genres")
+}
+
+func TestCreateMovieHandlerTooManyTags(t *testing.T) {
+	app := newTestApplication(t)
+
+	tags := make([]string, data.MaxTags+1)
+	for i := range tags {
+		tags[i] = fmt.Sprintf(`"key%d":"value"`, i)
+	}
+	body := `{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"],"tags":{` + strings.Join(tags, ",") + `}}`
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+
+	status, _, resp := execute(t, http.HandlerFunc(app.createMovieHandler), r)
+
+	assert.Status(t, status, http.StatusUnprocessableEntity)
+	assert.JSONField(t, []byte(resp), "error.tags", "must not contain more than 20 tags")
+}
+
+func TestCreateMoviesBatchHandlerValidation(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantErrors map[string]any
+	}{
+		{
+			name:       "Not an array",
+			body:       `{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Empty",
+			body:       `[]`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: map[string]any{"movies": "must contain at least one movie"},
+		},
+		{
+			name:       "Too many",
+			body:       "[" + strings.TrimSuffix(strings.Repeat(`{"title":"Moana"},`, maxMovieBatch+1), ",") + "]",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: map[string]any{"movies": fmt.Sprintf("must not contain more than %d movies", maxMovieBatch)},
+		},
+		{
+			// The errors for each movie are keyed by its index, and because the batch is
+			// rejected the database is never reached.
+			name: "Invalid movies",
+			body: `[
+				{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"]},
+				{"title":"","year":2016,"runtime":"107 mins","genres":["animation"]},
+				{"title":"Up","year":3000,"runtime":"96 mins","genres":["animation"]}
+			]`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: map[string]any{
+				"movies[1].title": "must be provided",
+				"movies[2].year":  "must not be in the future",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch", strings.NewReader(tt.body))
+
+			status, _, body := execute(t, http.HandlerFunc(app.createMoviesBatchHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			if tt.wantErrors != nil {
+				assert.Equal(t, decodeJSON(t, body)["error"], any(tt.wantErrors))
+			}
+		})
+	}
+}
+
+func TestCreateMoviesBatchHandlerPartial(t *testing.T) {
+	// Answer each insert with the next movie ID, except for "Up", whose insert fails. The
+	// fake database doesn't support transactions, so only movies which are inserted one
+	// at a time can be created.
+	var inserts int64
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			if args[0].Value == "Up" {
+				return []string{"id", "created_at", "updated_at", "version"}, nil
+			}
+			inserts++
+			return []string{"id", "created_at", "updated_at", "version"},
+				[][]driver.Value{{inserts, time.Now(), time.Now(), int64(1)}}
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	body := `[
+		{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"]},
+		{"title":"","year":2016,"runtime":"107 mins","genres":["animation"]},
+		{"title":"Up","year":2009,"runtime":"96 mins","genres":["animation"]},
+		{"title":"Coco","year":2017,"runtime":"105 mins","genres":["animation"]}
+	]`
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch?partial=true", strings.NewReader(body))
+
+	status, _, resp := execute(t, http.HandlerFunc(app.createMoviesBatchHandler), r)
+
+	assert.Status(t, status, http.StatusMultiStatus)
+	assert.Equal(t, inserts, int64(2))
+
+	results := decodeJSON(t, resp)["results"].([]any)
+	wantStatus := []float64{http.StatusCreated, http.StatusUnprocessableEntity, http.StatusInternalServerError, http.StatusCreated}
+	if len(results) != len(wantStatus) {
+		t.Fatalf("got %d results; want %d", len(results), len(wantStatus))
+	}
+	for i, result := range results {
+		assert.Equal(t, result.(map[string]any)["status"], any(wantStatus[i]))
+	}
+
+	invalid, _ := json.Marshal(results[1])
+	assert.JSONField(t, invalid, "error.title", "must be provided")
+	created, _ := json.Marshal(results[3])
+	assert.JSONField(t, created, "resource.title", "Coco")
+	assert.JSONField(t, []byte(resp), "summary.succeeded", 2)
+
+	// An invalid partial parameter is rejected before the body is read.
+	r = httptest.NewRequest(http.MethodPost, "/v1/movies/batch?partial=maybe", strings.NewReader(body))
+
+	status, _, resp = execute(t, http.HandlerFunc(app.createMoviesBatchHandler), r)
+
+	assert.Status(t, status, http.StatusUnprocessableEntity)
+	assert.JSONField(t, []byte(resp), "error.partial", "must be a boolean value")
+}
+
+func TestGenreListUnmarshal(t *testing.T) {
+	tests := []struct {
+		name        string
+		js          string
+		wantValues  []string
+		wantTooMany bool
+		wantErr     bool
+	}{
+		{name: "Within limit", js: `["drama","war"]`, wantValues: []string{"drama", "war"}},
+		{name: "At limit", js: `["a","b","c","d","e"]`, wantValues: []string{"a", "b", "c", "d", "e"}},
+		{name: "Over limit", js: `["a","b","c","d","e","f"]`, wantTooMany: true},
+		{name: "Empty", js: `[]`, wantValues: []string{}},
+		{name: "Null", js: `null`},
+		{name: "Not an array", js: `"drama"`, wantErr: true},
+		{name: "Not strings", js: `[1, 2]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input struct {
+				Genres genreList `json:"genres"`
+			}
+
+			err := json.Unmarshal([]byte(`{"genres":`+tt.js+`}`), &input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got nil error; want an error")
+				}
+				return
+			}
+			assert.NilError(t, err)
+
+			assert.Equal(t, input.Genres.Values, tt.wantValues)
+			assert.Equal(t, input.Genres.TooMany, tt.wantTooMany)
+		})
+	}
+}
+
+func TestValidateMovieDuplicateGenres(t *testing.T) {
+	tests := []struct {
+		name       string
+		dedupe     bool
+		wantGenres []string
+		wantErr    string
+	}{
+		{name: "Rejected by default", wantGenres: []string{"drama", "drama"}, wantErr: "must not contain duplicate values"},
+		{name: "Deduped", dedupe: true, wantGenres: []string{"drama"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.dedupeGenres = tt.dedupe
+
+			movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "drama"}}
+
+			v := validator.New()
+			app.validateMovie(v, movie)
+
+			assert.Equal(t, movie.Genres, tt.wantGenres)
+			assert.Equal(t, v.Errors["genres"], tt.wantErr)
+		})
+	}
+}
+
+func TestSortGenres(t *testing.T) {
+	// Answer the movie query with genres in the order they were stored.
+	db := sql.OpenDB(rowsConnector{
+		columns: []string{"id", "created_at", "title", "year", "runtime", "genres", "featured",
+			"tags", "updated_at", "deleted_at", "version"},
+		rows: [][]driver.Value{
+			{int64(7), time.Now(), "Casablanca", int64(1942), int64(102), []byte("{war,drama,romance}"), false,
+				[]byte("{}"), time.Now(), nil, int64(1)},
+		},
+	})
+	defer db.Close()
+
+	tests := []struct {
+		name       string
+		sort       bool
+		wantGenres []string
+	}{
+		{name: "Off", wantGenres: []string{"war", "drama", "romance"}},
+		{name: "On", sort: true, wantGenres: []string{"drama", "romance", "war"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.sortGenres = tt.sort
+			app.models = data.NewModels(db, data.DefaultTimeouts)
+			app.models.Movies.SortGenres = tt.sort
+
+			// Genres are sorted before they're stored...
+			movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"war", "drama", "romance"}}
+
+			v := validator.New()
+			app.validateMovie(v, movie)
+
+			assert.Equal(t, v.Valid(), true)
+			assert.Equal(t, movie.Genres, tt.wantGenres)
+
+			// ...and when they're read, in case they were stored in another order.
+			got, err := app.models.Movies.Get(7)
+			assert.NilError(t, err)
+			assert.Equal(t, got.Genres, tt.wantGenres)
+		})
+	}
+}
+
+func TestListMoviesHandlerCSV(t *testing.T) {
+	db := sql.OpenDB(rowsConnector{
+		columns: []string{"id", "title", "year", "runtime", "genres", "version"},
+		rows: [][]driver.Value{
+			{int64(1), "Moana", int64(2016), int64(107), []byte("{animation,adventure}"), int64(1)},
+			{int64(2), "Amélie, the fabulous", int64(2001), int64(122), []byte("{comedy}"), int64(3)},
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		view   data.MovieView
+		want   string
+	}{
+		{
+			name: "CSV path",
+			path: "/v1/movies.csv",
+			want: "id,title,year,runtime,genres,version\n" +
+				"1,Moana,2016,107,animation|adventure,1\n" +
+				"2,\"Amélie, the fabulous\",2001,122,comedy,3",
+		},
+		{
+			name:   "Accept header",
+			path:   "/v1/movies?page_size=1",
+			accept: "text/csv",
+			want: "id,title,year,runtime,genres,version\n" +
+				"1,Moana,2016,107,animation|adventure,1\n" +
+				"2,\"Amélie, the fabulous\",2001,122,comedy,3",
+		},
+		{
+			name: "Public view",
+			path: "/v1/movies.csv",
+			view: data.MovieViewPublic,
+			want: "id,title,year\n" +
+				"1,Moana,2016\n" +
+				"2,\"Amélie, the fabulous\",2001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			r = app.contextSetMovieView(r, tt.view)
+
+			status, headers, body := execute(t, http.HandlerFunc(app.listMoviesHandler), r)
+
+			assert.Status(t, status, http.StatusOK)
+			assert.Equal(t, headers.Get("Content-Type"), "text/csv")
+			assert.Equal(t, headers.Get("Content-Disposition"), `attachment; filename="movies.csv"`)
+			assert.Equal(t, body, tt.want)
+		})
+	}
+}
+
+func TestShowMovieHandlerETag(t *testing.T) {
+	// Answer the movie query with version 3 of movie 7.
+	db := sql.OpenDB(rowsConnector{
+		columns: []string{"id", "created_at", "title", "year", "runtime", "genres", "featured",
+			"tags", "updated_at", "deleted_at", "version"},
+		rows: [][]driver.Value{
+			{int64(7), time.Now(), "Moana", int64(2016), int64(107), []byte("{animation}"), false,
+				[]byte("{}"), time.Now(), nil, int64(3)},
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{name: "No If-None-Match", wantStatus: http.StatusOK},
+		{name: "Match", ifNoneMatch: `W/"7-3"`, wantStatus: http.StatusNotModified},
+		{name: "Strong match", ifNoneMatch: `"7-3"`, wantStatus: http.StatusNotModified},
+		{name: "Match in list", ifNoneMatch: `W/"7-1", W/"7-3"`, wantStatus: http.StatusNotModified},
+		{name: "Wildcard", ifNoneMatch: `*`, wantStatus: http.StatusNotModified},
+		{name: "Older version", ifNoneMatch: `W/"7-2"`, wantStatus: http.StatusOK},
+		{name: "Other movie", ifNoneMatch: `"8-3"`, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/7", nil)
+			r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey,
+				httprouter.Params{{Key: "id", Value: "7"}}))
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+
+			status, headers, body := execute(t, http.HandlerFunc(app.showMovieHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			assert.Equal(t, headers.Get("ETag"), `W/"7-3"`)
+
+			if tt.wantStatus == http.StatusNotModified {
+				assert.Equal(t, body, "")
+			} else {
+				assert.JSONField(t, []byte(body), "movie.version", 3)
+			}
+		})
+	}
+}
+
+func TestUpdateMovieHandlerExpectedVersion(t *testing.T) {
+	// Emulate version 5 of movie 7, which can only be updated by an UPDATE statement
+	// expecting version 5.
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			if strings.HasPrefix(strings.TrimSpace(query), "UPDATE") {
+				if args[7].Value != int64(5) {
+					return []string{"updated_at", "version"}, nil
+				}
+				return []string{"updated_at", "version"}, [][]driver.Value{{time.Now(), int64(6)}}
+			}
+
+			return []string{"id", "created_at", "title", "year", "runtime", "genres", "featured",
+					"tags", "updated_at", "deleted_at", "version"},
+				[][]driver.Value{{int64(7), time.Now(), "Moana", int64(2016), int64(107),
+					[]byte("{animation}"), false, []byte("{}"), time.Now(), nil, int64(5)}}
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	tests := []struct {
+		name            string
+		expectedVersion string
+		wantStatus      int
+	}{
+		{name: "No header", wantStatus: http.StatusOK},
+		{name: "Current version", expectedVersion: "5", wantStatus: http.StatusOK},
+		{name: "Stale version", expectedVersion: "3", wantStatus: http.StatusConflict},
+		{name: "Not a number", expectedVersion: "five", wantStatus: http.StatusBadRequest},
+		{name: "Zero", expectedVersion: "0", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/v1/movies/7", strings.NewReader(`{"title": "Moana 2"}`))
+			r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey,
+				httprouter.Params{{Key: "id", Value: "7"}}))
+			if tt.expectedVersion != "" {
+				r.Header.Set("X-Expected-Version", tt.expectedVersion)
+			}
+
+			status, _, body := execute(t, http.HandlerFunc(app.updateMovieHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			if tt.wantStatus == http.StatusOK {
+				assert.JSONField(t, []byte(body), "movie.version", 6)
+			}
+		})
+	}
+}
+
+func TestRestoreMovieHandler(t *testing.T) {
+	// Emulate movie 7, which has been deleted, and movie 8, which hasn't. Only the
+	// restore of movie 7 affects a row.
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			if strings.Contains(query, "deleted_at = NULL") {
+				if args[0].Value != int64(7) {
+					return nil, nil
+				}
+				return nil, [][]driver.Value{{}}
+			}
+
+			return []string{"id", "created_at", "title", "year", "runtime", "genres", "featured",
+					"tags", "updated_at", "deleted_at", "version"},
+				[][]driver.Value{{args[0].Value, time.Now(), "Moana", int64(2016), int64(107),
+					[]byte("{animation}"), false, []byte("{}"), time.Now(), nil, int64(3)}}
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	tests := []struct {
+		name       string
+		id         string
+		wantStatus int
+	}{
+		{name: "Deleted", id: "7", wantStatus: http.StatusOK},
+		{name: "Not deleted", id: "8", wantStatus: http.StatusNotFound},
+		{name: "Invalid ID", id: "0", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Restoring takes no payload, so the request has an empty body, which
+			// mustn't be rejected with a 400.
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies/"+tt.id+"/restore", nil)
+			r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey,
+				httprouter.Params{{Key: "id", Value: tt.id}}))
+
+			status, _, body := execute(t, http.HandlerFunc(app.restoreMovieHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			if tt.wantStatus == http.StatusOK {
+				assert.JSONField(t, []byte(body), "movie.id", 7)
+			}
+		})
+	}
+}
+
+func TestCountMoviesHandler(t *testing.T) {
+	// Answer the count query with 3, recording the title filter it was given.
+	var gotTitle any
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			gotTitle = args[0].Value
+			return []string{"count"}, [][]driver.Value{{int64(3)}}
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies/count?title=moana&genres=animation", nil)
+
+	status, _, body := execute(t, http.HandlerFunc(app.countMoviesHandler), r)
+
+	assert.Status(t, status, http.StatusOK)
+	assert.JSONField(t, []byte(body), "count", 3)
+	assert.Equal(t, gotTitle, any("moana"))
+}
+
+func TestCountMoviesHandlerMatchesListing(t *testing.T) {
+	// Record the query and arguments of each statement, and answer the count query with
+	// 2 and the list query with no movies.
+	var queries []string
+	var arguments [][]driver.NamedValue
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			queries = append(queries, query)
+			arguments = append(arguments, args)
+			if strings.Contains(query, "count(*) OVER()") {
+				return []string{"count", "id", "created_at", "title", "year", "runtime", "genres", "featured",
+					"tags", "updated_at", "version"}, nil
+			}
+			return []string{"count"}, [][]driver.Value{{int64(2)}}
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	filters := "title=moana&genres=animation,adventure&genres_match=any&year_from=2010&year_to=2020&tag=studio:disney&created_after=2015-01-01"
+
+	status, _, body := execute(t, http.HandlerFunc(app.countMoviesHandler),
+		httptest.NewRequest(http.MethodGet, "/v1/movies/count?"+filters, nil))
+	assert.Status(t, status, http.StatusOK)
+	assert.JSONField(t, []byte(body), "count", 2)
+
+	status, _, _ = execute(t, http.HandlerFunc(app.listMoviesHandler),
+		httptest.NewRequest(http.MethodGet, "/v1/movies?page=2&sort=-year&"+filters, nil))
+	assert.Status(t, status, http.StatusOK)
+
+	if len(queries) != 2 {
+		t.Fatalf("got %d queries; want 2", len(queries))
+	}
+
+	// The WHERE clauses are the same, up to the ORDER BY which only the listing has.
+	where := func(query string) string {
+		query = query[strings.Index(query, "WHERE"):]
+		if i := strings.Index(query, "ORDER BY"); i >= 0 {
+			query = query[:i]
+		}
+		return strings.Join(strings.Fields(query), " ")
+	}
+	assert.Equal(t, where(queries[0]), where(queries[1]))
+	if !strings.Contains(queries[0], "genres && $2") {
+		t.Errorf("got count query %q; want it to match any of the genres", queries[0])
+	}
+
+	// So are the arguments for it, which the listing follows with the LIMIT and OFFSET.
+	assert.Equal(t, len(arguments[0]), 6)
+	assert.Equal(t, arguments[1][:6], arguments[0])
+}
+
+func TestListMoviesHandlerGenresMatch(t *testing.T) {
+	// Record the query, and answer it with no movies.
+	var gotQuery string
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			gotQuery = query
+			return []string{"count", "id", "created_at", "title", "year", "runtime", "genres", "featured",
+				"tags", "updated_at", "version"}, nil
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantOp     string
+	}{
+		{name: "Default", query: "genres=action,thriller", wantStatus: http.StatusOK, wantOp: "genres @> $2"},
+		{name: "All", query: "genres=action,thriller&genres_match=all", wantStatus: http.StatusOK, wantOp: "genres @> $2"},
+		{name: "Any", query: "genres=action,thriller&genres_match=any", wantStatus: http.StatusOK, wantOp: "genres && $2"},
+		{name: "Invalid", query: "genres=action&genres_match=some", wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotQuery = ""
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies?"+tt.query, nil)
+
+			status, _, body := execute(t, http.HandlerFunc(app.listMoviesHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			if tt.wantStatus != http.StatusOK {
+				assert.JSONField(t, []byte(body), "error.genres_match", "must be either all or any")
+				return
+			}
+			if !strings.Contains(gotQuery, tt.wantOp) {
+				t.Errorf("got query %q; want it to contain %q", gotQuery, tt.wantOp)
+			}
+		})
+	}
+}
+
+func TestListMoviesHandlerCreatedAfter(t *testing.T) {
+	// Record the created_after argument, and answer the query with no movies.
+	var gotArg driver.Value
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			gotArg = args[5].Value
+			return []string{"count", "id", "created_at", "title", "year", "runtime", "genres", "featured",
+				"tags", "updated_at", "version"}, nil
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantArg    driver.Value
+	}{
+		{name: "Absent", query: "", wantStatus: http.StatusOK, wantArg: nil},
+		{name: "Date", query: "created_after=2024-03-15", wantStatus: http.StatusOK,
+			wantArg: time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{name: "Invalid", query: "created_after=15/03/2024", wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotArg = nil
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies?"+tt.query, nil)
+
+			status, _, body := execute(t, http.HandlerFunc(app.listMoviesHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			if tt.wantStatus != http.StatusOK {
+				assert.JSONField(t, []byte(body), "error.created_after", "must be a valid date")
+				return
+			}
+			assert.Equal(t, gotArg, tt.wantArg)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promLatencyBuckets are the upper bounds, in seconds, of the request latency histogram
+// buckets.
+var promLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// promMethods are the request methods which get their own method label value. Any other
+// method is counted as "OTHER".
+var promMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// promSeries identifies a set of requests by their labels. The route is the logical
+// endpoint name given to app.endpoint(), not the raw URL path, so that the number of
+// series stays small no matter which IDs clients request.
+type promSeries struct {
+	method string
+	route  string
+	status int
+}
+
+// promHistogram holds the cumulative counts for each of promLatencyBuckets, along with
+// the total count and sum of the observed latencies.
+type promHistogram struct {
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// promCollector records the request count and latency of every request, and writes
+// them in the Prometheus text exposition format.
+type promCollector struct {
+	mu        sync.Mutex
+	latencies map[promSeries]*promHistogram
+}
+
+func newPromCollector() *promCollector {
+	return &promCollector{latencies: make(map[promSeries]*promHistogram)}
+}
+
+// observe() records a request which took the given time to process.
+func (c *promCollector) observe(method, route string, status int, elapsed time.Duration) {
+	// Clients can send any method they like, so only the standard ones get their own
+	// label value.
+	if !slices.Contains(promMethods, method) {
+		method = "OTHER"
+	}
+
+	key := promSeries{method: method, route: route, status: status}
+	seconds := elapsed.Seconds()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.latencies[key]
+	if !ok {
+		h = &promHistogram{buckets: make([]int64, len(promLatencyBuckets))}
+		c.latencies[key] = h
+	}
+
+	for i, le := range promLatencyBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// write() writes the request count and latency histogram for every series, in a stable
+// order.
+func (c *promCollector) write(w *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]promSeries, 0, len(c.latencies))
+	for key := range c.latencies {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b promSeries) int {
+		if n := strings.Compare(a.route, b.route); n != 0 {
+			return n
+		}
+		if n := strings.Compare(a.method, b.method); n != 0 {
+			return n
+		}
+		return a.status - b.status
+	})
+
+	fmt.Fprintln(w, "# HELP greenlight_http_requests_total Total number of HTTP requests.")
+	fmt.Fprintln(w, "# TYPE greenlight_http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "greenlight_http_requests_total{%s} %d\n", key.labels(), c.latencies[key].count)
+	}
+
+	fmt.Fprintln(w, "# HELP greenlight_http_request_duration_seconds HTTP request latency in seconds.")
+	fmt.Fprintln(w, "# TYPE greenlight_http_request_duration_seconds histogram")
+	for _, key := range keys {
+		h := c.latencies[key]
+		for i, le := range promLatencyBuckets {
+			fmt.Fprintf(w, "greenlight_http_request_duration_seconds_bucket{%s,le=%q} %d\n",
+				key.labels(), strconv.FormatFloat(le, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "greenlight_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", key.labels(), h.count)
+		fmt.Fprintf(w, "greenlight_http_request_duration_seconds_sum{%s} %s\n", key.labels(), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "greenlight_http_request_duration_seconds_count{%s} %d\n", key.labels(), h.count)
+	}
+}
+
+// labels() formats the series labels for the exposition format. The label values come
+// from a fixed set, so they never need escaping.
+func (s promSeries) labels() string {
+	return fmt.Sprintf(`method=%q,route=%q,status="%d"`, s.method, s.route, s.status)
+}
+
+// The prometheusHandler() handler writes the metrics collected by the metrics() middleware in the
+// Prometheus text exposition format.
+
+func (app *application) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	app.prometheus.write(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
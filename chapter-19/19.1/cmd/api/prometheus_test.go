@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+)
+
+// promSampleRx matches a sample line in the Prometheus text exposition format, like
+// `name{label="value",...} 1.5`.
+var promSampleRx = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"]*"(,[a-zA-Z_][a-zA-Z0-9_]*="[^"]*")*\})? [-+]?([0-9.]+([eE][-+]?[0-9]+)?|Inf)$`)
+
+func TestPrometheusMetrics(t *testing.T) {
+	app := newTestApplication(t)
+	app.prometheus = newPromCollector()
+	app.models = data.NewModels(newReadyDB(t), data.DefaultTimeouts)
+
+	routes := app.routes()
+
+	execute(t, routes, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	execute(t, routes, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	execute(t, routes, httptest.NewRequest(http.MethodGet, "/no/such/path", nil))
+
+	status, headers, body := execute(t, routes, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Status(t, status, http.StatusOK)
+	assert.StringContains(t, headers.Get("Content-Type"), "text/plain")
+
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		if !promSampleRx.MatchString(line) {
+			t.Errorf("invalid sample line %q", line)
+		}
+	}
+
+	// Requests are labelled with the route name, and requests which didn't match a
+	// route share a single series rather than one per path.
+	assert.StringContains(t, body, `greenlight_http_requests_total{method="GET",route="readiness",status="200"} 2`)
+	assert.StringContains(t, body, `greenlight_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.StringContains(t, body, `greenlight_http_request_duration_seconds_count{method="GET",route="readiness",status="200"} 2`)
+}
+
+func TestPrometheusMetricsDisabled(t *testing.T) {
+	app := newTestApplication(t)
+
+	status, _, _ := execute(t, app.routes(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Status(t, status, http.StatusNotFound)
+}
+
+func TestPromCollectorOtherMethod(t *testing.T) {
+	c := newPromCollector()
+	c.observe("BREW", "movies:list", http.StatusMethodNotAllowed, 0)
+
+	var b strings.Builder
+	c.write(&b)
+
+	assert.StringContains(t, b.String(), `greenlight_http_requests_total{method="OTHER",route="movies:list",status="405"} 1`)
+}
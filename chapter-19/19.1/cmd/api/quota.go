@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// dailyQuota counts the number of operations performed by each user during the current
+// UTC day. The counts are held in memory and reset when the day rolls over, so they
+// are per-instance and don't survive a restart.
+
+type dailyQuota struct {
+	mu     sync.Mutex
+	limit  int
+	day    time.Time
+	counts map[int64]int
+}
+
+func newDailyQuota(limit int) *dailyQuota {
+	return &dailyQuota{
+		limit:  limit,
+		counts: make(map[int64]int),
+	}
+}
+
+// allow() records an operation for the user at the given time, and reports whether it
+// is within the quota. It also returns the time at which the quota next resets. A limit
+// of zero (or less) means the quota is unlimited.
+
+func (q *dailyQuota) allow(userID int64, now time.Time) (bool, time.Time) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	resetAt := today.Add(24 * time.Hour)
+
+	if q.limit <= 0 {
+		return true, resetAt
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// If the day has changed since the last operation, start counting afresh.
+	if !q.day.Equal(today) {
+		q.day = today
+		q.counts = make(map[int64]int)
+	}
+
+	if q.counts[userID] >= q.limit {
+		return false, resetAt
+	}
+
+	q.counts[userID]++
+	return true, resetAt
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterStore decides whether the client identified by key may make another
+// request. The rateLimit() middleware consults it for every request. Blocked() reports
+// whether the client has nothing left, without using up any of its allowance. SetLimit()
+// changes the rate and burst for every client, including those the store already knows
+// about.
+type rateLimiterStore interface {
+	Allow(ctx context.Context, key string) (bool, error)
+	Blocked(ctx context.Context, key string) (bool, error)
+	SetLimit(rps float64, burst int)
+}
+
+// The newRateLimiterStore() method returns the store selected by the -limiter-backend
+// flag: a per-instance in-memory store, or a Redis store which is shared by every
+// instance using the same Redis server, so that limits hold across a cluster. The name
+// keeps the Redis keys of different stores apart, like "ratelimit" for requests and
+// "authfailures" for failed authentications.
+
+func (app *application) newRateLimiterStore(name string) rateLimiterStore {
+	if app.config.limiter.backend == "redis" {
+		client := newRedisClient(app.config.limiter.redis)
+		s := newRedisLimiterStore(client, app.config.limiter.rps, app.config.limiter.burst)
+		s.prefix = "greenlight:" + name + ":"
+		return s
+	}
+	return newMemoryLimiterStore(app.config.limiter.rps, app.config.limiter.burst)
+}
+
+// memoryLimiterStore holds a token bucket rate limiter for each client in memory.
+// Clients which haven't been seen for three minutes are removed once a minute.
+type memoryLimiterStore struct {
+	mu      sync.Mutex
+	rps     float64
+	burst   int
+	clients map[string]*memoryClient
+}
+
+type memoryClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newMemoryLimiterStore(rps float64, burst int) *memoryLimiterStore {
+	s := &memoryLimiterStore{
+		rps:     rps,
+		burst:   burst,
+		clients: make(map[string]*memoryClient),
+	}
+
+	// Launch a background goroutine which removes old entries from the clients map
+	// once every minute.
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			s.sweep(time.Now().Add(-3 * time.Minute))
+		}
+	}()
+
+	return s
+}
+
+func (s *memoryLimiterStore) Allow(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// If there isn't a limiter for the client yet, create one.
+	c, found := s.clients[key]
+	if !found {
+		c = &memoryClient{limiter: rate.NewLimiter(rate.Limit(s.rps), s.burst)}
+		s.clients[key] = c
+	}
+
+	c.lastSeen = time.Now()
+	return c.limiter.Allow(), nil
+}
+
+// Blocked() reports whether the client has no tokens left, without using one up.
+func (s *memoryLimiterStore) Blocked(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, found := s.clients[key]
+	return found && c.limiter.Tokens() < 1, nil
+}
+
+// SetLimit() changes the rate and burst for new clients, and updates the limiters of the
+// existing clients in place, rather than replacing them, so that they keep the tokens
+// they have left. The new rate applies from now on.
+func (s *memoryLimiterStore) SetLimit(rps float64, burst int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rps, s.burst = rps, burst
+
+	for _, c := range s.clients {
+		c.limiter.SetLimit(rate.Limit(rps))
+		c.limiter.SetBurst(burst)
+	}
+}
+
+// sweep() removes the clients which haven't been seen since the cutoff.
+func (s *memoryLimiterStore) sweep(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, c := range s.clients {
+		if c.lastSeen.Before(cutoff) {
+			delete(s.clients, key)
+		}
+	}
+}
+
+// redisScripter runs a Lua script on a Redis server, returning its result.
+type redisScripter interface {
+	Eval(ctx context.Context, script string, keys []string, args ...string) (any, error)
+}
+
+// tokenBucketScript implements a token bucket in Redis. The bucket for KEYS[1] is a hash
+// holding the number of tokens left and the time (in milliseconds) it was last updated.
+// It refills at ARGV[1] tokens per second up to ARGV[2] tokens. If a token is available
+// the script takes ARGV[4] tokens, which is 1, or 0 to only check, and returns 1.
+// Otherwise it returns 0. The key expires once the bucket would be full again, so idle
+// clients don't use any memory.
+const tokenBucketScript = `
+local rps = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rps / 1000)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - cost
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rps * 1000) + 1000)
+
+return allowed
+`
+
+// redisLimiterStore keeps each client's token bucket in Redis. The rate and burst are
+// passed to the script on every call, so changing them applies to existing buckets too.
+type redisLimiterStore struct {
+	client redisScripter
+	prefix string
+
+	mu    sync.RWMutex
+	rps   float64
+	burst int
+}
+
+func newRedisLimiterStore(client redisScripter, rps float64, burst int) *redisLimiterStore {
+	return &redisLimiterStore{client: client, rps: rps, burst: burst, prefix: "greenlight:ratelimit:"}
+}
+
+func (s *redisLimiterStore) Allow(ctx context.Context, key string) (bool, error) {
+	return s.eval(ctx, key, 1)
+}
+
+func (s *redisLimiterStore) Blocked(ctx context.Context, key string) (bool, error) {
+	allowed, err := s.eval(ctx, key, 0)
+	if err != nil {
+		return false, err
+	}
+	return !allowed, nil
+}
+
+// eval() runs the token bucket script for the client, taking cost tokens if one is
+// available, and reports whether one was.
+func (s *redisLimiterStore) eval(ctx context.Context, key string, cost int) (bool, error) {
+	s.mu.RLock()
+	args := []string{
+		strconv.FormatFloat(s.rps, 'f', -1, 64),
+		strconv.Itoa(s.burst),
+		strconv.FormatInt(time.Now().UnixMilli(), 10),
+		strconv.Itoa(cost),
+	}
+	s.mu.RUnlock()
+
+	result, err := s.client.Eval(ctx, tokenBucketScript, []string{s.prefix + key}, args...)
+	if err != nil {
+		return false, err
+	}
+
+	allowed, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("redis: unexpected rate limit script result %v", result)
+	}
+	return allowed == 1, nil
+}
+
+func (s *redisLimiterStore) SetLimit(rps float64, burst int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rps, s.burst = rps, burst
+}
+
+// The readLimiterFile() function reads rate limiter settings from a file, one
+// name=value pair per line, where the names are rps and burst. Either can be left out,
+// in which case the given default is returned for it. Blank lines and lines starting
+// with # are ignored.
+
+func readLimiterFile(path string, rps float64, burst int) (float64, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, value, _ := strings.Cut(text, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+		switch name {
+		case "rps":
+			rps, err = strconv.ParseFloat(value, 64)
+			if err != nil || rps <= 0 {
+				return 0, 0, fmt.Errorf("%s:%d: rps must be a positive number", path, line)
+			}
+		case "burst":
+			burst, err = strconv.Atoi(value)
+			if err != nil || burst < 1 {
+				return 0, 0, fmt.Errorf("%s:%d: burst must be a positive integer", path, line)
+			}
+		default:
+			return 0, 0, fmt.Errorf("%s:%d: unknown rate limiter setting %q", path, line, name)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return rps, burst, nil
+}
+
+// The loadLimiterSettings() method works out the rate limiter rps and burst from the
+// -limiter-rps and -limiter-burst flags, overridden by the limiter file if there is one.
+
+func (app *application) loadLimiterSettings() (float64, int, error) {
+	rps, burst := app.config.limiter.rps, app.config.limiter.burst
+	if app.config.limiter.file == "" {
+		return rps, burst, nil
+	}
+	return readLimiterFile(app.config.limiter.file, rps, burst)
+}
+
+// The reloadLimiter() method re-reads the limiter file and applies the settings to the
+// rate limiter store and the failed authentication store. Clients keep their current
+// limiters, so the tokens they have left carry over, but the new rate applies straight
+// away. If the file can't be read, the current settings are left as they are. It is
+// called when the process receives a SIGHUP signal.
+
+func (app *application) reloadLimiter() {
+	if app.config.limiter.file == "" || app.limiterStore == nil {
+		return
+	}
+
+	rps, burst, err := app.loadLimiterSettings()
+	if err != nil {
+		app.logger.Error("failed to reload rate limiter settings", "error", err.Error())
+		return
+	}
+
+	app.limiterStore.SetLimit(rps, burst)
+	if app.authFailures != nil {
+		app.authFailures.SetLimit(rps, burst)
+	}
+	app.logger.Info("reloaded rate limiter settings", "rps", rps, "burst", burst)
+}
+
+// redisOptions holds the connection settings from a Redis DSN.
+type redisOptions struct {
+	addr     string
+	username string
+	password string
+	db       int
+}
+
+// The parseRedisDSN() function parses a DSN in the form
+// redis://[[username]:password@]host[:port][/db]. The port defaults to 6379 and the
+// database to 0.
+
+func parseRedisDSN(dsn string) (redisOptions, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return redisOptions{}, fmt.Errorf("invalid Redis DSN: %w", err)
+	}
+	if u.Scheme != "redis" || u.Hostname() == "" {
+		return redisOptions{}, fmt.Errorf("invalid Redis DSN %q: must be in the form redis://host:port/db", dsn)
+	}
+
+	opts := redisOptions{addr: u.Host}
+	if u.Port() == "" {
+		opts.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if u.User != nil {
+		opts.username = u.User.Username()
+		opts.password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		opts.db, err = strconv.Atoi(db)
+		if err != nil || opts.db < 0 {
+			return redisOptions{}, fmt.Errorf("invalid Redis DSN %q: database must be a non-negative integer", dsn)
+		}
+	}
+
+	return opts, nil
+}
+
+// The default settings for the Redis client used by the rate limiter. At most
+// redisMaxIdleConns connections are kept open between commands, and after a failed dial
+// Redis is skipped for redisDialCooldown.
+const (
+	redisMaxIdleConns = 10
+	redisDialCooldown = 5 * time.Second
+)
+
+// errRedisUnavailable is returned by redisClient.Eval() during the cool-down after a
+// failed dial, without trying to connect.
+var errRedisUnavailable = errors.New("redis: unavailable after a failed connection attempt")
+
+// redisClient is a minimal Redis client which can run EVAL, speaking the RESP protocol
+// directly. Each command takes an idle connection from a small pool, or dials a new one
+// if there are none, so concurrent commands don't wait for each other. Up to maxIdle
+// connections are returned to the pool afterwards, and a connection is dropped after
+// any error other than a Redis error reply. New connections are authenticated and
+// switched to the configured database before use.
+//
+// If dialing fails, the client doesn't try again until the cool-down has passed, and
+// returns errRedisUnavailable straight away instead, so that while Redis is down
+// requests aren't held up waiting for dials to time out.
+type redisClient struct {
+	redisOptions
+	timeout  time.Duration
+	maxIdle  int
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	idle      []*redisConn
+	downUntil time.Time
+}
+
+// redisConn is a connection to the Redis server, with a buffered reader for replies.
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func newRedisClient(opts redisOptions) *redisClient {
+	return &redisClient{
+		redisOptions: opts,
+		timeout:      time.Second,
+		maxIdle:      redisMaxIdleConns,
+		cooldown:     redisDialCooldown,
+	}
+}
+
+func (c *redisClient) Eval(ctx context.Context, script string, keys []string, args ...string) (any, error) {
+	cmd := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	cmd = append(cmd, args...)
+
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setDeadline(ctx, conn)
+
+	reply, err := conn.do(cmd)
+
+	// A Redis error reply leaves the connection usable, but anything else means we
+	// can't be sure where we are in the stream, so drop it.
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		conn.Close()
+		return reply, err
+	}
+
+	c.put(conn)
+	return reply, err
+}
+
+// get() takes an idle connection from the pool, or dials a new one. During the
+// cool-down after a failed dial it returns errRedisUnavailable instead.
+func (c *redisClient) get(ctx context.Context) (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	if time.Now().Before(c.downUntil) {
+		c.mu.Unlock()
+		return nil, errRedisUnavailable
+	}
+	c.mu.Unlock()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		c.mu.Lock()
+		c.downUntil = time.Now().Add(c.cooldown)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// put() returns a connection to the pool, or closes it if the pool is full.
+func (c *redisClient) put(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.idle) >= c.maxIdle {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// dial() opens a new connection, authenticates it and selects the database, as needed.
+func (c *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{Timeout: c.timeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	conn := &redisConn{Conn: nc, rd: bufio.NewReader(nc)}
+
+	c.setDeadline(ctx, conn)
+
+	if c.password != "" {
+		cmd := []string{"AUTH", c.password}
+		if c.username != "" {
+			cmd = []string{"AUTH", c.username, c.password}
+		}
+		_, err := conn.do(cmd)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if c.db != 0 {
+		_, err := conn.do([]string{"SELECT", strconv.Itoa(c.db)})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// setDeadline() sets the connection deadline to the client timeout, or the context
+// deadline if that is sooner.
+func (c *redisClient) setDeadline(ctx context.Context, conn *redisConn) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+}
+
+func (conn *redisConn) do(cmd []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+	for _, arg := range cmd {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := conn.Write([]byte(b.String()))
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	return readRESP(conn.rd)
+}
+
+// redisError is an error reply from the Redis server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readRESP() reads a single RESP reply. Integers are returned as int64, simple and bulk
+// strings as string (or nil for a null bulk string), and arrays as []any.
+
+func readRESP(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(rd, buf)
+		if err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]any, n)
+		for i := range values {
+			values[i], err = readRESP(rd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
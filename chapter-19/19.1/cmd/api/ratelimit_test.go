@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/assert"
+)
+
+func TestMemoryLimiterStore(t *testing.T) {
+	s := newMemoryLimiterStore(0.001, 2)
+	ctx := context.Background()
+
+	// The first two requests use up the burst, and the third is refused.
+	for i, want := range []bool{true, true, false} {
+		allowed, err := s.Allow(ctx, "192.0.2.1")
+		assert.NilError(t, err)
+		if allowed != want {
+			t.Errorf("request %d: got allowed %t; want %t", i+1, allowed, want)
+		}
+	}
+
+	// Each client has its own limiter.
+	allowed, err := s.Allow(ctx, "192.0.2.2")
+	assert.NilError(t, err)
+	assert.Equal(t, allowed, true)
+
+	// Sweeping forgets clients which haven't been seen since the cutoff, so they start
+	// again with a full burst.
+	s.sweep(time.Now().Add(time.Second))
+	assert.Equal(t, len(s.clients), 0)
+
+	allowed, err = s.Allow(ctx, "192.0.2.1")
+	assert.NilError(t, err)
+	assert.Equal(t, allowed, true)
+}
+
+func TestMemoryLimiterStoreSetLimit(t *testing.T) {
+	s := newMemoryLimiterStore(0.001, 2)
+	ctx := context.Background()
+
+	// Use one of the client's two tokens.
+	allowed, err := s.Allow(ctx, "192.0.2.1")
+	assert.NilError(t, err)
+	assert.Equal(t, allowed, true)
+
+	// Changing the burst keeps the client's limiter, so it still has one token left
+	// rather than starting again with a full burst.
+	s.SetLimit(0.001, 3)
+	for i, want := range []bool{true, false} {
+		allowed, err := s.Allow(ctx, "192.0.2.1")
+		assert.NilError(t, err)
+		if allowed != want {
+			t.Errorf("request %d: got allowed %t; want %t", i+1, allowed, want)
+		}
+	}
+
+	// Raising the rate applies to the client straight away: at the old rate it would
+	// wait over 15 minutes for its next token, but now it only waits a few milliseconds.
+	s.SetLimit(1000, 3)
+	time.Sleep(5 * time.Millisecond)
+
+	allowed, err = s.Allow(ctx, "192.0.2.1")
+	assert.NilError(t, err)
+	assert.Equal(t, allowed, true)
+
+	// New clients get the new settings too.
+	assert.Equal(t, s.rps, 1000.0)
+	assert.Equal(t, s.burst, 3)
+}
+
+func TestReloadLimiter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limiter")
+
+	writeFile := func(contents string) {
+		t.Helper()
+		err := os.WriteFile(path, []byte(contents), 0o600)
+		assert.NilError(t, err)
+	}
+
+	app := newTestApplication(t)
+	app.config.limiter.rps = 2
+	app.config.limiter.burst = 4
+	app.config.limiter.file = path
+
+	m := &mockScripter{result: int64(1)}
+	app.limiterStore = newRedisLimiterStore(m, app.config.limiter.rps, app.config.limiter.burst)
+
+	// A setting left out of the file keeps the flag value.
+	writeFile("# Raised for the launch.\nrps=10\n")
+	app.reloadLimiter()
+
+	_, err := app.limiterStore.Allow(context.Background(), "192.0.2.1")
+	assert.NilError(t, err)
+	assert.Equal(t, m.args[0][:2], []string{"10", "4"})
+
+	// A bad file leaves the settings as they were.
+	writeFile("rps=fast\n")
+	app.reloadLimiter()
+
+	_, err = app.limiterStore.Allow(context.Background(), "192.0.2.1")
+	assert.NilError(t, err)
+	assert.Equal(t, m.args[1][:2], []string{"10", "4"})
+}
+
+func TestReadLimiterFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		contents  string
+		wantRPS   float64
+		wantBurst int
+		wantErr   bool
+	}{
+		{name: "Both", contents: "rps=0.5\nburst=10\n", wantRPS: 0.5, wantBurst: 10},
+		{name: "Defaults", contents: "# Nothing set\n\n", wantRPS: 2, wantBurst: 4},
+		{name: "Spaces", contents: " burst = 8 \n", wantRPS: 2, wantBurst: 8},
+		{name: "Zero rps", contents: "rps=0\n", wantErr: true},
+		{name: "Fractional burst", contents: "burst=1.5\n", wantErr: true},
+		{name: "Unknown setting", contents: "enabled=false\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "limiter")
+			err := os.WriteFile(path, []byte(tt.contents), 0o600)
+			assert.NilError(t, err)
+
+			rps, burst, err := readLimiterFile(path, 2, 4)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				assert.Equal(t, rps, tt.wantRPS)
+				assert.Equal(t, burst, tt.wantBurst)
+			}
+		})
+	}
+}
+
+// mockScripter is a redisScripter which records its calls and returns canned results.
+type mockScripter struct {
+	keys   [][]string
+	args   [][]string
+	result any
+	err    error
+}
+
+func (m *mockScripter) Eval(ctx context.Context, script string, keys []string, args ...string) (any, error) {
+	m.keys = append(m.keys, keys)
+	m.args = append(m.args, args)
+	return m.result, m.err
+}
+
+func TestRedisLimiterStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Allowed", func(t *testing.T) {
+		m := &mockScripter{result: int64(1)}
+		s := newRedisLimiterStore(m, 2.5, 4)
+
+		allowed, err := s.Allow(ctx, "192.0.2.1")
+		assert.NilError(t, err)
+		assert.Equal(t, allowed, true)
+
+		assert.Equal(t, m.keys, [][]string{{"greenlight:ratelimit:192.0.2.1"}})
+		assert.Equal(t, m.args[0][:2], []string{"2.5", "4"})
+		assert.Equal(t, m.args[0][3], "1")
+	})
+
+	t.Run("Blocked", func(t *testing.T) {
+		// Checking doesn't take a token, and a client with none left is blocked.
+		m := &mockScripter{result: int64(0)}
+		s := newRedisLimiterStore(m, 2, 4)
+
+		blocked, err := s.Blocked(ctx, "192.0.2.1")
+		assert.NilError(t, err)
+		assert.Equal(t, blocked, true)
+		assert.Equal(t, m.args[0][3], "0")
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		s := newRedisLimiterStore(&mockScripter{result: int64(0)}, 2, 4)
+
+		allowed, err := s.Allow(ctx, "192.0.2.1")
+		assert.NilError(t, err)
+		assert.Equal(t, allowed, false)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		unavailable := errors.New("connection refused")
+		s := newRedisLimiterStore(&mockScripter{err: unavailable}, 2, 4)
+
+		_, err := s.Allow(ctx, "192.0.2.1")
+		if !errors.Is(err, unavailable) {
+			t.Errorf("got error %v; want %v", err, unavailable)
+		}
+	})
+
+	t.Run("Unexpected result", func(t *testing.T) {
+		s := newRedisLimiterStore(&mockScripter{result: "OK"}, 2, 4)
+
+		_, err := s.Allow(ctx, "192.0.2.1")
+		if err == nil {
+			t.Error("got nil error; want an error")
+		}
+	})
+}
+
+func TestRedisClientEval(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+
+	// Run a fake Redis server which reads one command and replies with the integer 1.
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reply, err := readRESP(bufio.NewReader(conn))
+		if err != nil {
+			received <- nil
+			return
+		}
+
+		var cmd []string
+		for _, arg := range reply.([]any) {
+			cmd = append(cmd, arg.(string))
+		}
+		received <- cmd
+
+		io.WriteString(conn, ":1\r\n")
+	}()
+
+	c := newRedisClient(redisOptions{addr: l.Addr().String()})
+
+	result, err := c.Eval(context.Background(), "return 1", []string{"key"}, "arg")
+	assert.NilError(t, err)
+	assert.Equal(t, result, any(int64(1)))
+	assert.Equal(t, <-received, []string{"EVAL", "return 1", "1", "key", "arg"})
+}
+
+func TestRedisClientSetup(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+
+	// Run a fake Redis server which replies +OK to AUTH and SELECT, and :1 to anything
+	// else, recording the commands it receives.
+	received := make(chan []string, 3)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rd := bufio.NewReader(conn)
+		for range 3 {
+			reply, err := readRESP(rd)
+			if err != nil {
+				return
+			}
+
+			var cmd []string
+			for _, arg := range reply.([]any) {
+				cmd = append(cmd, arg.(string))
+			}
+			received <- cmd
+
+			if cmd[0] == "EVAL" {
+				io.WriteString(conn, ":1\r\n")
+			} else {
+				io.WriteString(conn, "+OK\r\n")
+			}
+		}
+	}()
+
+	opts, err := parseRedisDSN("redis://limiter:s3cret@" + l.Addr().String() + "/2")
+	assert.NilError(t, err)
+
+	c := newRedisClient(opts)
+
+	result, err := c.Eval(context.Background(), "return 1", []string{"key"})
+	assert.NilError(t, err)
+	assert.Equal(t, result, any(int64(1)))
+
+	assert.Equal(t, <-received, []string{"AUTH", "limiter", "s3cret"})
+	assert.Equal(t, <-received, []string{"SELECT", "2"})
+	assert.Equal(t, <-received, []string{"EVAL", "return 1", "1", "key"})
+}
+
+func TestRedisClientPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+
+	// Run a fake Redis server which replies :1 to every command, counting the
+	// connections it accepts.
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					_, err := readRESP(rd)
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, ":1\r\n")
+				}
+			}()
+		}
+	}()
+
+	c := newRedisClient(redisOptions{addr: l.Addr().String()})
+
+	// Commands run one after another share a pooled connection.
+	for range 3 {
+		_, err := c.Eval(context.Background(), "return 1", []string{"key"})
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, accepted.Load(), int32(1))
+
+	// Concurrent commands don't wait for each other, each using its own connection,
+	// and only maxIdle of them are kept afterwards.
+	c.maxIdle = 2
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := c.Eval(context.Background(), "return 1", []string{"key"})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if len(c.idle) > c.maxIdle {
+		t.Errorf("got %d idle connections; want at most %d", len(c.idle), c.maxIdle)
+	}
+}
+
+func TestRedisClientCooldown(t *testing.T) {
+	// Find an address with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	c := newRedisClient(redisOptions{addr: addr})
+	c.cooldown = 50 * time.Millisecond
+
+	// The first command fails to dial.
+	_, err = c.Eval(context.Background(), "return 1", nil)
+	if err == nil || errors.Is(err, errRedisUnavailable) {
+		t.Fatalf("got error %v; want a dial error", err)
+	}
+
+	// During the cool-down, commands fail straight away without dialing.
+	_, err = c.Eval(context.Background(), "return 1", nil)
+	if !errors.Is(err, errRedisUnavailable) {
+		t.Errorf("got error %v; want %v", err, errRedisUnavailable)
+	}
+
+	// Afterwards the client tries to dial again.
+	time.Sleep(60 * time.Millisecond)
+
+	_, err = c.Eval(context.Background(), "return 1", nil)
+	if err == nil || errors.Is(err, errRedisUnavailable) {
+		t.Errorf("got error %v; want a dial error", err)
+	}
+}
+
+func TestRateLimitStoreError(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.limiterStore = newRedisLimiterStore(&mockScripter{err: errRedisUnavailable}, 2, 4)
+
+	called := false
+	h := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	// If the store fails, the limiter fails open, and the request gets through.
+	status, _, _ := execute(t, h, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Status(t, status, http.StatusOK)
+	assert.Equal(t, called, true)
+}
+
+func TestParseRedisDSN(t *testing.T) {
+	tests := []struct {
+		dsn     string
+		want    redisOptions
+		wantErr bool
+	}{
+		{dsn: "redis://localhost:6379/0", want: redisOptions{addr: "localhost:6379"}},
+		{dsn: "redis://cache.internal", want: redisOptions{addr: "cache.internal:6379"}},
+		{dsn: "redis://:pa55word@10.0.0.5:6380/3", want: redisOptions{addr: "10.0.0.5:6380", password: "pa55word", db: 3}},
+		{dsn: "redis://user:pa55word@[::1]:6379", want: redisOptions{addr: "[::1]:6379", username: "user", password: "pa55word"}},
+		{dsn: "localhost:6379", wantErr: true},
+		{dsn: "http://localhost:6379", wantErr: true},
+		{dsn: "redis://localhost:6379/db", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dsn, func(t *testing.T) {
+			got, err := parseRedisDSN(tt.dsn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			assert.Equal(t, got, tt.want)
+		})
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    any
+		wantErr bool
+	}{
+		{name: "Integer", reply: ":42\r\n", want: int64(42)},
+		{name: "Simple string", reply: "+OK\r\n", want: "OK"},
+		{name: "Bulk string", reply: "$5\r\nhello\r\n", want: "hello"},
+		{name: "Null bulk string", reply: "$-1\r\n", want: nil},
+		{name: "Array", reply: "*2\r\n:1\r\n$1\r\na\r\n", want: []any{int64(1), "a"}},
+		{name: "Error", reply: "-ERR unknown command\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRESP(bufio.NewReader(strings.NewReader(tt.reply)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			assert.Equal(t, got, tt.want)
+		})
+	}
+}
@@ -1,10 +1,24 @@
 package main
 
 import (
+	"expvar"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 )
 
+// endpointNames lists the logical names given to the routes with app.endpoint(), which
+// can be used with the -disabled-endpoints flag.
+var endpointNames = []string{
+	"healthcheck", "readiness", "metrics", "docs", "openapi",
+	"movies:list", "movies:csv", "movies:create", "movies:batch", "movies:show", "movies:update", "movies:delete",
+	"movies:restore", "movies:cover", "movies:featured", "movies:count", "movies:duplicates",
+	"genres:canonical",
+	"admin:bulk-genre",
+	"users:register", "users:activate", "users:password", "users:export",
+	"tokens:authentication", "tokens:activation", "tokens:password-reset",
+	"debug:info", "debug:vars",
+}
+
 func (app *application) routes() http.Handler {
 	// Initialize a new httprouter router instance.
 
@@ -23,33 +37,167 @@ func (app *application) routes() http.Handler {
 
 	// Register the relevant Methods, URL patterns and handler functions for our endpoints using the HandlerFunc() method. Note that http.MethodGet and
 	// http.MethodPost are constants which equate to the strings "GET" and "POST" respectively.
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	// Each handler is wrapped with app.endpoint() to give the route a logical name,
+	// which the -disabled-endpoints flag refers to.
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck",
+		app.endpoint("healthcheck", app.healthcheckHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/movies",
-		app.requiredPermission("movies:read", app.listMoviesHandler))
+		app.endpoint("movies:list", app.publicReadPermission("movies:read", app.listMoviesHandler)))
+	// Add the route for the GET /v1/movies.csv endpoint, which exports the movies
+	// matching the same filters as GET /v1/movies as CSV.
+	router.HandlerFunc(http.MethodGet, "/v1/movies.csv",
+		app.endpoint("movies:csv", app.publicReadPermission("movies:read", app.listMoviesHandler)))
+	// Add the route for the POST /v1/movies endpoint. An accidental repeat of the request
+	// is rejected, if the -duplicate-request-window flag is set.
 	router.HandlerFunc(http.MethodPost, "/v1/movies",
-		app.requiredPermission("movies:write", app.createMovieHandler))
+		app.endpoint("movies:create", app.requiredPermission("movies:write", app.rejectDuplicateRequests(app.requireWriteQuota(app.createMovieHandler)))))
 	router.HandlerFunc(http.MethodGet, "/v1/movies/:id",
-		app.requiredPermission("movies:read", app.showMovieHandler))
+		app.endpoint("movies:show", app.requiredPermission("movies:read", app.showMovieHandler)))
 	/* // Add the route for the PUT /v1/movies/:id endpoint
 	router.HandlerFunc(http.MethodPut, "/v1/movies/:id", app.updateMovieHandler) */
 	// Require a PATCH request, rather than PUT
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id",
-		app.requiredPermission("movies:write", app.updateMovieHandler))
+		app.endpoint("movies:update", app.requiredPermission("movies:write", app.requireWriteQuota(app.updateMovieHandler))))
+	// Add the route for the PUT /v1/movies/:id/cover endpoint, which takes a
+	// multipart/form-data upload.
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/cover",
+		app.endpoint("movies:cover", app.requiredPermission("movies:write", app.requireWriteQuota(
+			app.requireContentType([]string{"multipart/form-data"}, app.uploadMovieCoverHandler)))))
 	// Add the route for the DELETE /vi/moives/:id endpoint.
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id",
-		app.requiredPermission("movies:write", app.deleteMovieHandler))
+		app.endpoint("movies:delete", app.requiredPermission("movies:write", app.requireWriteQuota(app.deleteMovieHandler))))
+	// Add the route for the POST /v1/movies/:id/restore endpoint, which undoes a delete.
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/restore",
+		app.endpoint("movies:restore", app.requiredPermission("movies:write", app.requireWriteQuota(app.restoreMovieHandler))))
 
 	/* // Add the routefor the GET /v1/movies endpoint
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMoviesHandler) */
 
+	// Add the route for the GET /v1/genres/canonical endpoint.
+	router.HandlerFunc(http.MethodGet, "/v1/genres/canonical",
+		app.endpoint("genres:canonical", app.requiredPermission("movies:read", app.listCanonicalGenresHandler)))
+
+	// Add the route for the POST /v1/admin/movies/bulk-genre endpoint. This changes many
+	// movies at once, so it requires the "admin:write" permission.
+	router.HandlerFunc(http.MethodPost, "/v1/admin/movies/bulk-genre",
+		app.endpoint("admin:bulk-genre", app.requiredPermission("admin:write", app.requireWriteQuota(app.bulkUpdateGenresHandler))))
+
 	// Add the route for the POST /v1/users endpoint
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users",
+		app.endpoint("users:register", app.registerUserHandler))
+
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated",
+		app.endpoint("users:activate", app.activateUserHandler))
 
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	// Add the route for the PUT /v1/users/password endpoint, which sets a new password
+	// using a password reset token.
+	router.HandlerFunc(http.MethodPut, "/v1/users/password",
+		app.endpoint("users:password", app.updateUserPasswordHandler))
+
+	// Add the route for the GET /v1/users/me/export endpoint.
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export",
+		app.endpoint("users:export", app.requireActivatedUser(app.exportUserHandler)))
 
 	// Add the route for the POST /v1/tokens/authentication
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication",
+		app.endpoint("tokens:authentication", app.createAuthenticationTokenHandler))
+
+	// Add the route for the POST /v1/tokens/activation endpoint, which resends the
+	// activation token to a user who hasn't activated their account.
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation",
+		app.endpoint("tokens:activation", app.createActivationTokenHandler))
+
+	// Add the route for the POST /v1/tokens/password-reset endpoint.
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset",
+		app.endpoint("tokens:password-reset", app.createPasswordResetTokenHandler))
+
+	// Add the route for the GET /v1/debug/info endpoint. This exposes process internals
+	// so it is restricted to users with the "admin:read" permission.
+	router.HandlerFunc(http.MethodGet, "/v1/debug/info",
+		app.endpoint("debug:info", app.requiredPermission("admin:read", app.debugInfoHandler)))
+
+	// Add the route for the GET /v1/debug/vars endpoint, which serves the expvar
+	// variables as JSON. Like /v1/debug/info it requires the "admin:read" permission.
+	router.HandlerFunc(http.MethodGet, "/v1/debug/vars",
+		app.endpoint("debug:vars", app.requiredPermission("admin:read", expvar.Handler().ServeHTTP)))
+
+	// httprouter doesn't allow fixed path segments to live alongside a wildcard in the
+	// same position, so routes like GET /v1/movies/featured can't be registered next to
+	// GET /v1/movies/:id. We register these on a http.ServeMux instead, which gives
+	// them precedence, and let it fall through to the router for everything else.
+	mux := http.NewServeMux()
+	mux.Handle("/", router)
+
+	// Add the route for the GET /v1/movies/featured endpoint.
+	mux.HandleFunc("GET /v1/movies/featured",
+		app.endpoint("movies:featured", app.requiredPermission("movies:read", app.listFeaturedMoviesHandler)))
+
+	// Add the route for the POST /v1/movies/batch endpoint, which creates several movies
+	// at once. It counts as a single write against the daily write quota. Like
+	// POST /v1/movies, an accidental repeat of the request is rejected, if the
+	// -duplicate-request-window flag is set.
+	mux.HandleFunc("POST /v1/movies/batch",
+		app.endpoint("movies:batch", app.requiredPermission("movies:write", app.rejectDuplicateRequests(app.requireWriteQuota(app.createMoviesBatchHandler)))))
+
+	// Add the route for the GET /v1/movies/count endpoint.
+	mux.HandleFunc("GET /v1/movies/count",
+		app.endpoint("movies:count", app.requiredPermission("movies:read", app.countMoviesHandler)))
+
+	// Add the route for the GET /v1/movies/duplicates endpoint. This is an editorial
+	// tool, so it requires the "movies:write" permission. It's experimental, so it can be
+	// turned off with the "movies-duplicates" feature flag.
+	mux.HandleFunc("GET /v1/movies/duplicates",
+		app.endpoint("movies:duplicates", app.requireFeature("movies-duplicates", app.requiredPermission("movies:write", app.listDuplicateMoviesHandler))))
+
+	// Add the route for the GET /readyz readiness probe. It's unversioned, as it's meant
+	// for load balancers rather than API clients.
+	mux.HandleFunc("GET /readyz", app.endpoint("readiness", app.readinessHandler))
+
+	// Add the route for the GET /metrics endpoint, if Prometheus metrics are enabled.
+	// Like /readyz it's unversioned and unauthenticated, as it's meant for scrapers.
+	if app.prometheus != nil {
+		mux.HandleFunc("GET /metrics", app.endpoint("metrics", app.prometheusHandler))
+	}
+
+	// Add the routes for the GET /docs API explorer and the GET /v1/openapi.json document
+	// it loads, if they are enabled. Both are public, as they only describe the API.
+	if app.config.docsEnabled {
+		mux.HandleFunc("GET /docs", app.endpoint("docs", app.docsHandler))
+		mux.HandleFunc("GET /v1/openapi.json", app.endpoint("openapi", app.openAPIHandler))
+	}
 
-	// Wrap the router with the panic recovery middleware.
-	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
+	// Wrap the router with the middleware chain, outermost first. The order matters:
+	//
+	//   - metrics comes first, so that it measures the full lifecycle of each request.
+	//   - logRequestContext stores the request-scoped logger which logRequest and the
+	//     error helpers use, so it must come before them.
+	//   - limitInFlight comes straight after the logging middleware, so that refused
+	//     requests are still counted and logged, but cost as little as possible.
+	//   - compress sits inside metrics and logRequest, so that they record the status
+	//     code it passes on, and outside recoverPanic, so that error responses for
+	//     panics are compressed and finished properly too.
+	//   - logBodies sits inside compress, so that it logs the uncompressed response, and
+	//     outside recoverPanic, so that it logs the error responses for panics.
+	//   - recoverPanic sits inside the logging and timing middleware, so that a panic is
+	//     still logged and timed as a 500 response.
+	//   - enableCORS must run before authenticate and rateLimit, so that preflight
+	//     requests and error responses carry the CORS headers.
+	//   - rateLimit runs after authenticate, so that authenticated users are limited
+	//     by their user ID rather than their IP address. Requests with a bad token
+	//     never get that far, so authenticate limits failed authentications by IP
+	//     address itself.
+	return composeMiddleware(mux,
+		app.metrics,
+		app.logRequestContext,
+		app.logRequest,
+		app.limitInFlight,
+		app.responseTime,
+		app.compress,
+		app.logBodies,
+		app.recoverPanic,
+		app.servedBy,
+		app.enableCORS,
+		app.authenticate,
+		app.rateLimit,
+	)
 }
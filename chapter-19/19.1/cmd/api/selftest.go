@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// requiredPermissionCodes lists the permission codes which the routes check for, and so
+// which must exist in the permissions table.
+var requiredPermissionCodes = []string{"movies:read", "movies:write", "admin:read", "admin:write"}
+
+// dependencyCheck is a named check that one of the application's dependencies is
+// usable. A nil error means the check passed.
+type dependencyCheck struct {
+	name  string
+	check func() error
+}
+
+// The dependencyChecks() method returns the checks run by -run-selftest: the readiness
+// checks, that the database has the required permissions, and that the SMTP server can
+// be reached.
+
+func (app *application) dependencyChecks() []dependencyCheck {
+	return append(app.readinessChecks(5*time.Second), []dependencyCheck{
+		{
+			name: "permissions",
+			check: func() error {
+				missing, err := app.models.Permissions.Missing(requiredPermissionCodes...)
+				if err != nil {
+					return err
+				}
+				if len(missing) > 0 {
+					return fmt.Errorf("missing permission codes: %s", strings.Join(missing, ", "))
+				}
+				return nil
+			},
+		},
+		{
+			name:  "mailer",
+			check: app.mailer.Verify,
+		},
+	}...)
+}
+
+// The runSelfTest() function runs every check, writing a PASS or FAIL line for each to
+// w followed by a summary, and returns true if they all passed. All checks are run even
+// after one fails, so that the report shows everything which needs fixing.
+
+func runSelfTest(w io.Writer, checks []dependencyCheck) bool {
+	failed := 0
+
+	for _, c := range checks {
+		err := c.check()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL  %s: %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(w, "PASS  %s\n", c.name)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(w, "self-test failed: %d of %d checks failed\n", failed, len(checks))
+		return false
+	}
+
+	fmt.Fprintf(w, "self-test passed: %d checks\n", len(checks))
+	return true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"greelight.techkunstler.com/internal/assert"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	pass := func() error { return nil }
+
+	t.Run("All pass", func(t *testing.T) {
+		var report strings.Builder
+
+		ok := runSelfTest(&report, []dependencyCheck{
+			{name: "database", check: pass},
+			{name: "mailer", check: pass},
+		})
+
+		assert.Equal(t, ok, true)
+		assert.StringContains(t, report.String(), "PASS  database\n")
+		assert.StringContains(t, report.String(), "self-test passed: 2 checks")
+	})
+
+	t.Run("Failing dependency", func(t *testing.T) {
+		var report strings.Builder
+		ran := false
+
+		ok := runSelfTest(&report, []dependencyCheck{
+			{name: "database", check: pass},
+			{name: "mailer", check: func() error { return errors.New("dial tcp: connection refused") }},
+			{name: "permissions", check: func() error { ran = true; return nil }},
+		})
+
+		assert.Equal(t, ok, false)
+		assert.StringContains(t, report.String(), "FAIL  mailer: dial tcp: connection refused\n")
+		assert.StringContains(t, report.String(), "self-test failed: 1 of 3 checks failed")
+
+		// Checks after the failing one still run.
+		assert.Equal(t, ran, true)
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -12,8 +13,27 @@ import (
 	"time"
 )
 
-func (app *application) server() error {
+// The tlsEnabled() method reports whether both a TLS certificate and key were given, in
+// which case the server uses HTTPS.
+
+func (app *application) tlsEnabled() bool {
+	return app.config.tls.certFile != "" && app.config.tls.keyFile != ""
+}
 
+// The tlsConfig() method returns the TLS settings for the server. The certificates are
+// loaded separately by ListenAndServeTLS().
+
+func (app *application) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: app.config.tls.minVersion,
+		// Advertise HTTP/2 ahead of HTTP/1.1 so that clients which support it use it.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
+
+// The newServer() method returns the configured http.Server for the application.
+
+func (app *application) newServer() *http.Server {
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
@@ -23,11 +43,75 @@ func (app *application) server() error {
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	// If the -disable-keep-alives flag is set, every response carries a
+	// "Connection: close" header so that clients don't reuse connections. This is
+	// useful when draining an instance.
+	if app.config.disableKeepAlives {
+		srv.SetKeepAlivesEnabled(false)
+	}
+
+	return srv
+}
+
+// The shutdown() method gracefully stops the server. The readiness endpoint starts
+// failing straight away, but if -shutdown-drain-delay is set requests continue to be
+// served for that long first, to give load balancers time to deregister the instance.
+// Once the server has stopped, it waits for the goroutines started by background() to
+// finish, so that emails being sent aren't lost when the process exits.
+
+func (app *application) shutdown(srv *http.Server) error {
+	app.draining.Store(true)
+
+	if delay := app.config.shutdownDrainDelay; delay > 0 {
+		app.logger.Info("draining connections", "addr", srv.Addr, "delay", delay.String())
+		time.Sleep(delay)
+	}
+
+	// Stop reusing connections, so that idle keep-alive connections are closed and
+	// in-flight requests finish with a "Connection: close" header.
+	srv.SetKeepAlivesEnabled(false)
+
+	app.logger.Info("shutting down server", "addr", srv.Addr)
+
+	// Create a context with a 30-second timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("completing background tasks", "addr", srv.Addr)
+
+	// Call Wait() to block until our WaitGroup counter is zero --- essentially
+	// blocking until the background goroutines have finished.
+	app.wg.Wait()
+
+	return nil
+}
+
+func (app *application) server() error {
+
+	srv := app.newServer()
+
 	// Create a shutdownError channel. We will use this to receive any
 	// errors returned by the graceful shutdown() function
 
 	shutdownError := make(chan error)
 
+	// Reload the feature flags and rate limiter settings whenever the process receives a
+	// SIGHUP signal.
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		for range hup {
+			app.reloadFeatures()
+			app.reloadLimiter()
+		}
+	}()
+
 	go func() {
 		// Creae a quit channel which carries os.Signal values.
 
@@ -45,40 +129,34 @@ func (app *application) server() error {
 		// include it in the log entry attributes.
 		app.logger.Info("caught signal", "signal", s.String())
 
-		// Create a context with a 30-second timeout.
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		// Call Shutdown() on our server, passing in the context we just made.
-		// Shutdown() will return nil if the graceful shutdown was successful, or
-		// an erro (which may happen because of a problem closing the listeners, or
-		// because the shutdown didn't complete before the 30-second context deadline is
-		// hit). We rely this return value to the shutdownError channel.
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			shutdownError <- err
-		}
-		app.logger.Info("completeing background tasks", "addr", srv.Addr)
-
-		// Call Wait() to block until our WaitGroup counter is zero --- essentially
-		// blocking until the background goroutines have finished. Then we return nil on
-		// the shutdownError channel, to indicate that the shutdown cometed without any issues.
-
-		app.wg.Wait()
-		shutdownError <- nil
+		// Drain the server, shut it down and wait for the background tasks. This will
+		// return nil if the graceful shutdown was successful, or an error (which may
+		// happen because of a problem closing the listeners, or because the shutdown
+		// didn't complete before the 30-second deadline is hit). We relay this return
+		// value to the shutdownError channel. Only one value is ever sent, as the
+		// receiver only reads once.
+		shutdownError <- app.shutdown(srv)
 
 		/* // Exit the application with a 0 (success) status code.
 		os.Exit(0) */
 	}()
 
-	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
-
-	// Calling Shutdown() on our server will cause ListenAndServe() to immediately
-	// return a http.ErrServerClosed error. So if we see this error, it is actually
-	// a good thing and an indication that the graceful shutdown is started. So we check
-	// specifically for this, only returing the error if it is NOT http.ErrServerClosed.
-
-	err := srv.ListenAndServe()
+	// Calling Shutdown() on our server will cause ListenAndServe() (or
+	// ListenAndServeTLS()) to immediately return a http.ErrServerClosed error. So if we
+	// see this error, it is actually a good thing and an indication that the graceful
+	// shutdown is started. So we check specifically for this, only returing the error if
+	// it is NOT http.ErrServerClosed.
+
+	var err error
+	if app.tlsEnabled() {
+		srv.TLSConfig = app.tlsConfig()
+
+		app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env, "tls", true)
+		err = srv.ListenAndServeTLS(app.config.tls.certFile, app.config.tls.keyFile)
+	} else {
+		app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
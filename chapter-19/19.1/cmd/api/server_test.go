@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+)
+
+func TestTLSMinVersion(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.tls.minVersion = tls.VersionTLS13
+
+	// httptest generates a self-signed certificate when starting a TLS server, and
+	// uses our TLS config for everything else.
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(app.healthcheckHandler))
+	ts.TLS = app.tlsConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	rs, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	if rs.TLS == nil || rs.TLS.Version < tls.VersionTLS13 {
+		t.Errorf("negotiated TLS version %x; want at least %x", rs.TLS.Version, tls.VersionTLS13)
+	}
+
+	// A client which only supports TLS 1.2 should be refused.
+	client := ts.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.MaxVersion = tls.VersionTLS12
+	client.Transport = transport
+
+	_, err = client.Get(ts.URL)
+	if err == nil {
+		t.Error("TLS 1.2 client connected to a server requiring TLS 1.3")
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{in: "1.2", want: tls.VersionTLS12},
+		{in: "1.3", want: tls.VersionTLS13},
+		{in: "1.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTLSVersion(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v; want error %t", tt.in, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %x; want %x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHTTP2Enabled(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.tls.minVersion = tls.VersionTLS12
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(app.healthcheckHandler))
+	ts.TLS = app.tlsConfig()
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	rs, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	if rs.ProtoMajor != 2 {
+		t.Errorf("got protocol %s; want HTTP/2", rs.Proto)
+	}
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.disableKeepAlives = true
+	app.models = data.NewModels(newReadyDB(t), data.DefaultTimeouts)
+
+	srv := app.newServer()
+
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config = srv
+	ts.Start()
+	defer ts.Close()
+
+	rs, err := ts.Client().Get(ts.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rs.StatusCode, http.StatusOK)
+	}
+	if !rs.Close {
+		t.Error(`response was not sent with "Connection: close"`)
+	}
+}
+
+func TestShutdownDrainDelay(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.shutdownDrainDelay = 300 * time.Millisecond
+	app.models = data.NewModels(newReadyDB(t), data.DefaultTimeouts)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /readyz", app.readinessHandler)
+	mux.HandleFunc("GET /v1/movies", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+
+	baseURL := "http://" + l.Addr().String()
+
+	get := func(path string) int {
+		t.Helper()
+
+		rs, err := http.Get(baseURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+		return rs.StatusCode
+	}
+
+	assert.Status(t, get("/readyz"), http.StatusOK)
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- app.shutdown(srv)
+	}()
+
+	for !app.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// During the drain window the instance reports itself as not ready, but still
+	// serves requests.
+	assert.Status(t, get("/readyz"), http.StatusServiceUnavailable)
+	assert.Status(t, get("/v1/movies"), http.StatusOK)
+
+	err = <-done
+	assert.NilError(t, err)
+
+	if elapsed := time.Since(start); elapsed < app.config.shutdownDrainDelay {
+		t.Errorf("shutdown took %s; want at least the %s drain delay", elapsed, app.config.shutdownDrainDelay)
+	}
+
+	_, err = http.Get(baseURL + "/v1/movies")
+	if err == nil {
+		t.Error("server still accepting connections after shutdown")
+	}
+}
+
+func TestShutdownWaitsForBackgroundTasks(t *testing.T) {
+	app := newTestApplication(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.NewServeMux()}
+	go srv.Serve(l)
+
+	release := make(chan struct{})
+	app.background(func() {
+		<-release
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.shutdown(srv)
+	}()
+
+	// shutdown() mustn't return while the background task is still running.
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the background task finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown didn't return after the background task finished")
+	}
+}
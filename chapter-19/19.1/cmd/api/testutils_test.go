@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/data"
+)
+
+// newTestApplication() returns an application instance suitable for unit testing
+// handlers and middleware which don't touch the database. The logger discards all
+// output.
+
+func newTestApplication(t *testing.T) *application {
+	var cfg config
+	cfg.env = "testing"
+	cfg.filters = data.DefaultFilterConfig
+	cfg.localeHeader = "Accept-Language"
+
+	return &application{
+		config:     cfg,
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		startTime:  time.Now(),
+		writeQuota: newDailyQuota(0),
+	}
+}
+
+// newReadyDB() returns a fake database which answers pings, and reports the current
+// schema version, so that the readiness checks pass.
+
+func newReadyDB(t *testing.T) *sql.DB {
+	db := sql.OpenDB(rowsConnector{
+		columns: []string{"version", "dirty"},
+		rows:    [][]driver.Value{{int64(data.SchemaVersion), false}},
+	})
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// execute() sends the request through the given handler using a httptest.ResponseRecorder
+// and returns the recorded response status code, headers and trimmed body.
+
+func execute(t *testing.T, h http.Handler, r *http.Request) (int, http.Header, string) {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	rs := rr.Result()
+	defer rs.Body.Close()
+
+	body, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = bytes.TrimSpace(body)
+
+	return rs.StatusCode, rs.Header, string(body)
+}
+
+// decodeJSON() unmarshals a JSON response body into an envelope-like map, failing the
+// test if the body isn't valid JSON.
+
+func decodeJSON(t *testing.T, body string) map[string]any {
+	t.Helper()
+
+	var js map[string]any
+	err := json.Unmarshal([]byte(body), &js)
+	if err != nil {
+		t.Fatalf("invalid JSON response %q: %v", body, err)
+	}
+	return js
+}
+
+// rowsConnector is a database/sql connector, and driver, whose connections answer every
+// query with the same result set. Use it with sql.OpenDB() to test code which reads
+// query results without a real database. Statements run with Exec() report the number
+// of rows in the result set as the number of rows affected.
+type rowsConnector struct {
+	columns []string
+	rows    [][]driver.Value
+
+	// If query is set, it is called to answer each query instead, so that tests can
+	// vary the result by query and check the arguments.
+	query func(query string, args []driver.NamedValue) (columns []string, rows [][]driver.Value)
+}
+
+func (c rowsConnector) Connect(ctx context.Context) (driver.Conn, error) { return rowsConn{c}, nil }
+func (c rowsConnector) Driver() driver.Driver                            { return c }
+func (c rowsConnector) Open(name string) (driver.Conn, error)            { return rowsConn{c}, nil }
+
+type rowsConn struct{ c rowsConnector }
+
+func (c rowsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.c.query != nil {
+		columns, rows := c.c.query(query, args)
+		return &fakeRows{columns: columns, rows: rows}, nil
+	}
+	return &fakeRows{columns: c.c.columns, rows: c.c.rows}, nil
+}
+func (c rowsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	rows := c.c.rows
+	if c.c.query != nil {
+		_, rows = c.c.query(query, args)
+	}
+	return driver.RowsAffected(len(rows)), nil
+}
+func (c rowsConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c rowsConn) Close() error              { return nil }
+func (c rowsConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	i       int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"greelight.techkunstler.com/internal/data"
-	"greelight.techkunstler.com/internal/validator"
 	"net/http"
 	"time"
 )
@@ -22,13 +21,13 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// Validate the email and password provided by the client
 
-	v := validator.New()
+	v := app.newValidator(r)
 
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePasswordPlainText(v, input.Password)
 
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
@@ -72,9 +71,175 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	// Encoe the token to JSON and send it in the response along with a 201 created
-	// status code.
+	// status code. Tokens can't be fetched individually, so there is no Location.
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	app.writeCreated(w, r, "", envelope{"authentication_token": token})
+}
+
+// The createPasswordResetTokenHandler() handler generates a password reset token for an
+// activated user and emails it to them, for use with PUT /v1/users/password. The token
+// expires after 45 minutes.
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// Look up the user with the email address, sending a 422 response if there isn't
+	// one.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Only activated accounts can reset their password.
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// Reserve a background slot for the email before saving the token, so that a full
+	// queue doesn't leave behind a token which is never sent.
+	err = app.reserveBackground()
+	if err != nil {
+		app.serviceUnavailableResponse(w, r)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.releaseBackground()
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Capture the request-scoped logger so that any error sending the email can still
+	// be tied back to this request.
+	logger := app.requestLogger(r)
+
+	app.runBackground(func() {
+		data := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createActivationTokenHandler() handler sends a fresh activation token to a user
+// who hasn't activated their account yet, for example because they lost the welcome
+// email. Any activation tokens they already have are deleted first, so only the latest
+// one works. The response is the same 202 Accepted whether or not the email address is
+// registered or already activated, so that it can't be used to find out which addresses
+// have accounts.
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	// Unknown addresses and activated users get the same response as everyone else, but
+	// nothing is sent to them.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err != nil || user.Activated {
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Resending is a convenience which the client can simply retry, so rather than
+	// waiting for a free background slot the request is turned away if there isn't one.
+	// The slot is reserved before the user's tokens are replaced, so that a full queue
+	// leaves the token from their earlier email working.
+	err = app.tryReserveBackground()
+	if err != nil {
+		app.serviceUnavailableResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.releaseBackground()
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.releaseBackground()
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Capture the request-scoped logger so that any error sending the email can still
+	// be tied back to this request.
+	logger := app.requestLogger(r)
+
+	app.runBackground(func() {
+		data := map[string]any{
+			"activationToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
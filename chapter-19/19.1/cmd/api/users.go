@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"greelight.techkunstler.com/internal/data"
-	"greelight.techkunstler.com/internal/validator"
 )
 
 /* func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -115,10 +114,10 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// Validate the plaintext token provided by the client
 
-	v := validator.New()
+	v := app.newValidator(r)
 
 	if data.ValidateTokenPlainText(v, input.TokenPlaintext); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
@@ -132,7 +131,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddError("token", "invalid or expired activation token")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -178,6 +177,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
+		return
 	}
 
 	user := &data.User{
@@ -192,20 +192,33 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	v := validator.New()
+	v := app.newValidator(r)
 
-	if data.ValidateUser(v, user); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	data.ValidateUser(v, user)
+	data.ValidateRegistrationEmail(v, user.Email, app.config.blockedEmailDomains)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// Reserve a background slot for the welcome email before creating the user. If the
+	// queue is full the client can retry, whereas a user created without the email
+	// could never be activated, and retrying would fail with a duplicate email.
+	err = app.reserveBackground()
+	if err != nil {
+		app.serviceUnavailableResponse(w, r)
 		return
 	}
 
 	err = app.models.Users.Insert(user)
 
 	if err != nil {
+		app.releaseBackground()
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
 			v.AddError("email", "a user with this email address already exists")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -216,26 +229,32 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
 	if err != nil {
+		app.releaseBackground()
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
+		app.releaseBackground()
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
+	// Capture the request-scoped logger so that any error sending the email can still
+	// be tied back to this request.
+	logger := app.requestLogger(r)
+
+	app.runBackground(func() {
 		data := map[string]any{
 			"activationToken": token.Plaintext,
 			"userID":          user.ID,
 		}
 
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err := app.mailer.Send(user.Email, "user_welcome.tmpl", data)
 
 		if err != nil {
-			app.logger.Error(err.Error())
+			logger.Error(err.Error())
 		}
 	})
 
@@ -244,3 +263,75 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The updateUserPasswordHandler() handler sets a new password for the user who owns a
+// password reset token, and then deletes all of their password reset tokens so that none
+// of them can be used again.
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	data.ValidatePasswordPlainText(v, input.Password)
+	data.ValidateTokenPlainText(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// Retrieve the user who owns the token, letting the client know if the token isn't
+	// valid.
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Save the new password, checking for edit conflicts as in activateUserHandler().
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/assert"
+	"greelight.techkunstler.com/internal/data"
+)
+
+func TestRegisterUserHandlerRejectedBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		field      string
+		wantErr    string
+	}{
+		{
+			name:       "Badly-formed JSON",
+			body:       `{"name": "Alice",`,
+			wantStatus: http.StatusBadRequest,
+			field:      "error",
+			wantErr:    "body contains badly-formed JSON",
+		},
+		{
+			name:       "Invalid user",
+			body:       `{"name": "Alice", "email": "not-an-email", "password": "pa55word"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			field:      "error.email",
+			wantErr:    "must be a valid email address",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(tt.body))
+
+			// Neither request should get as far as the database, and the response must
+			// be a single JSON object.
+			status, _, body := execute(t, http.HandlerFunc(app.registerUserHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			assert.JSONField(t, []byte(body), tt.field, tt.wantErr)
+		})
+	}
+}
+
+func TestRegisterUserHandlerBackgroundSlot(t *testing.T) {
+	// Record the statements which are run. Inserting the user returns no row, so it
+	// fails.
+	var statements []string
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			statements = append(statements, strings.Fields(query)[0])
+			return []string{"id", "created_at", "version"}, nil
+		},
+	})
+	defer db.Close()
+
+	tests := []struct {
+		name           string
+		queueFull      bool
+		wantStatus     int
+		wantStatements []string
+	}{
+		{
+			// A full queue is found out before the user is created, so nothing is left
+			// behind which would stop the client from retrying.
+			name:       "Queue full",
+			queueFull:  true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			// The slot reserved for the welcome email is given back when the user can't
+			// be created.
+			name:           "Insert fails",
+			wantStatus:     http.StatusInternalServerError,
+			wantStatements: []string{"INSERT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements = nil
+
+			app := newTestApplication(t)
+			app.models = data.NewModels(db, data.DefaultTimeouts)
+			app.config.background.wait = 0
+			app.backgroundSlots = make(chan struct{}, 1)
+			if tt.queueFull {
+				app.backgroundSlots <- struct{}{}
+			}
+
+			body := `{"name": "Alice", "email": "alice@example.com", "password": "pa55word"}`
+			r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body))
+
+			status, _, _ := execute(t, http.HandlerFunc(app.registerUserHandler), r)
+
+			assert.Status(t, status, tt.wantStatus)
+			assert.Equal(t, statements, tt.wantStatements)
+			if !tt.queueFull {
+				assert.Equal(t, len(app.backgroundSlots), 0)
+			}
+		})
+	}
+}
+
+func TestActivateUserHandlerInvalidToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "Missing token", body: `{}`, wantErr: "must be provided"},
+		{name: "Short token", body: `{"token": "ABCDEFGHIJ"}`, wantErr: "must be 26 bytes long"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPut, "/v1/users/activated", strings.NewReader(tt.body))
+
+			// The token is rejected before the database is queried.
+			status, _, body := execute(t, http.HandlerFunc(app.activateUserHandler), r)
+
+			assert.Status(t, status, http.StatusUnprocessableEntity)
+			assert.JSONField(t, []byte(body), "error.token", tt.wantErr)
+		})
+	}
+}
+
+func TestCreatePasswordResetTokenHandler(t *testing.T) {
+	// Emulate an activated user, alice@example.com, and an inactive one,
+	// bob@example.com.
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			columns := []string{"id", "created_at", "name", "email", "password_hash", "activated", "version"}
+			switch args[0].Value {
+			case "alice@example.com":
+				return columns, [][]driver.Value{{int64(1), time.Now(), "Alice", "alice@example.com", []byte("hash"), true, int64(1)}}
+			case "bob@example.com":
+				return columns, [][]driver.Value{{int64(2), time.Now(), "Bob", "bob@example.com", []byte("hash"), false, int64(1)}}
+			}
+			return columns, nil
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "Invalid email", body: `{"email": "alice"}`, wantErr: "must be a valid email address"},
+		{name: "Unknown user", body: `{"email": "carol@example.com"}`, wantErr: "no matching email address found"},
+		{name: "Inactive user", body: `{"email": "bob@example.com"}`, wantErr: "user account must be activated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/tokens/password-reset", strings.NewReader(tt.body))
+
+			status, _, body := execute(t, http.HandlerFunc(app.createPasswordResetTokenHandler), r)
+
+			assert.Status(t, status, http.StatusUnprocessableEntity)
+			assert.JSONField(t, []byte(body), "error.email", tt.wantErr)
+		})
+	}
+}
+
+func TestUpdateUserPasswordHandler(t *testing.T) {
+	const validToken = "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
+	validHash := sha256.Sum256([]byte(validToken))
+
+	// Emulate a user with a password reset token, recording the new password hash and
+	// the scope of the tokens which are deleted.
+	var newHash []byte
+	var deletedScope driver.Value
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			switch {
+			case strings.Contains(query, "INNER JOIN tokens"):
+				if string(args[0].Value.([]byte)) != string(validHash[:]) || args[1].Value != data.ScopePasswordReset {
+					return []string{"id"}, nil
+				}
+				return []string{"id", "created_at", "name", "email", "password_hash", "activated", "version"},
+					[][]driver.Value{{int64(1), time.Now(), "Alice", "alice@example.com", []byte("old"), true, int64(1)}}
+			case strings.Contains(query, "UPDATE users"):
+				newHash = args[2].Value.([]byte)
+				return []string{"version"}, [][]driver.Value{{int64(2)}}
+			case strings.Contains(query, "DELETE FROM tokens"):
+				deletedScope = args[0].Value
+				return nil, [][]driver.Value{{}}
+			}
+			t.Errorf("unexpected query %q", query)
+			return nil, nil
+		},
+	})
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, data.DefaultTimeouts)
+
+	send := func(body string) (int, string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPut, "/v1/users/password", strings.NewReader(body))
+		status, _, resp := execute(t, http.HandlerFunc(app.updateUserPasswordHandler), r)
+		return status, resp
+	}
+
+	t.Run("Valid token", func(t *testing.T) {
+		status, body := send(`{"password": "n3wpa55word", "token": "` + validToken + `"}`)
+
+		assert.Status(t, status, http.StatusOK)
+		assert.JSONField(t, []byte(body), "message", "your password was successfully reset")
+
+		if len(newHash) == 0 || string(newHash) == "old" {
+			t.Errorf("got password hash %q; want a new hash", newHash)
+		}
+		assert.Equal(t, deletedScope, driver.Value(data.ScopePasswordReset))
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		status, body := send(`{"password": "n3wpa55word", "token": "ABCDEFGHIJKLMNOPQRSTUVWXYZ"}`)
+
+		assert.Status(t, status, http.StatusUnprocessableEntity)
+		assert.JSONField(t, []byte(body), "error.token", "invalid or expired password reset token")
+	})
+
+	t.Run("Short password", func(t *testing.T) {
+		status, body := send(`{"password": "pa55", "token": "` + validToken + `"}`)
+
+		assert.Status(t, status, http.StatusUnprocessableEntity)
+		assert.JSONField(t, []byte(body), "error.password", "must be atleast 8 bytes long")
+	})
+}
+
+func TestCreateActivationTokenHandler(t *testing.T) {
+	// Emulate an activated user, alice@example.com, and an inactive one,
+	// bob@example.com, recording the token statements which are run.
+	var statements []string
+	db := sql.OpenDB(rowsConnector{
+		query: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			switch {
+			case strings.Contains(query, "DELETE FROM tokens"):
+				statements = append(statements, fmt.Sprintf("delete %v", args[0].Value))
+				return nil, [][]driver.Value{{}}
+			case strings.Contains(query, "INSERT INTO tokens"):
+				statements = append(statements, fmt.Sprintf("insert %v", args[3].Value))
+				return nil, [][]driver.Value{{}}
+			}
+
+			columns := []string{"id", "created_at", "name", "email", "password_hash", "activated", "version"}
+			switch args[0].Value {
+			case "alice@example.com":
+				return columns, [][]driver.Value{{int64(1), time.Now(), "Alice", "alice@example.com", []byte("hash"), true, int64(1)}}
+			case "bob@example.com":
+				return columns, [][]driver.Value{{int64(2), time.Now(), "Bob", "bob@example.com", []byte("hash"), false, int64(1)}}
+			}
+			return columns, nil
+		},
+	})
+	defer db.Close()
+
+	tests := []struct {
+		name           string
+		body           string
+		queueFull      bool
+		wantStatus     int
+		wantErr        string
+		wantStatements []string
+	}{
+		{
+			name:           "Inactive user",
+			body:           `{"email": "bob@example.com"}`,
+			wantStatus:     http.StatusAccepted,
+			wantStatements: []string{"delete activation", "insert activation"},
+		},
+		{
+			// An unknown address gets the same response, but no token.
+			name:       "Unknown user",
+			body:       `{"email": "carol@example.com"}`,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			// Activated users aren't sent anything, but get the same response.
+			name:       "Activated user",
+			body:       `{"email": "alice@example.com"}`,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			// Resending sheds load rather than waiting when the background queue is full,
+			// without touching the user's existing tokens.
+			name:       "Queue full",
+			body:       `{"email": "bob@example.com"}`,
+			queueFull:  true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "Invalid email",
+			body:       `{"email": "bob"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErr:    "must be a valid email address",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements = nil
+
+			app := newTestApplication(t)
+			app.models = data.NewModels(db, data.DefaultTimeouts)
+			if tt.queueFull {
+				app.backgroundSlots = make(chan struct{}, 1)
+				app.backgroundSlots <- struct{}{}
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/tokens/activation", strings.NewReader(tt.body))
+
+			status, _, body := execute(t, http.HandlerFunc(app.createActivationTokenHandler), r)
+
+			// Wait for the email to be sent. The test application has no mail server, so
+			// sending fails, and the error is logged.
+			app.wg.Wait()
+
+			assert.Status(t, status, tt.wantStatus)
+			switch {
+			case tt.wantErr != "":
+				assert.JSONField(t, []byte(body), "error.email", tt.wantErr)
+			case tt.wantStatus == http.StatusAccepted:
+				assert.JSONField(t, []byte(body), "message", "an email will be sent to you containing activation instructions")
+			}
+			assert.Equal(t, statements, tt.wantStatements)
+		})
+	}
+}
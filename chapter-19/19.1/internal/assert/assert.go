@@ -0,0 +1,90 @@
+package assert
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Equal() uses reflect.DeepEqual() rather than ==, so that it also works for the
+// slices and maps used in the movie tests (like genres).
+
+func Equal[T any](t *testing.T, actual, expected T) {
+	t.Helper()
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got: %v; want: %v", actual, expected)
+	}
+}
+
+func StringContains(t *testing.T, actual, expectedSubstring string) {
+	t.Helper()
+
+	if !strings.Contains(actual, expectedSubstring) {
+		t.Errorf("got: %q; expected to contain: %q", actual, expectedSubstring)
+	}
+}
+
+func NilError(t *testing.T, actual error) {
+	t.Helper()
+
+	if actual != nil {
+		t.Errorf("got: %v; expected: nil", actual)
+	}
+}
+
+// Status() checks a response status code, failing the test straight away if it doesn't
+// match as the rest of the response is unlikely to be what the test expects.
+
+func Status(t *testing.T, actual, expected int) {
+	t.Helper()
+
+	if actual != expected {
+		t.Fatalf("got status: %d; want: %d", actual, expected)
+	}
+}
+
+// JSONField() checks the value of a field in a JSON response body. Nested fields are
+// addressed with a dotted key, like "error.title". The expected value is compared after
+// a round trip through encoding/json, so that, for example, an int matches the float64
+// which a JSON number decodes to.
+
+func JSONField(t *testing.T, body []byte, key string, expected any) {
+	t.Helper()
+
+	var actual any
+	err := json.Unmarshal(body, &actual)
+	if err != nil {
+		t.Fatalf("invalid JSON body %q: %v", body, err)
+	}
+
+	for _, part := range strings.Split(key, ".") {
+		obj, ok := actual.(map[string]any)
+		if !ok {
+			t.Errorf("JSON field %q not found in %s", key, body)
+			return
+		}
+
+		actual, ok = obj[part]
+		if !ok {
+			t.Errorf("JSON field %q not found in %s", key, body)
+			return
+		}
+	}
+
+	js, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want any
+	err = json.Unmarshal(js, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(actual, want) {
+		t.Errorf("got JSON field %q: %v; want: %v", key, actual, want)
+	}
+}
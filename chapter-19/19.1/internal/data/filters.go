@@ -1,57 +1,184 @@
 package data
 
 import (
+	"fmt"
 	"greelight.techkunstler.com/internal/validator"
 	"strings"
+	"time"
 )
 
-// Add a SortSafelist field to hold the supported sort values.
+// Add a SortSafelist field to hold the supported sort values. Sort may hold several
+// comma-separated terms, like "-year,title", to sort by more than one column. YearFrom
+// and YearTo restrict the results to an inclusive range of release years, with zero
+// meaning no bound. Tag restricts them to movies with a tag, given as "key:value".
+// GenresMatch says whether a movie must have all of the genres being filtered on, or
+// just any one of them; empty means all. CreatedAfter restricts them to movies created
+// at or after a time, with the zero time meaning no bound. The query struct tags give the
+// query string parameter names; CreatedAfter has none, as it is read with readDate().
 type Filters struct {
-	Page         int
-	PageSize     int
-	Sort         string
+	Page         int    `query:"page"`
+	PageSize     int    `query:"page_size"`
+	Sort         string `query:"sort"`
 	SortSafeList []string
+	YearFrom     int    `query:"year_from"`
+	YearTo       int    `query:"year_to"`
+	Tag          string `query:"tag"`
+	GenresMatch  string `query:"genres_match"`
+	CreatedAfter time.Time
 }
 
-// Define a new Metadata struct for holding the pagination metadata.
+// The values of Filters.GenresMatch.
+const (
+	GenresMatchAll = "all"
+	GenresMatchAny = "any"
+)
+
+// Define a new Metadata struct for holding the pagination metadata. None of the fields
+// use omitempty, so that the metadata always has the same shape, even when there are no
+// records.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int `json:"current_page" xml:"current_page"`
+	PageSize     int `json:"page_size" xml:"page_size"`
+	FirstPage    int `json:"first_page" xml:"first_page"`
+	LastPage     int `json:"last_page" xml:"last_page"`
+	TotalRecords int `json:"total_records" xml:"total_records"`
+}
+
+// FilterConfig holds the pagination limits for list endpoints. It is built from
+// command-line flags at startup, so that the defaults and the validation rules are
+// always in sync.
+type FilterConfig struct {
+	MaxPage         int
+	MaxPageSize     int
+	DefaultPageSize int
+}
+
+// DefaultFilterConfig holds the limits which are used if none are configured.
+var DefaultFilterConfig = FilterConfig{
+	MaxPage:         10_000_000,
+	MaxPageSize:     100,
+	DefaultPageSize: 20,
 }
 
-func ValidateFilters(v *validator.Validator, f Filters) {
+// Validate() checks the pagination and sort values in f against the configured limits.
+
+func (c FilterConfig) Validate(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
 
 	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be maximum of 10 million")
+	v.Check(f.Page <= c.MaxPage, "page", fmt.Sprintf("must be a maximum of %d", c.MaxPage))
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be maximum of 100")
+	v.Check(f.PageSize <= c.MaxPageSize, "page_size", fmt.Sprintf("must be a maximum of %d", c.MaxPageSize))
+
+	// Check that the year range, if given, isn't back to front.
+	v.Check(f.YearFrom >= 0, "year_from", "must not be negative")
+	v.Check(f.YearTo >= 0, "year_to", "must not be negative")
+	if f.YearFrom > 0 && f.YearTo > 0 {
+		v.Check(f.YearFrom <= f.YearTo, "year_to", "must not be before year_from")
+	}
+
+	// Check that the genres match mode, if given, is one we know.
+	if f.GenresMatch != "" {
+		v.Check(validator.PermittedValue(f.GenresMatch, GenresMatchAll, GenresMatchAny), "genres_match", "must be either all or any")
+	}
+
+	// Check that the tag filter, if given, has a key.
+	if f.Tag != "" {
+		key, _, found := strings.Cut(f.Tag, ":")
+		v.Check(found && key != "", "tag", "must be in the form key:value")
+	}
+
+	// Check that each sort term matches a value in the safelist, and that no column is
+	// sorted on more than once.
+	seen := make(map[string]bool)
+	for _, term := range f.SortTerms() {
+		if !validator.PermittedValue(term, f.SortSafeList...) {
+			v.AddError("sort", "invalid sort value")
+			return
+		}
 
-	// Check that the sort parameter matches a value in the safelist.
-	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+		column := strings.TrimPrefix(term, "-")
+		if seen[column] {
+			v.AddError("sort", "must not sort by the same column more than once")
+			return
+		}
+		seen[column] = true
+	}
 }
 
-func (f Filters) sortColumn() string {
+// SortTerms() splits the comma-separated Sort value into its individual terms, like
+// "-year" and "title". An empty term is kept, so that "year," fails validation.
+
+func (f Filters) SortTerms() []string {
+	terms := strings.Split(f.Sort, ",")
+	for i := range terms {
+		terms[i] = strings.TrimSpace(terms[i])
+	}
+	return terms
+}
+
+func (f Filters) sortColumn(term string) string {
 	for _, safeValue := range f.SortSafeList {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+		if term == safeValue {
+			return strings.TrimPrefix(term, "-")
 		}
 	}
-	panic("unsafe sort parameter: " + f.Sort)
+	panic("unsafe sort parameter: " + term)
 }
 
 // Return the sort direction ("ASC" OR "DESC") depening on the prefix character of the
-// sort field.
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
+// sort term.
+func (f Filters) sortDirection(term string) string {
+	if strings.HasPrefix(term, "-") {
 		return "DESC"
 	}
 	return "ASC"
 }
 
+// orderBy() returns the columns and directions for the ORDER BY clause, like
+// "year DESC, title ASC", one for each sort term.
+
+func (f Filters) orderBy() string {
+	terms := f.SortTerms()
+
+	clauses := make([]string, len(terms))
+	for i, term := range terms {
+		clauses[i] = f.sortColumn(term) + " " + f.sortDirection(term)
+	}
+	return strings.Join(clauses, ", ")
+}
+
+// genresOperator() returns the array operator which matches a movie's genres against
+// the genres filter: @> (contains) to match all of them, or && (overlaps) to match any.
+
+func (f Filters) genresOperator() string {
+	if f.GenresMatch == GenresMatchAny {
+		return "&&"
+	}
+	return "@>"
+}
+
+// tagFilter() returns the tag filter as a Tags map for a jsonb containment check. With no
+// filter it returns an empty map, which every movie's tags contain.
+
+func (f Filters) tagFilter() Tags {
+	key, value, found := strings.Cut(f.Tag, ":")
+	if !found {
+		return Tags{}
+	}
+	return Tags{key: value}
+}
+
+// createdAfter() returns the lower bound on the creation time for the query, or nil if
+// there isn't one.
+
+func (f Filters) createdAfter() any {
+	if f.CreatedAfter.IsZero() {
+		return nil
+	}
+	return f.CreatedAfter
+}
+
 func (f Filters) limit() int {
 	return f.PageSize
 }
@@ -70,8 +197,15 @@ func (f Filters) offset() int {
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 	if totalRecords == 0 {
-		// Note that we return an empty Metadata struct if there are no records.
-		return Metadata{}
+		// If there are no records we still report the requested page and page size, and
+		// treat the (empty) first page as the last page too.
+		return Metadata{
+			CurrentPage:  page,
+			PageSize:     pageSize,
+			FirstPage:    1,
+			LastPage:     1,
+			TotalRecords: 0,
+		}
 	}
 
 	return Metadata{
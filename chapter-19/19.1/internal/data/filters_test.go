@@ -0,0 +1,159 @@
+package data
+
+import (
+	"encoding/json"
+	"testing"
+
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestFilterConfigValidate(t *testing.T) {
+	c := FilterConfig{MaxPage: 50, MaxPageSize: 10, DefaultPageSize: 5}
+
+	tests := []struct {
+		name    string
+		filters Filters
+		wantErr map[string]string
+	}{
+		{
+			name:    "Within limits",
+			filters: Filters{Page: 50, PageSize: 10},
+		},
+		{
+			name:    "Page size over configured max",
+			filters: Filters{Page: 1, PageSize: 11},
+			wantErr: map[string]string{"page_size": "must be a maximum of 10"},
+		},
+		{
+			name:    "Page over configured max",
+			filters: Filters{Page: 51, PageSize: 5},
+			wantErr: map[string]string{"page": "must be a maximum of 50"},
+		},
+		{
+			name:    "Match any genre",
+			filters: Filters{Page: 1, PageSize: 5, GenresMatch: GenresMatchAny},
+		},
+		{
+			name:    "Unknown genres match",
+			filters: Filters{Page: 1, PageSize: 5, GenresMatch: "some"},
+			wantErr: map[string]string{"genres_match": "must be either all or any"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filters.Sort = "id"
+			tt.filters.SortSafeList = []string{"id"}
+
+			v := validator.New()
+			c.Validate(v, tt.filters)
+
+			if len(v.Errors) != len(tt.wantErr) {
+				t.Fatalf("got errors %v; want %v", v.Errors, tt.wantErr)
+			}
+			for key, msg := range tt.wantErr {
+				if v.Errors[key] != msg {
+					t.Errorf("got %s error %q; want %q", key, v.Errors[key], msg)
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateMetadataEmpty(t *testing.T) {
+	metadata := calculateMetadata(0, 3, 10)
+
+	js, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"current_page":3,"page_size":10,"first_page":1,"last_page":1,"total_records":0}`
+	if string(js) != want {
+		t.Errorf("got %s; want %s", js, want)
+	}
+}
+
+func TestCalculateMetadata(t *testing.T) {
+	got := calculateMetadata(12, 2, 5)
+	want := Metadata{CurrentPage: 2, PageSize: 5, FirstPage: 1, LastPage: 3, TotalRecords: 12}
+
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestFiltersMultiColumnSort(t *testing.T) {
+	safeList := []string{"id", "title", "year", "-id", "-title", "-year"}
+
+	t.Run("Order by", func(t *testing.T) {
+		f := Filters{Sort: "-year, title", SortSafeList: safeList}
+
+		if got, want := f.orderBy(), "year DESC, title ASC"; got != want {
+			t.Errorf("got %q; want %q", got, want)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		sort    string
+		wantErr string
+	}{
+		{name: "Single", sort: "-year"},
+		{name: "Two columns", sort: "-year,title"},
+		{name: "Invalid term", sort: "-year,rating", wantErr: "invalid sort value"},
+		{name: "Empty term", sort: "year,", wantErr: "invalid sort value"},
+		{name: "Repeated column", sort: "year,-year", wantErr: "must not sort by the same column more than once"},
+		{name: "Injection attempt", sort: "year; DROP TABLE movies", wantErr: "invalid sort value"},
+		{name: "Unlisted column", sort: "-password_hash", wantErr: "invalid sort value"},
+	}
+
+	c := DefaultFilterConfig
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			c.Validate(v, Filters{Page: 1, PageSize: 10, Sort: tt.sort, SortSafeList: safeList})
+
+			if got := v.Errors["sort"]; got != tt.wantErr {
+				t.Errorf("got sort error %q; want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFiltersValidateYearRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int
+		key      string
+		wantErr  string
+	}{
+		{name: "Unbounded"},
+		{name: "Range", from: 1990, to: 1999},
+		{name: "Single year", from: 1994, to: 1994},
+		{name: "From only", from: 1990},
+		{name: "To only", to: 1999},
+		{name: "Back to front", from: 1999, to: 1990, key: "year_to", wantErr: "must not be before year_from"},
+		{name: "Negative", from: -1, key: "year_from", wantErr: "must not be negative"},
+	}
+
+	c := DefaultFilterConfig
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			c.Validate(v, Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: []string{"id"}, YearFrom: tt.from, YearTo: tt.to})
+
+			if tt.wantErr == "" {
+				if !v.Valid() {
+					t.Errorf("got errors %v; want none", v.Errors)
+				}
+				return
+			}
+			if got := v.Errors[tt.key]; got != tt.wantErr {
+				t.Errorf("got %s error %q; want %q", tt.key, got, tt.wantErr)
+			}
+		})
+	}
+}
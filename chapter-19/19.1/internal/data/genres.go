@@ -0,0 +1,128 @@
+package data
+
+import (
+	_ "embed"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"greelight.techkunstler.com/internal/validator"
+)
+
+// genres.txt holds the canonical genre vocabulary, one lowercase genre per line in
+// alphabetical order.
+//
+//go:embed "genres.txt"
+var genresTxt string
+
+// CanonicalGenres is the list of genres which are accepted when strict genre validation
+// is enabled.
+var CanonicalGenres = strings.Fields(genresTxt)
+
+// MaxGenreBytes is the maximum length of a single genre. Genres can't contain a comma,
+// because the genres query string parameter uses one to separate them.
+const MaxGenreBytes = 50
+
+// AddTooManyGenresError() records that a movie has more than MaxGenres genres. It's used
+// by ValidateMovie(), and by handlers which stop decoding a genres array once it's too
+// long, so that the error is always reported the same way.
+
+func AddTooManyGenresError(v *validator.Validator) {
+	v.AddError("genres", fmt.Sprintf("must not contain more than %d genres", MaxGenres))
+}
+
+// ValidateGenres() checks that each genre is non-empty, valid UTF-8, no longer than
+// MaxGenreBytes and free of commas, adding any error under the given key.
+
+func ValidateGenres(v *validator.Validator, key string, genres []string) {
+	for _, genre := range genres {
+		v.Check(genre != "", key, "must not contain an empty genre")
+		v.Check(len(genre) <= MaxGenreBytes, key, fmt.Sprintf("must not contain a genre more than %d bytes long", MaxGenreBytes))
+		v.Check(utf8.ValidString(genre), key, "must be valid UTF-8")
+		v.Check(!strings.Contains(genre, ","), key, "must not contain a genre with a comma")
+	}
+}
+
+// ValidateCanonicalGenres() checks that every genre is in the canonical list. For each
+// unknown genre the error message suggests the closest canonical genres, if any are
+// similar enough.
+
+func ValidateCanonicalGenres(v *validator.Validator, genres []string) {
+	for _, genre := range genres {
+		if slices.Contains(CanonicalGenres, genre) {
+			continue
+		}
+
+		message := fmt.Sprintf("%q is not a known genre", genre)
+		if matches := closeGenres(genre); len(matches) > 0 {
+			message += fmt.Sprintf(", did you mean: %s?", strings.Join(matches, ", "))
+		}
+
+		// Only the first unknown genre is reported, as the validator keeps one message
+		// per key.
+		v.AddError("genres", message)
+		return
+	}
+}
+
+// NormalizeGenres() trims the whitespace from each genre and lowercases it, then removes
+// any duplicates, keeping the first occurrence. A nil slice is returned unchanged, so
+// that a missing genres field still fails validation.
+
+func NormalizeGenres(genres []string) []string {
+	if genres == nil {
+		return nil
+	}
+
+	normalized := make([]string, 0, len(genres))
+	for _, genre := range genres {
+		genre = strings.ToLower(strings.TrimSpace(genre))
+		if !slices.Contains(normalized, genre) {
+			normalized = append(normalized, genre)
+		}
+	}
+	return normalized
+}
+
+// closeGenres() returns the canonical genres which are within an edit distance of two
+// of the given genre, or which it is a prefix of.
+
+func closeGenres(genre string) []string {
+	genre = strings.ToLower(genre)
+
+	var matches []string
+	for _, canonical := range CanonicalGenres {
+		if levenshtein(genre, canonical) <= 2 || (len(genre) >= 3 && strings.HasPrefix(canonical, genre)) {
+			matches = append(matches, canonical)
+		}
+	}
+	return matches
+}
+
+// levenshtein() returns the number of single character insertions, deletions and
+// substitutions needed to turn a into b.
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestCanonicalGenres(t *testing.T) {
+	if len(CanonicalGenres) == 0 {
+		t.Fatal("canonical genre list is empty")
+	}
+	if !slices.IsSorted(CanonicalGenres) {
+		t.Errorf("canonical genres are not sorted: %v", CanonicalGenres)
+	}
+	if !slices.Contains(CanonicalGenres, "drama") {
+		t.Errorf("canonical genres %v don't include drama", CanonicalGenres)
+	}
+}
+
+func TestValidateGenres(t *testing.T) {
+	tests := []struct {
+		name    string
+		genres  []string
+		wantErr string
+	}{
+		{name: "Valid", genres: []string{"drama", "film-noir", strings.Repeat("a", MaxGenreBytes)}},
+		{name: "Empty", genres: []string{"drama", ""}, wantErr: "must not contain an empty genre"},
+		{name: "Too long", genres: []string{strings.Repeat("a", MaxGenreBytes+1)}, wantErr: "must not contain a genre more than 50 bytes long"},
+		{name: "Invalid UTF-8", genres: []string{"drama\xff"}, wantErr: "must be valid UTF-8"},
+		{name: "Comma", genres: []string{"drama,war"}, wantErr: "must not contain a genre with a comma"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateGenres(v, "genres", tt.genres)
+
+			if got := v.Errors["genres"]; got != tt.wantErr {
+				t.Errorf("got error %q; want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateCanonicalGenres(t *testing.T) {
+	tests := []struct {
+		name    string
+		genres  []string
+		wantErr string
+	}{
+		{
+			name:   "Canonical",
+			genres: []string{"drama", "sci-fi"},
+		},
+		{
+			name:    "Typo",
+			genres:  []string{"drama", "dramma"},
+			wantErr: `"dramma" is not a known genre, did you mean: drama?`,
+		},
+		{
+			name:    "Prefix",
+			genres:  []string{"docu"},
+			wantErr: `"docu" is not a known genre, did you mean: documentary?`,
+		},
+		{
+			name:    "No close match",
+			genres:  []string{"telenovela"},
+			wantErr: `"telenovela" is not a known genre`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateCanonicalGenres(v, tt.genres)
+
+			if got := v.Errors["genres"]; got != tt.wantErr {
+				t.Errorf("got error %q; want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeGenres(t *testing.T) {
+	tests := []struct {
+		name   string
+		genres []string
+		want   []string
+	}{
+		{name: "Nil", genres: nil, want: nil},
+		{name: "Unchanged", genres: []string{"drama", "war"}, want: []string{"drama", "war"}},
+		{name: "Duplicates", genres: []string{"drama", "war", "drama"}, want: []string{"drama", "war"}},
+		{name: "Case and whitespace", genres: []string{"Drama", " drama ", "WAR"}, want: []string{"drama", "war"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeGenres(tt.genres)
+			if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("got %#v; want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -10,9 +12,47 @@ import (
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
+	ErrNoDatabase     = errors.New("no database configured")
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// Timeouts holds the maximum time each kind of database operation may take. Read is
+// used for queries, Write for inserts, updates and deletes, and Bulk for operations
+// which touch many rows, like exports. A zero value means the default is used.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Bulk  time.Duration
+}
+
+// DefaultTimeouts holds the timeouts which are used if none are configured.
+var DefaultTimeouts = Timeouts{
+	Read:  3 * time.Second,
+	Write: 3 * time.Second,
+	Bulk:  30 * time.Second,
+}
+
+func (t Timeouts) read() time.Duration {
+	if t.Read <= 0 {
+		return DefaultTimeouts.Read
+	}
+	return t.Read
+}
+
+func (t Timeouts) write() time.Duration {
+	if t.Write <= 0 {
+		return DefaultTimeouts.Write
+	}
+	return t.Write
+}
+
+func (t Timeouts) bulk() time.Duration {
+	if t.Bulk <= 0 {
+		return DefaultTimeouts.Bulk
+	}
+	return t.Bulk
+}
+
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and Permission Model, as our build progresses.
 
@@ -20,17 +60,28 @@ type Models struct {
 	Movies      MovieModel
 	Users       UserModel
 	Tokens      TokenModel
-	Permissions PermissionMoel
+	Permissions PermissionModel
+	Schema      SchemaModel
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing the
 // initialized MovieModel
 
-func NewModels(db *sql.DB) Models {
+func NewModels(db *sql.DB, timeouts Timeouts) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionMoel{DB: db},
+		Movies:      MovieModel{DB: db, Timeouts: timeouts},
+		Users:       UserModel{DB: db, Timeouts: timeouts},
+		Tokens:      TokenModel{DB: db, Timeouts: timeouts},
+		Permissions: PermissionModel{DB: db, Timeouts: timeouts},
+		Schema:      SchemaModel{DB: db, Timeouts: timeouts},
+	}
+}
+
+// Ping() checks that the database can be reached, using the deadline in ctx.
+
+func (m Models) Ping(ctx context.Context) error {
+	if m.Movies.DB == nil {
+		return ErrNoDatabase
 	}
+	return m.Movies.DB.PingContext(ctx)
 }
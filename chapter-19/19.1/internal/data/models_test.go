@@ -0,0 +1,95 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsDefaults(t *testing.T) {
+	var zero Timeouts
+
+	if got := zero.read(); got != DefaultTimeouts.Read {
+		t.Errorf("got read timeout %s; want %s", got, DefaultTimeouts.Read)
+	}
+	if got := zero.write(); got != DefaultTimeouts.Write {
+		t.Errorf("got write timeout %s; want %s", got, DefaultTimeouts.Write)
+	}
+	if got := zero.bulk(); got != DefaultTimeouts.Bulk {
+		t.Errorf("got bulk timeout %s; want %s", got, DefaultTimeouts.Bulk)
+	}
+
+	custom := Timeouts{Read: time.Second, Write: 2 * time.Second, Bulk: time.Minute}
+	if custom.read() != time.Second || custom.write() != 2*time.Second || custom.bulk() != time.Minute {
+		t.Errorf("configured timeouts not used: %+v", custom)
+	}
+}
+
+func TestTimeoutsSlowQuery(t *testing.T) {
+	db := newTestDB(t)
+
+	timeouts := Timeouts{Read: 50 * time.Millisecond, Bulk: 5 * time.Second}
+
+	sleep := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		_, err := db.ExecContext(ctx, "SELECT pg_sleep(0.2)")
+		return err
+	}
+
+	// A 200ms query fits in the bulk timeout...
+	err := sleep(timeouts.bulk())
+	if err != nil {
+		t.Errorf("got error %v under the bulk timeout; want nil", err)
+	}
+
+	// ...but not in the read timeout.
+	err = sleep(timeouts.read())
+	if err == nil {
+		t.Error("got nil error exceeding the read timeout")
+	}
+}
+
+func TestModelErrorsWrapped(t *testing.T) {
+	// IDs less than 1 are rejected without touching the database, so no connection
+	// pool is needed here.
+	m := MovieModel{}
+
+	tests := []struct {
+		name    string
+		err     error
+		wantMsg string
+	}{
+		{
+			name: "Get",
+			err: func() error {
+				_, err := m.Get(0)
+				return err
+			}(),
+			wantMsg: "movies: get id=0: record not found",
+		},
+		{
+			name:    "Delete",
+			err:     m.Delete(-1),
+			wantMsg: "movies: delete id=-1: record not found",
+		},
+		{
+			name:    "Restore",
+			err:     m.Restore(0),
+			wantMsg: "movies: restore id=0: record not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, ErrRecordNotFound) {
+				t.Errorf("got error %v; want it to match ErrRecordNotFound", tt.err)
+			}
+			if tt.err == nil || tt.err.Error() != tt.wantMsg {
+				t.Errorf("got message %q; want %q", tt.err, tt.wantMsg)
+			}
+		})
+	}
+}
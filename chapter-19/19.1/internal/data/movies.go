@@ -5,26 +5,91 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"time"
+	"unicode/utf8"
 
 	"github.com/lib/pq"
 	"greelight.techkunstler.com/internal/validator"
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
+	ID        int64     `json:"id" xml:"id"`
+	CreatedAt time.Time `json:"-" xml:"-"`
+	Title     string    `json:"title" xml:"title"`
+	Year      int32     `json:"year,omitempty" xml:"year,omitempty"`
 	// Use the Runtime type instead of int32. Note that the omitempty directive will
 	// still work on this: if the Runtime field has the underlying value 0, then
 	// it will be considered empty and omited -- and the MarshalJSON() method we just mad
 	// won't be called at all.
-	Runtime Runtime  `json:"runttime,omitempty,string"`
-	Genres  []string `json:"genres,omitempty"`
-	Version int32    `json:"version"`
+	Runtime Runtime  `json:"runttime,omitempty,string" xml:"runtime,omitempty"`
+	Genres  []string `json:"genres,omitempty" xml:"genres>genre,omitempty"`
+	// Featured marks a movie which editors want to highlight. It is included in
+	// the featured listing returned by GetFeatured().
+	Featured bool `json:"featured" xml:"featured"`
+	// Tags holds free-form key/value metadata about the movie, beyond its genres.
+	Tags      Tags      `json:"tags,omitempty" xml:"tags,omitempty"`
+	UpdatedAt time.Time `json:"-" xml:"-"`
+	// Deleted is true if the movie has been soft-deleted, in which case DeletedAt holds
+	// the time it happened. Soft-deleted movies are only returned by
+	// GetIncludingDeleted(), so Deleted is false everywhere else.
+	Deleted   bool       `json:"deleted" xml:"deleted"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+	Version   int32      `json:"version" xml:"version"`
 }
 
+// MovieView selects which of a movie's fields are sent to a client.
+type MovieView int
+
+const (
+	// MovieViewFull includes every field.
+	MovieViewFull MovieView = iota
+	// MovieViewPublic includes only the ID, title and year, leaving out the version and
+	// other internal fields. It is used for anonymous users.
+	MovieViewPublic
+)
+
+// PublicMovie is the public view of a movie.
+type PublicMovie struct {
+	ID    int64  `json:"id" xml:"id"`
+	Title string `json:"title" xml:"title"`
+	Year  int32  `json:"year,omitempty" xml:"year,omitempty"`
+}
+
+// View() returns the value to encode as JSON for the movie in the given view: the movie
+// itself for the full view, or a PublicMovie for the public view.
+
+func (movie *Movie) View(view MovieView) any {
+	if view == MovieViewPublic {
+		return PublicMovie{ID: movie.ID, Title: movie.Title, Year: movie.Year}
+	}
+	return movie
+}
+
+// ViewMovies() is like View() but for a slice of movies.
+
+func ViewMovies(movies []*Movie, view MovieView) any {
+	if view != MovieViewPublic {
+		return movies
+	}
+
+	public := make([]PublicMovie, len(movies))
+	for i, movie := range movies {
+		public[i] = movie.View(view).(PublicMovie)
+	}
+	return public
+}
+
+// MaxTitleBytes is the maximum length of a movie title in bytes (not characters). The
+// movies_title_length_check constraint on the movies table enforces the same limit, so
+// if you change this you must add a migration changing the constraint to match.
+const MaxTitleBytes = 500
+
+// MaxGenres is the maximum number of genres a movie can have. The genres_length_check
+// constraint on the movies table enforces the same limit.
+const MaxGenres = 5
+
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 
 	// Use the Check() method to execute our validation checks. This will add
@@ -34,7 +99,11 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	// In the second, we "check that the lenght of the title is less than or equal to
 	// 500 bytes" and so on.
 	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.Check(len(movie.Title) <= MaxTitleBytes, "title", fmt.Sprintf("must not be more than %d bytes long", MaxTitleBytes))
+	// The limit is in bytes, so a title must be valid UTF-8 for its length to be
+	// meaningful. This also stops clients from sending a title which has been cut off
+	// part way through a multi-byte character to squeeze it under the limit.
+	v.Check(utf8.ValidString(movie.Title), "title", "must be valid UTF-8")
 
 	v.Check(movie.Year != 0, "year", "must be provided")
 	v.Check(movie.Year > 1888, "year", "must be greatethan 1888")
@@ -43,21 +112,142 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
 	v.Check(movie.Runtime > 0, "runtime", "must be positive integer")
 
-	v.Check(movie.Genres != nil, "geners", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "geners", "must contain at least one genre")
-	v.Check(len(movie.Genres) <= 5, "geners", "must not contain more than five genres")
+	v.Check(movie.Genres != nil, "genres", "must be provided")
+	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least one genre")
+	if len(movie.Genres) > MaxGenres {
+		AddTooManyGenresError(v)
+	}
 
 	// Note that we're using the Unique helper in the line below to check that all
 	// values in the input.Genres slice are unique.
 
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	ValidateGenres(v, "genres", movie.Genres)
+
+	ValidateTags(v, movie.Tags)
+}
 
+// MovieUpdate holds the changes to apply to a movie in a partial update. A nil field
+// means it wasn't provided and should be left as it is.
+type MovieUpdate struct {
+	Title    *string
+	Year     *int32
+	Runtime  *Runtime
+	Genres   []string
+	Featured *bool
+	Tags     Tags
+}
+
+// WithUpdates() returns a copy of the movie with the provided changes applied. The
+// original movie is never modified, so it is safe to validate the copy and throw it
+// away if the checks fail.
+
+func (movie Movie) WithUpdates(u MovieUpdate) *Movie {
+	// movie is already a copy, but the Genres slice still shares its backing array
+	// with the original, so clone it too.
+	movie.Genres = slices.Clone(movie.Genres)
+	movie.Tags = maps.Clone(movie.Tags)
+
+	if u.Title != nil {
+		movie.Title = *u.Title
+	}
+
+	if u.Year != nil {
+		movie.Year = *u.Year
+	}
+
+	if u.Runtime != nil {
+		movie.Runtime = *u.Runtime
+	}
+
+	if u.Genres != nil {
+		movie.Genres = slices.Clone(u.Genres)
+	}
+
+	if u.Featured != nil {
+		movie.Featured = *u.Featured
+	}
+
+	// The provided tags replace the existing ones rather than being merged with them,
+	// so a client can remove a tag by sending the others without it.
+	if u.Tags != nil {
+		movie.Tags = maps.Clone(u.Tags)
+		if len(movie.Tags) == 0 {
+			movie.Tags = nil
+		}
+	}
+
+	return &movie
+}
+
+// FieldChange holds the old and new values of a single field which was modified by an
+// update.
+type FieldChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// DiffMovies() compares two versions of the same movie and returns the client-facing
+// fields which differ, keyed by their JSON name. Fields which are the same in both
+// are not included, so an empty map means nothing changed.
+
+func DiffMovies(before, after *Movie) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+
+	if before.Title != after.Title {
+		changes["title"] = FieldChange{Old: before.Title, New: after.Title}
+	}
+	if before.Year != after.Year {
+		changes["year"] = FieldChange{Old: before.Year, New: after.Year}
+	}
+	if before.Runtime != after.Runtime {
+		changes["runtime"] = FieldChange{Old: before.Runtime, New: after.Runtime}
+	}
+	if !slices.Equal(before.Genres, after.Genres) {
+		changes["genres"] = FieldChange{Old: before.Genres, New: after.Genres}
+	}
+	if before.Featured != after.Featured {
+		changes["featured"] = FieldChange{Old: before.Featured, New: after.Featured}
+	}
+	if !maps.Equal(before.Tags, after.Tags) {
+		changes["tags"] = FieldChange{Old: before.Tags, New: after.Tags}
+	}
+
+	return changes
 }
 
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
 
 type MovieModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Timeouts Timeouts
+
+	// AccentInsensitive makes the title search ignore accents, so that "Amelie" matches
+	// "Amélie". It needs the unaccent extension, which migration 000014 installs.
+	AccentInsensitive bool
+
+	// SortGenres makes the movies read from the database have their genres in
+	// alphabetical order, whatever order they were stored in, so that clients see a
+	// stable order.
+	SortGenres bool
+}
+
+// sortGenres() sorts the movie's genres, if SortGenres is set.
+func (m MovieModel) sortGenres(movie *Movie) {
+	if m.SortGenres {
+		slices.Sort(movie.Genres)
+	}
+}
+
+// titleMatch() returns the WHERE condition which matches movie titles against the search
+// terms in $1, or every movie if $1 is empty. The accent-insensitive version can't use
+// the movies_title_idx index, because unaccent() isn't immutable.
+
+func (m MovieModel) titleMatch() string {
+	if m.AccentInsensitive {
+		return "(to_tsvector('simple', unaccent(title)) @@ plainto_tsquery('simple', unaccent($1)) OR $1 = '')"
+	}
+	return "(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')"
 }
 
 // The Insert method accepts a pointer to a movie struct, which should contain the data
@@ -66,45 +256,106 @@ func (m MovieModel) Insert(movie *Movie) error {
 	// Define the SQL query for inserting a new record in the movies table and returning
 	// the system-generated data..
 	query := `
-	INSERT INTO movies (title, year, runtime, genres)
-	VALUES ($1, $2, $3, $4)
-	RETURNING id, created_at, version`
+	INSERT INTO movies (title, year, runtime, genres, featured, tags)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at, updated_at, version`
 
 	// Create an args slice containing the values for the plaeholder parameters from
 	// the movie struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
 
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Featured, movie.Tags}
 
 	// Create a context with a 3-second timeout.
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
 	defer cancel()
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool,
 	// passing in the args slice as a variadic parameter and scanning the system-generated id, created_at and version values into the movie struct.
 
 	// return m.DB.QueryRow(query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt,
-		&movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt,
+		&movie.UpdatedAt, &movie.Version)
+	if err != nil {
+		return fmt.Errorf("movies: insert: %w", err)
+	}
+	return nil
+}
+
+// InsertBatch() inserts the movies in a single transaction, filling in their
+// system-generated fields like Insert() does. If any insert fails, the transaction is
+// rolled back and none of the movies are inserted.
+
+func (m MovieModel) InsertBatch(movies []*Movie) error {
+	query := `
+	INSERT INTO movies (title, year, runtime, genres, featured, tags)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at, updated_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.bulk())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("movies: insert batch: %w", err)
+	}
+
+	// Rolling back after a successful commit does nothing, so this only takes effect
+	// if we return early.
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("movies: insert batch: %w", err)
+	}
+	defer stmt.Close()
+
+	for i, movie := range movies {
+		args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Featured, movie.Tags}
+
+		err := stmt.QueryRowContext(ctx, args...).Scan(&movie.ID, &movie.CreatedAt,
+			&movie.UpdatedAt, &movie.Version)
+		if err != nil {
+			return fmt.Errorf("movies: insert batch: movie %d: %w", i, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("movies: insert batch: %w", err)
+	}
+	return nil
 }
 
 // Add a placeholder method for fetching a specific record from the movies table.
 func (m MovieModel) Get(id int64) (*Movie, error) {
+	return m.get(id, false)
+}
+
+// GetIncludingDeleted() is like Get(), except it also returns the movie if it has been
+// soft-deleted. The Deleted and DeletedAt fields say whether it has.
+
+func (m MovieModel) GetIncludingDeleted(id int64) (*Movie, error) {
+	return m.get(id, true)
+}
+
+func (m MovieModel) get(id int64, includeDeleted bool) (*Movie, error) {
 	// The PostgresSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shortcut
 	// and return an ErrRecordNotFound error straight away.
 
 	if id < 1 {
-		return nil, ErrRecordNotFound
+		return nil, fmt.Errorf("movies: get id=%d: %w", id, ErrRecordNotFound)
 	}
 
 	// Define the SQL query for retriveing the movie data.
 	query := `
-	SELECT id, created_at, title, year, runtime, genres, version
+	SELECT id, created_at, title, year, runtime, genres, featured, tags, updated_at,
+	    deleted_at, version
 	FROM movies
-	WHERE id = $1
+	WHERE id = $1 AND (deleted_at IS NULL OR $2)
 	`
 
 	// Declare a Movie struct to hold the data returned by the query.
@@ -114,7 +365,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	// carries a 3-second timeout deadline. Note that we're using theempty context.Background()
 	// as the 'parent' context.
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
 
 	// Importatnly, use defer to make sure that we cancel the context before the Get() method returns
 	defer cancel()
@@ -124,13 +375,17 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	// movie struct. Importantly, notice that we need to convert the scan target for the
 	// geners column using the pq.Array() adapter function again.
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id, includeDeleted).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.Featured,
+		&movie.Tags,
+		&movie.UpdatedAt,
+		&movie.DeletedAt,
 		&movie.Version,
 	)
 	// Handle any errors. If there was no matching movie found, Scan() will return
@@ -140,11 +395,14 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
+			return nil, fmt.Errorf("movies: get id=%d: %w", id, ErrRecordNotFound)
 		default:
-			return nil, err
+			return nil, fmt.Errorf("movies: get id=%d: %w", id, err)
 		}
 	}
+	movie.Deleted = movie.DeletedAt != nil
+	m.sortGenres(&movie)
+
 	// Otherwise, return a pointer to the movie struct.
 	return &movie, nil
 }
@@ -155,9 +413,10 @@ func (m MovieModel) Update(movie *Movie) error {
 	// Add the 'AND version = $6' clause to the SQL query.
 
 	query := `UPDATE movies
-	SET title = $1, year = $2, runtime= $3, genres = $4, version = version +1
-	WHERE id = $5 AND version = $6
-	RETURNING version`
+	SET title = $1, year = $2, runtime= $3, genres = $4, featured = $5, tags = $6,
+	    updated_at = NOW(), version = version +1
+	WHERE id = $7 AND version = $8 AND deleted_at IS NULL
+	RETURNING updated_at, version`
 
 	// Create an args slice containing the values for the placeholder parameters.
 
@@ -166,6 +425,8 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Year,
 		movie.Runtime,
 		pq.Array(movie.Genres),
+		movie.Featured,
+		movie.Tags,
 		movie.ID,
 		movie.Version, // Add the expected movie version.
 	}
@@ -179,41 +440,48 @@ func (m MovieModel) Update(movie *Movie) error {
 
 	// Create a contex with a 3-second timeout.
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
 	defer cancel()
 
 	// err := m.DB.QueryRow(query, args...).Scan(&movie.Version)
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.UpdatedAt, &movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
+			return fmt.Errorf("movies: update id=%d: %w", movie.ID, ErrEditConflict)
 		default:
-			return err
+			return fmt.Errorf("movies: update id=%d: %w", movie.ID, err)
 		}
 	}
 	return nil
 
 }
 
+// Delete() soft-deletes a movie by setting its deleted_at timestamp, so that it can be
+// restored later. Soft-deleted movies are left out of every other query, apart from
+// GetIncludingDeleted(). The version is bumped too, so that an update based on the
+// movie before it was deleted fails even after it has been restored.
+
 func (m MovieModel) Delete(id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
-		return ErrRecordNotFound
+		return fmt.Errorf("movies: delete id=%d: %w", id, ErrRecordNotFound)
 	}
 
-	// Construct the SQL Query to delete the record.
+	// Construct the SQL Query to soft-delete the record. A movie which has already been
+	// deleted doesn't match, so deleting it again returns ErrRecordNotFound.
 	query := `
-	DELETE FROM movies
-	WHERE id = $1
+	UPDATE movies
+	SET deleted_at = NOW(), version = version + 1
+	WHERE id = $1 AND deleted_at IS NULL
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
 	defer cancel()
 	// Execute the SQL query using the Exec() method, passing in the id variable as the value for the placeholder parameter. The Exec() method returns a sql.Result object.
 
 	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
-		return err
+		return fmt.Errorf("movies: delete id=%d: %w", id, err)
 	}
 
 	// Call the RowsAffected() method on the sql.Result object to get the number of rows
@@ -221,22 +489,77 @@ func (m MovieModel) Delete(id int64) error {
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return fmt.Errorf("movies: delete id=%d: %w", id, err)
+	}
+
+	// If no rows were affected, we know that the movies table didn't contain a
+	// (non-deleted) record with the provided ID at the moment we tried to delete it. In
+	// that case we return an ErrRecordNotFound error.
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("movies: delete id=%d: %w", id, ErrRecordNotFound)
+	}
+	return nil
+}
+
+// Restore() undoes Delete(), clearing a movie's deleted_at timestamp. It returns
+// ErrRecordNotFound if there's no movie with the ID, or it hasn't been deleted.
+
+func (m MovieModel) Restore(id int64) error {
+	if id < 1 {
+		return fmt.Errorf("movies: restore id=%d: %w", id, ErrRecordNotFound)
+	}
+
+	query := `
+	UPDATE movies
+	SET deleted_at = NULL, version = version + 1
+	WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("movies: restore id=%d: %w", id, err)
 	}
 
-	// If no rows were affected, we know that the movies table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case
-	// we return an ErrRecordNotFound error.
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("movies: restore id=%d: %w", id, err)
+	}
 
 	if rowsAffected == 0 {
-		return ErrRecordNotFound
+		return fmt.Errorf("movies: restore id=%d: %w", id, ErrRecordNotFound)
 	}
 	return nil
 }
 
+// filterMovies() returns the WHERE conditions which GetAll(), ExportRows() and Count()
+// use to select the movies matching the title, genres and filters, along with the
+// arguments for them. The conditions use the placeholders $1 to $6, so a query which
+// needs more arguments appends them and numbers its own placeholders from $7.
+
+func (m MovieModel) filterMovies(title string, genres []string, filters Filters) (string, []any) {
+	where := fmt.Sprintf(`%s
+	AND (genres %s $2 OR $2 = '{}' OR ($2 IS NULL AND cardinality(genres) = 0))
+	AND deleted_at IS NULL
+	AND (year >= $3 OR $3 = 0)
+	AND (year <= $4 OR $4 = 0)
+	AND tags @> $5
+	AND ($6::timestamptz IS NULL OR created_at >= $6)`, m.titleMatch(), filters.genresOperator())
+
+	args := []any{title, pq.Array(genres), filters.YearFrom, filters.YearTo, filters.tagFilter(),
+		filters.createdAfter()}
+
+	return where, args
+}
+
 // Creat a new GetAll() method which returns a slice of movies. Although we're not
 // using them right now, we've set this up to accept the avrious filter parameters
 // as arguments.
+//
+// An empty (but non-nil) genres slice matches every movie, while a nil slice matches
+// only movies which have no genres.
 
 func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
 	// Construct the SQL query to retrieve all move records.
@@ -253,30 +576,33 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// Importantly notice that we also include a secondary sort
 	// on the movie ID to ensure a consistent ordering.
 
+	// The filters are shared with ExportRows() and Count(), and use the placeholders
+	// $1 to $6, so the LIMIT and OFFSET come after them.
+	where, args := m.filterMovies(title, genres, filters)
+
 	query := fmt.Sprintf(`
-        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, featured,
+            tags, updated_at, version
         FROM movies
-        WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
-        AND (genres @> $2 OR $2 = '{}')     
-        ORDER BY %s %s, id ASC
-        LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+        WHERE %s
+        ORDER BY %s, id ASC
+        LIMIT $7 OFFSET $8`, where, filters.orderBy())
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
 	defer cancel()
 
-	// As our SQL wuery now has quite a few placeholder parameters, let's collect the
-	// values for the placeholders in a slice. Notice here how we call the limit() and
-	// offset() methods on the Filters struct to get the appropriate values for the
-	// LIMIT and OFFSET clauses.
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	// Add the values for the LIMIT and OFFSET placeholders to the filter arguments.
+	// Notice here how we call the limit() and offset() methods on the Filters struct to
+	// get the appropriate values for them.
+	args = append(args, filters.limit(), filters.offset())
 
 	// Use QueryContext to execute the query. This returns a sql.Rows resultset
 	// containing the result.
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, fmt.Errorf("movies: get all: %w", err)
 	}
 
 	// Importantly, defer a call to rows.Close() to ensure that the resultset is closed
@@ -302,12 +628,16 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.Featured,
+			&movie.Tags,
+			&movie.UpdatedAt,
 			&movie.Version,
 		)
 
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, Metadata{}, fmt.Errorf("movies: get all: %w", err)
 		}
+		m.sortGenres(&movie)
 
 		// Add the movie struct to the slice.
 		movies = append(movies, &movie)
@@ -317,7 +647,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	//that was encountered during the iteration.
 
 	if err = rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, fmt.Errorf("movies: get all: %w", err)
 	}
 
 	// Generte a Metadata struct, passing in the total record count and pagination
@@ -328,3 +658,278 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// If everything went OK, then return the slice of movies.
 	return movies, metadata, nil
 }
+
+// ExportRows() runs the same query as GetAll(), but without the pagination, and returns
+// the rows rather than reading them into memory, so that large exports can be streamed
+// to the client. Use ScanExportRow() to read each row, and close the rows when done.
+// There is no timeout other than ctx, as an export takes as long as the client takes to
+// read it.
+
+func (m MovieModel) ExportRows(ctx context.Context, title string, genres []string, filters Filters) (*sql.Rows, error) {
+	where, args := m.filterMovies(title, genres, filters)
+
+	query := fmt.Sprintf(`
+	SELECT id, title, year, runtime, genres, version
+	FROM movies
+	WHERE %s
+	ORDER BY %s, id ASC`, where, filters.orderBy())
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("movies: export: %w", err)
+	}
+	return rows, nil
+}
+
+// ScanExportRow() reads the current row from ExportRows() into a movie. Only the ID,
+// title, year, runtime, genres and version are set.
+
+func (m MovieModel) ScanExportRow(rows *sql.Rows) (*Movie, error) {
+	var movie Movie
+
+	err := rows.Scan(
+		&movie.ID,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("movies: export: %w", err)
+	}
+	m.sortGenres(&movie)
+	return &movie, nil
+}
+
+// Count() returns the number of movies matching the same filters as GetAll(), including
+// the nil genres behaviour. The pagination and sort order are ignored. It returns 0 if
+// no movies match.
+
+func (m MovieModel) Count(title string, genres []string, filters Filters) (int, error) {
+	where, args := m.filterMovies(title, genres, filters)
+
+	query := fmt.Sprintf(`
+	SELECT count(*)
+	FROM movies
+	WHERE %s`, where)
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("movies: count: %w", err)
+	}
+
+	return count, nil
+}
+
+// The operations which UpdateGenres() can apply.
+const (
+	GenreOpAdd    = "add"
+	GenreOpRemove = "remove"
+)
+
+// UpdateGenres() adds a genre to, or removes a genre from, every movie matching the same
+// title and genres filters as GetAll(), in a single UPDATE statement. It returns the
+// number of movies which were changed. Movies which already have (or don't have) the
+// genre are left alone, as are movies the change would leave with more than MaxGenres
+// or no genres at all, so the genres_length_check constraint is never violated.
+
+func (m MovieModel) UpdateGenres(title string, genres []string, op, genre string) (int64, error) {
+	var set, where string
+	args := []any{title, pq.Array(genres), genre}
+
+	switch op {
+	case GenreOpAdd:
+		set = "array_append(genres, $3)"
+		where = "NOT ($3 = ANY(genres)) AND cardinality(genres) < $4"
+		args = append(args, MaxGenres)
+	case GenreOpRemove:
+		set = "array_remove(genres, $3)"
+		where = "$3 = ANY(genres) AND cardinality(genres) > 1"
+	default:
+		return 0, fmt.Errorf("movies: update genres: unknown operation %q", op)
+	}
+
+	query := fmt.Sprintf(`
+	UPDATE movies
+	SET genres = %s, updated_at = NOW(), version = version + 1
+	WHERE %s
+	AND (genres @> $2 OR $2 = '{}' OR ($2 IS NULL AND cardinality(genres) = 0))
+	AND deleted_at IS NULL
+	AND %s`, set, m.titleMatch(), where)
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("movies: update genres %s %q: %w", op, genre, err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("movies: update genres %s %q: %w", op, genre, err)
+	}
+
+	return affected, nil
+}
+
+// GetFeatured() returns a page of the movies which have been flagged as featured, with
+// the most recently updated ones first. Only the pagination values in filters are used;
+// the sort order is always updated_at DESC.
+
+func (m MovieModel) GetFeatured(filters Filters) ([]*Movie, Metadata, error) {
+	query := `
+	SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, featured,
+	    tags, updated_at, version
+	FROM movies
+	WHERE featured AND deleted_at IS NULL
+	ORDER BY updated_at DESC, id ASC
+	LIMIT $1 OFFSET $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, fmt.Errorf("movies: get featured: %w", err)
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+	totalRecords := 0
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Featured,
+			&movie.Tags,
+			&movie.UpdatedAt,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, fmt.Errorf("movies: get featured: %w", err)
+		}
+		m.sortGenres(&movie)
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, fmt.Errorf("movies: get featured: %w", err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
+
+// DuplicateGroup is a cluster of movies which are likely to be duplicates of each other.
+// IDs and Titles are in the same order.
+type DuplicateGroup struct {
+	IDs    []int64  `json:"ids"`
+	Titles []string `json:"titles"`
+}
+
+// FindDuplicates() returns groups of movies from the same year whose titles have a
+// trigram similarity of at least threshold (between 0 and 1). Pairs of similar movies
+// are chained together, so if A is similar to B and B is similar to C then all three
+// are in the same group. This requires the pg_trgm extension.
+
+func (m MovieModel) FindDuplicates(threshold float64) ([]DuplicateGroup, error) {
+	query := `
+	SELECT a.id, a.title, b.id, b.title
+	FROM movies a
+	INNER JOIN movies b ON a.year = b.year AND a.id < b.id
+	WHERE similarity(a.title, b.title) >= $1
+	AND a.deleted_at IS NULL AND b.deleted_at IS NULL
+	ORDER BY a.id, b.id`
+
+	// This compares every pair of movies from the same year, so use the bulk timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.bulk())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, threshold)
+	if err != nil {
+		return nil, fmt.Errorf("movies: find duplicates: %w", err)
+	}
+	defer rows.Close()
+
+	// Use a union-find structure to merge the similar pairs into groups. The parent map
+	// points each movie ID at another in the same group, and the root of each chain is
+	// the group's representative.
+	parent := make(map[int64]int64)
+	titles := make(map[int64]string)
+
+	var find func(id int64) int64
+	find = func(id int64) int64 {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+
+	var order []int64
+
+	for rows.Next() {
+		var (
+			aID, bID       int64
+			aTitle, bTitle string
+		)
+
+		err := rows.Scan(&aID, &aTitle, &bID, &bTitle)
+		if err != nil {
+			return nil, fmt.Errorf("movies: find duplicates: %w", err)
+		}
+
+		for _, id := range []int64{aID, bID} {
+			if _, ok := parent[id]; !ok {
+				parent[id] = id
+				order = append(order, id)
+			}
+		}
+		titles[aID] = aTitle
+		titles[bID] = bTitle
+
+		parent[find(bID)] = find(aID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("movies: find duplicates: %w", err)
+	}
+
+	// Collect the groups, keeping them (and the movies in them) in ID order.
+	slices.Sort(order)
+
+	groups := []DuplicateGroup{}
+	index := make(map[int64]int)
+
+	for _, id := range order {
+		root := find(id)
+
+		i, ok := index[root]
+		if !ok {
+			i = len(groups)
+			index[root] = i
+			groups = append(groups, DuplicateGroup{})
+		}
+
+		groups[i].IDs = append(groups[i].IDs, id)
+		groups[i].Titles = append(groups[i].Titles, titles[id])
+	}
+
+	return groups, nil
+}
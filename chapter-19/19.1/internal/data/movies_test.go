@@ -0,0 +1,832 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestMovieModelFeatured(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	featured := insertTestMovie(t, m, "Moana")
+	insertTestMovie(t, m, "Black Panther")
+
+	// Toggle the featured flag on via an update.
+	featured.Featured = true
+	err := m.Update(featured)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.Get(featured.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Featured {
+		t.Errorf("got featured %t; want true", got.Featured)
+	}
+
+	filters := Filters{Page: 1, PageSize: 20}
+
+	movies, metadata, err := m.GetFeatured(filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 1 || movies[0].ID != featured.ID {
+		t.Fatalf("got %d featured movies; want only movie %d", len(movies), featured.ID)
+	}
+	if metadata.TotalRecords != 1 {
+		t.Errorf("got total_records %d; want 1", metadata.TotalRecords)
+	}
+
+	// And toggle it off again.
+	got.Featured = false
+	err = m.Update(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movies, _, err = m.GetFeatured(filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 0 {
+		t.Errorf("got %d featured movies; want 0", len(movies))
+	}
+}
+
+func TestDiffMovies(t *testing.T) {
+	before := &Movie{
+		ID:      1,
+		Title:   "Moana",
+		Year:    2016,
+		Runtime: 107,
+		Genres:  []string{"animation", "adventure"},
+		Version: 1,
+	}
+
+	after := *before
+	after.Title = "Moana 2"
+	after.Runtime = 100
+
+	changes := DiffMovies(before, &after)
+
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes; want 2: %v", len(changes), changes)
+	}
+
+	want := map[string]FieldChange{
+		"title":   {Old: "Moana", New: "Moana 2"},
+		"runtime": {Old: Runtime(107), New: Runtime(100)},
+	}
+	for field, change := range want {
+		if changes[field] != change {
+			t.Errorf("got %s change %v; want %v", field, changes[field], change)
+		}
+	}
+
+	// Comparing a movie with itself should report nothing.
+	if changes := DiffMovies(before, before); len(changes) != 0 {
+		t.Errorf("got %d changes; want 0", len(changes))
+	}
+}
+
+func TestMovieModelCount(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	for _, movie := range []*Movie{
+		{Title: "Die Hard", Year: 1988, Runtime: 132, Genres: []string{"action"}},
+		{Title: "Speed", Year: 1994, Runtime: 116, Genres: []string{"action", "thriller"}},
+		{Title: "Amelie", Year: 2001, Runtime: 122, Genres: []string{"romance"}},
+	} {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}}
+
+	for _, genres := range [][]string{{}, {"action"}, {"action", "thriller"}, {"horror"}} {
+		count, err := m.Count("", genres, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		movies, _, err := m.GetAll("", genres, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != len(movies) {
+			t.Errorf("genres %v: got count %d; want %d", genres, count, len(movies))
+		}
+	}
+}
+
+func TestMovieModelGetAllGenresMatch(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	for _, movie := range []*Movie{
+		{Title: "Die Hard", Year: 1988, Runtime: 132, Genres: []string{"action"}},
+		{Title: "Speed", Year: 1994, Runtime: 116, Genres: []string{"action", "thriller"}},
+		{Title: "Amelie", Year: 2001, Runtime: 122, Genres: []string{"romance"}},
+	} {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		match      string
+		genres     []string
+		wantTitles []string
+	}{
+		{match: "", genres: []string{"action", "thriller"}, wantTitles: []string{"Speed"}},
+		{match: GenresMatchAll, genres: []string{"action", "thriller"}, wantTitles: []string{"Speed"}},
+		{match: GenresMatchAny, genres: []string{"action", "thriller"}, wantTitles: []string{"Die Hard", "Speed"}},
+		{match: GenresMatchAny, genres: []string{"thriller", "romance"}, wantTitles: []string{"Speed", "Amelie"}},
+		{match: GenresMatchAny, genres: []string{}, wantTitles: []string{"Die Hard", "Speed", "Amelie"}},
+	}
+
+	for _, tt := range tests {
+		filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}, GenresMatch: tt.match}
+
+		movies, _, err := m.GetAll("", tt.genres, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var titles []string
+		for _, movie := range movies {
+			titles = append(titles, movie.Title)
+		}
+		if !slices.Equal(titles, tt.wantTitles) {
+			t.Errorf("match %q, genres %v: got %v; want %v", tt.match, tt.genres, titles, tt.wantTitles)
+		}
+	}
+}
+
+func TestMovieModelGetAllCreatedAfter(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	old := &Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama"}}
+	recent := &Movie{Title: "Oppenheimer", Year: 2023, Runtime: 180, Genres: []string{"drama"}}
+	for _, movie := range []*Movie{old, recent} {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Backdate the first movie, as if it had been added years ago.
+	_, err := db.Exec("UPDATE movies SET created_at = '2020-01-01T00:00:00Z' WHERE id = $1", old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		createdAfter time.Time
+		wantTitles   []string
+	}{
+		{createdAfter: time.Time{}, wantTitles: []string{"Casablanca", "Oppenheimer"}},
+		{createdAfter: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), wantTitles: []string{"Casablanca", "Oppenheimer"}},
+		{createdAfter: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), wantTitles: []string{"Oppenheimer"}},
+		{createdAfter: time.Now().Add(time.Hour), wantTitles: nil},
+	}
+
+	for _, tt := range tests {
+		filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}, CreatedAfter: tt.createdAfter}
+
+		movies, _, err := m.GetAll("", []string{}, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var titles []string
+		for _, movie := range movies {
+			titles = append(titles, movie.Title)
+		}
+		if !slices.Equal(titles, tt.wantTitles) {
+			t.Errorf("created after %v: got %v; want %v", tt.createdAfter, titles, tt.wantTitles)
+		}
+	}
+}
+
+func TestMovieModelFindDuplicates(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	var ids []int64
+	for _, movie := range []*Movie{
+		{Title: "The Matrix", Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}},
+		{Title: "The Matrix.", Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}},
+		{Title: "Matrix, The", Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}},
+		// Similar title but a different year, so not a duplicate.
+		{Title: "The Matrix", Year: 2021, Runtime: 148, Genres: []string{"sci-fi"}},
+		{Title: "Notting Hill", Year: 1999, Runtime: 124, Genres: []string{"romance"}},
+	} {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, movie.ID)
+	}
+
+	groups, err := m.FindDuplicates(0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups; want 1: %+v", len(groups), groups)
+	}
+	if !slices.Equal(groups[0].IDs, ids[:3]) {
+		t.Errorf("got group %v; want %v", groups[0].IDs, ids[:3])
+	}
+}
+
+func TestMovieModelGetIncludingDeleted(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	movie := insertTestMovie(t, m, "Moana")
+
+	got, err := m.GetIncludingDeleted(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Deleted || got.DeletedAt != nil {
+		t.Errorf("got deleted %t, deleted_at %v; want false, nil", got.Deleted, got.DeletedAt)
+	}
+
+	_, err = db.Exec("UPDATE movies SET deleted_at = NOW() WHERE id = $1", movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Get(movie.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v from Get(); want ErrRecordNotFound", err)
+	}
+
+	got, err = m.GetIncludingDeleted(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Deleted || got.DeletedAt == nil {
+		t.Fatalf("got deleted %t, deleted_at %v; want true and a timestamp", got.Deleted, got.DeletedAt)
+	}
+
+	js, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(js, []byte(`"deleted":true`)) || !bytes.Contains(js, []byte(`"deleted_at":`)) {
+		t.Errorf("got JSON %s; want deleted marker and deleted_at", js)
+	}
+}
+
+func TestMovieModelInsertBatch(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	movies := []*Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		{Title: "Up", Year: 2009, Runtime: 96, Genres: []string{"animation"}},
+	}
+
+	err := m.InsertBatch(movies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, movie := range movies {
+		if movie.ID < 1 || movie.Version != 1 {
+			t.Errorf("got id %d, version %d for %q; want a generated id and version 1", movie.ID, movie.Version, movie.Title)
+		}
+	}
+
+	// A movie which the database rejects (the runtime violates the movies_runtime_check
+	// constraint) rolls back the whole batch.
+	rejected := []*Movie{
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action"}},
+		{Title: "Broken", Year: 2018, Runtime: -1, Genres: []string{"action"}},
+	}
+
+	err = m.InsertBatch(rejected)
+	if err == nil {
+		t.Fatal("got nil error; want an error")
+	}
+
+	var count int
+	err = db.QueryRow("SELECT count(*) FROM movies").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(movies) {
+		t.Errorf("got %d movies; want %d", count, len(movies))
+	}
+}
+
+func TestMovieModelDeleteAndRestore(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	movie := insertTestMovie(t, m, "Moana")
+
+	err := m.Delete(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The row is still there, but hidden from Get(), GetAll() and Update().
+	_, err = m.Get(movie.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v from Get(); want ErrRecordNotFound", err)
+	}
+
+	movies, _, err := m.GetAll("", []string{}, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 0 {
+		t.Errorf("got %d movies from GetAll(); want 0", len(movies))
+	}
+
+	deleted, err := m.GetIncludingDeleted(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted.Deleted {
+		t.Errorf("got deleted %t; want true", deleted.Deleted)
+	}
+
+	err = m.Update(deleted)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("got error %v from Update(); want ErrEditConflict", err)
+	}
+
+	// Deleting it again doesn't find it.
+	err = m.Delete(movie.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v from second Delete(); want ErrRecordNotFound", err)
+	}
+
+	err = m.Restore(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Deleted || got.Version <= deleted.Version {
+		t.Errorf("got deleted %t, version %d; want false and a version after %d", got.Deleted, got.Version, deleted.Version)
+	}
+
+	// Restoring a movie which isn't deleted doesn't find it.
+	err = m.Restore(movie.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v from second Restore(); want ErrRecordNotFound", err)
+	}
+}
+
+func TestMovieWithUpdates(t *testing.T) {
+	original := &Movie{
+		ID:      1,
+		Title:   "Moana",
+		Year:    2016,
+		Runtime: 107,
+		Genres:  []string{"animation", "adventure"},
+		Version: 1,
+	}
+
+	// An update with an invalid title and a duplicate genre.
+	title := ""
+	genres := []string{"animation", "animation"}
+
+	updated := original.WithUpdates(MovieUpdate{Title: &title, Genres: genres})
+
+	v := validator.New()
+	if ValidateMovie(v, updated); v.Valid() {
+		t.Fatal("expected the updated movie to fail validation")
+	}
+
+	// The original fetched movie must be untouched.
+	if original.Title != "Moana" {
+		t.Errorf("got original title %q; want %q", original.Title, "Moana")
+	}
+	if !slices.Equal(original.Genres, []string{"animation", "adventure"}) {
+		t.Errorf("got original genres %v; want unchanged", original.Genres)
+	}
+
+	// And changing the copy's genres in place mustn't leak back either.
+	updated = original.WithUpdates(MovieUpdate{})
+	updated.Genres[0] = "drama"
+	if original.Genres[0] != "animation" {
+		t.Errorf("got original genres %v; want unchanged", original.Genres)
+	}
+}
+
+func TestValidateMovieTitleLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		title   string
+		wantErr string
+	}{
+		{
+			name:  "Exactly the limit",
+			title: strings.Repeat("a", MaxTitleBytes),
+		},
+		{
+			name:    "One byte over",
+			title:   strings.Repeat("a", MaxTitleBytes+1),
+			wantErr: "must not be more than 500 bytes long",
+		},
+		{
+			// 166 three-byte characters plus two ASCII ones is exactly 500 bytes.
+			name:  "Multi-byte at the limit",
+			title: strings.Repeat("€", 166) + "ab",
+		},
+		{
+			// Only 167 characters, but 501 bytes.
+			name:    "Multi-byte over",
+			title:   strings.Repeat("€", 167),
+			wantErr: "must not be more than 500 bytes long",
+		},
+		{
+			// A three-byte character cut off after its first two bytes.
+			name:    "Truncated character",
+			title:   strings.Repeat("a", 497) + "€"[:2],
+			wantErr: "must be valid UTF-8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := &Movie{
+				Title:   tt.title,
+				Year:    2016,
+				Runtime: 107,
+				Genres:  []string{"animation"},
+			}
+
+			v := validator.New()
+			ValidateMovie(v, movie)
+
+			if got := v.Errors["title"]; got != tt.wantErr {
+				t.Errorf("got title error %q; want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMovieTooManyGenres(t *testing.T) {
+	movie := &Movie{
+		Title:   "Moana",
+		Year:    2016,
+		Runtime: 107,
+		Genres:  []string{"a", "b", "c", "d", "e", "f"},
+	}
+
+	v := validator.New()
+	ValidateMovie(v, movie)
+
+	// Every genre error is reported under the same key.
+	if got := v.Errors["genres"]; got != "must not contain more than 5 genres" {
+		t.Errorf("got genres error %q; want %q", got, "must not contain more than 5 genres")
+	}
+	if len(v.Errors) != 1 {
+		t.Errorf("got errors %v; want only the genres error", v.Errors)
+	}
+}
+
+func TestMovieModelGetAllMultiColumnSort(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	for _, movie := range []*Movie{
+		{Title: "Beta", Year: 2001, Runtime: 100, Genres: []string{"drama"}},
+		{Title: "Alpha", Year: 2001, Runtime: 100, Genres: []string{"drama"}},
+		{Title: "Gamma", Year: 2010, Runtime: 100, Genres: []string{"drama"}},
+	} {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filters := Filters{
+		Page:         1,
+		PageSize:     10,
+		Sort:         "-year,title",
+		SortSafeList: []string{"year", "title", "-year", "-title"},
+	}
+
+	movies, _, err := m.GetAll("", []string{}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var titles []string
+	for _, movie := range movies {
+		titles = append(titles, movie.Title)
+	}
+
+	want := []string{"Gamma", "Alpha", "Beta"}
+	if !slices.Equal(titles, want) {
+		t.Errorf("got order %v; want %v", titles, want)
+	}
+}
+
+func TestMovieModelGetAllSortDescending(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	for _, movie := range []*Movie{
+		{Title: "Middle", Year: 2005, Runtime: 100, Genres: []string{"drama"}},
+		{Title: "Oldest", Year: 1999, Runtime: 100, Genres: []string{"drama"}},
+		{Title: "Newest", Year: 2018, Runtime: 100, Genres: []string{"drama"}},
+	} {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filters := Filters{
+		Page:         1,
+		PageSize:     10,
+		Sort:         "-year",
+		SortSafeList: []string{"id", "year", "-id", "-year"},
+	}
+
+	movies, _, err := m.GetAll("", []string{}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var years []int32
+	for _, movie := range movies {
+		years = append(years, movie.Year)
+	}
+
+	want := []int32{2018, 2005, 1999}
+	if !slices.Equal(years, want) {
+		t.Errorf("got years %v; want %v", years, want)
+	}
+}
+
+func TestMovieModelGetAllYearRange(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	for _, movie := range []*Movie{
+		{Title: "Groundhog Day", Year: 1993, Runtime: 101, Genres: []string{"comedy"}},
+		{Title: "Heat", Year: 1995, Runtime: 170, Genres: []string{"crime"}},
+		{Title: "The Matrix", Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}},
+		{Title: "Memento", Year: 2000, Runtime: 113, Genres: []string{"thriller"}},
+	} {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		from, to int
+		want     []string
+	}{
+		{name: "Range", from: 1994, to: 1999, want: []string{"Heat", "The Matrix"}},
+		{name: "From only", from: 1999, want: []string{"The Matrix", "Memento"}},
+		{name: "To only", to: 1993, want: []string{"Groundhog Day"}},
+		{name: "Unbounded", want: []string{"Groundhog Day", "Heat", "The Matrix", "Memento"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := Filters{Page: 1, PageSize: 10, Sort: "year", SortSafeList: []string{"year"}, YearFrom: tt.from, YearTo: tt.to}
+
+			movies, _, err := m.GetAll("", []string{}, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var titles []string
+			for _, movie := range movies {
+				titles = append(titles, movie.Title)
+			}
+
+			if !slices.Equal(titles, tt.want) {
+				t.Errorf("got %v; want %v", titles, tt.want)
+			}
+		})
+	}
+}
+
+func TestMovieModelGetAllEmptyGenres(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	insertTestMovie(t, m, "Moana")
+	insertTestMovie(t, m, "Black Panther")
+
+	filters := Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: []string{"id"}}
+
+	// An empty genres filter matches every movie.
+	movies, _, err := m.GetAll("", []string{}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 2 {
+		t.Errorf("got %d movies for empty genres; want 2", len(movies))
+	}
+
+	// A nil genres filter matches only movies without genres, of which there are none.
+	movies, _, err = m.GetAll("", nil, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 0 {
+		t.Errorf("got %d movies for nil genres; want 0", len(movies))
+	}
+}
+
+func TestMovieModelGetAllMetadata(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	for _, title := range []string{"Moana", "Black Panther", "Deadpool"} {
+		insertTestMovie(t, m, title)
+	}
+
+	filters := Filters{Page: 2, PageSize: 2, Sort: "id", SortSafeList: []string{"id"}}
+
+	movies, metadata, err := m.GetAll("", []string{}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 1 {
+		t.Errorf("got %d movies on page 2; want 1", len(movies))
+	}
+
+	want := Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 2, TotalRecords: 3}
+	if metadata != want {
+		t.Errorf("got metadata %+v; want %+v", metadata, want)
+	}
+
+	// A filter which matches nothing still reports the requested page, with no records.
+	_, metadata, err = m.GetAll("Casablanca", []string{}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 1, TotalRecords: 0}
+	if metadata != want {
+		t.Errorf("got metadata %+v; want %+v", metadata, want)
+	}
+}
+
+func TestMovieModelUpdateGenres(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	movies := []*Movie{
+		{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance"}},
+		{Title: "Vertigo", Year: 1958, Runtime: 128, Genres: []string{"drama", "thriller"}},
+		{Title: "Rear Window", Year: 1954, Runtime: 112, Genres: []string{"drama", "classic"}},
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+	}
+	for _, movie := range movies {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rear Window already has the genre, so only two of the three dramas change.
+	affected, err := m.UpdateGenres("", []string{"drama"}, GenreOpAdd, "classic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected != 2 {
+		t.Errorf("got %d affected; want 2", affected)
+	}
+
+	want := map[string][]string{
+		"Casablanca":  {"drama", "romance", "classic"},
+		"Vertigo":     {"drama", "thriller", "classic"},
+		"Rear Window": {"drama", "classic"},
+		"Moana":       {"animation"},
+	}
+
+	for _, movie := range movies {
+		got, err := m.Get(movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got.Genres, want[movie.Title]) {
+			t.Errorf("%s: got genres %v; want %v", movie.Title, got.Genres, want[movie.Title])
+		}
+	}
+
+	// Removing a movie's only genre would break the genres_length_check constraint, so
+	// Moana is left alone.
+	affected, err = m.UpdateGenres("", []string{}, GenreOpRemove, "animation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected != 0 {
+		t.Errorf("got %d affected; want 0", affected)
+	}
+}
+
+func TestMovieView(t *testing.T) {
+	movie := &Movie{ID: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Version: 3}
+
+	tests := []struct {
+		name        string
+		view        MovieView
+		wantVersion bool
+	}{
+		{name: "Full", view: MovieViewFull, wantVersion: true},
+		{name: "Public", view: MovieViewPublic, wantVersion: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := json.Marshal(movie.View(tt.view))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fields map[string]any
+			err = json.Unmarshal(js, &fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok := fields["version"]; ok != tt.wantVersion {
+				t.Errorf("got version present %t; want %t in %s", ok, tt.wantVersion, js)
+			}
+			if fields["title"] != "Moana" {
+				t.Errorf("got title %v; want Moana", fields["title"])
+			}
+		})
+	}
+}
+
+func TestMovieModelAccentInsensitiveSearch(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db, AccentInsensitive: true}
+
+	for _, title := range []string{"Amélie", "Amelie", "Die Hard"} {
+		insertTestMovie(t, m, title)
+	}
+
+	filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}}
+
+	for _, query := range []string{"amelie", "Amélie", "AMÉLIE"} {
+		movies, _, err := m.GetAll(query, []string{}, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(movies) != 2 {
+			t.Errorf("query %q: got %d movies; want 2", query, len(movies))
+		}
+
+		count, err := m.Count(query, []string{}, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("query %q: got count %d; want 2", query, count)
+		}
+	}
+
+	// Without the option, accents still matter.
+	m.AccentInsensitive = false
+
+	movies, _, err := m.GetAll("amelie", []string{}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 1 {
+		t.Errorf("got %d movies; want 1", len(movies))
+	}
+}
@@ -3,8 +3,8 @@ package data
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"github.com/lib/pq"
-	"time"
 )
 
 // Define a Permissions slice, which we will use to hold the permissions code
@@ -25,8 +25,9 @@ func (p Permissions) Include(code string) bool {
 }
 
 // Define the PermissionModel type.
-type PermissionMoel struct {
-	DB *sql.DB
+type PermissionModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
 }
 
 // The GetAllForUser() method returns all permission codes for a specific user in a
@@ -34,20 +35,20 @@ type PermissionMoel struct {
 // It uses the standad pattern that we've already seen before for retrieving multiple data
 // rosw in a SQL query
 
-func (m PermissionMoel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 	SELECT permissions.code
 	FROM permissions
-	INNER JOIN users_permissions ON users_permissions.permission_id = permission.id
+	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
 	INNER JOIN users ON users_permissions.user_id = users.id
 	WHERE users.id = $1
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("permissions: get all for user id=%d: %w", userID, err)
 	}
 	defer rows.Close()
 
@@ -58,12 +59,12 @@ func (m PermissionMoel) GetAllForUser(userID int64) (Permissions, error) {
 
 		err := rows.Scan(&permission)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("permissions: get all for user id=%d: %w", userID, err)
 		}
 		permissions = append(permissions, permission)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("permissions: get all for user id=%d: %w", userID, err)
 	}
 	return permissions, nil
 }
@@ -72,14 +73,59 @@ func (m PermissionMoel) GetAllForUser(userID int64) (Permissions, error) {
 // variadic parameter for the codes so that we can assign multiple permissions in a
 // single call.
 
-func (m PermissionMoel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 	INSERT INTO users_permissions
 	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	if err != nil {
+		return fmt.Errorf("permissions: add for user id=%d: %w", userID, err)
+	}
+	return nil
+}
+
+// Missing() returns those of the provided permission codes which don't exist in the
+// permissions table, for example because a migration hasn't been run.
+
+func (m PermissionModel) Missing(codes ...string) ([]string, error) {
+	query := `
+	SELECT code
+	FROM permissions
+	WHERE code = ANY($1)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(codes))
+	if err != nil {
+		return nil, fmt.Errorf("permissions: missing: %w", err)
+	}
+	defer rows.Close()
+
+	var existing Permissions
+
+	for rows.Next() {
+		var code string
+
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, fmt.Errorf("permissions: missing: %w", err)
+		}
+		existing = append(existing, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("permissions: missing: %w", err)
+	}
+
+	var missing []string
+	for _, code := range codes {
+		if !existing.Include(code) {
+			missing = append(missing, code)
+		}
+	}
+	return missing, nil
 }
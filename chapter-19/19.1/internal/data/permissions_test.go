@@ -0,0 +1,34 @@
+package data
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPermissionModelGetAllForUser(t *testing.T) {
+	db := newTestDB(t)
+	users := UserModel{DB: db}
+	permissions := PermissionModel{DB: db}
+
+	user := insertTestUser(t, users, "alice@example.com")
+	other := insertTestUser(t, users, "bob@example.com")
+
+	err := permissions.AddForUser(user.ID, "movies:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = permissions.AddForUser(other.ID, "movies:read", "movies:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Permissions{"movies:read"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got permissions %v; want %v", got, want)
+	}
+}
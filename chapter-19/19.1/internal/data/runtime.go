@@ -1,6 +1,7 @@
 package data
 
 import (
+	"encoding/xml"
 	"errors" // New import
 	"fmt"
 	"strconv"
@@ -32,6 +33,13 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 	return []byte(quotedJSONValue), nil
 }
 
+// MarshalXML() encodes the runtime in the same "<runtime> mins" format as MarshalJSON(),
+// for clients which ask for XML responses.
+
+func (r Runtime) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(fmt.Sprintf("%d mins", r), start)
+}
+
 // Implement a UnmarshalJSON() method on the Runtime type so that it
 // satisfies the json.Unmarshaler interface. IMPORTANT: Becasue UnmarshalJSON() needs to modify
 // the receiver (our Runtime type), we must use a pointer receiver for this to work correctly.
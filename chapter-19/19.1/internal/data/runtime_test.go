@@ -0,0 +1,50 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRuntimeMarshalJSON(t *testing.T) {
+	js, err := json.Marshal(Runtime(102))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := string(js), `"102 mins"`; got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
+
+func TestRuntimeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		js      string
+		want    Runtime
+		wantErr error
+	}{
+		{name: "Valid", js: `"107 mins"`, want: 107},
+		{name: "Missing unit", js: `"107"`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "Bare number", js: `107`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "Wrong unit", js: `"107 minutes"`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "Not a number", js: `"many mins"`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "Out of range", js: `"99999999999 mins"`, wantErr: ErrInvalidRuntimeFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input struct {
+				Runtime Runtime `json:"runtime"`
+			}
+
+			err := json.Unmarshal([]byte(`{"runtime": `+tt.js+`}`), &input)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if input.Runtime != tt.want {
+				t.Errorf("got %d; want %d", input.Runtime, tt.want)
+			}
+		})
+	}
+}
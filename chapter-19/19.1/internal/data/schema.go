@@ -0,0 +1,50 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the number of the newest migration in the migrations directory, which
+// is the schema version this code expects the database to be at. Remember to bump it
+// when adding a migration.
+const SchemaVersion = 14
+
+// SchemaModel reads the state of the migrations applied to the database.
+type SchemaModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Version() returns the version of the last migration applied to the database and
+// whether it failed part way through (which golang-migrate calls "dirty"). It returns
+// ErrRecordNotFound if no migrations have been applied.
+
+func (m SchemaModel) Version() (int, bool, error) {
+	query := `
+	SELECT version, dirty
+	FROM schema_migrations
+	LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
+	defer cancel()
+
+	var (
+		version int
+		dirty   bool
+	)
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, fmt.Errorf("schema: version: %w", ErrRecordNotFound)
+		default:
+			return 0, false, fmt.Errorf("schema: version: %w", err)
+		}
+	}
+
+	return version, dirty, nil
+}
@@ -0,0 +1,30 @@
+package data
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSchemaVersionMatchesMigrations(t *testing.T) {
+	ups, err := filepath.Glob("../../migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newest := 0
+	for _, up := range ups {
+		prefix, _, _ := strings.Cut(filepath.Base(up), "_")
+
+		n, err := strconv.Atoi(prefix)
+		if err != nil {
+			t.Fatalf("bad migration file name %q", up)
+		}
+		newest = max(newest, n)
+	}
+
+	if newest != SchemaVersion {
+		t.Errorf("got SchemaVersion %d; newest migration is %d", SchemaVersion, newest)
+	}
+}
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strings"
+
+	"greelight.techkunstler.com/internal/validator"
+)
+
+// Limits on the free-form tags a movie can have. Keys can't contain a colon, because
+// the tag filter uses one to separate the key from the value.
+const (
+	MaxTags          = 20
+	MaxTagKeyBytes   = 50
+	MaxTagValueBytes = 200
+)
+
+// Tags holds a movie's free-form key/value metadata, like {"language": "french"}. It is
+// stored in the jsonb tags column.
+type Tags map[string]string
+
+// Value() implements the driver.Valuer interface, encoding the tags as a JSON object. A
+// nil map is stored as an empty object, to match the column default.
+
+func (t Tags) Value() (driver.Value, error) {
+	if t == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]string(t))
+}
+
+// Scan() implements the sql.Scanner interface, decoding the JSON object from the
+// database. An empty object gives a nil map, so that the tags are left out of responses.
+
+func (t *Tags) Scan(src any) error {
+	var b []byte
+
+	switch src := src.(type) {
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	case nil:
+		*t = nil
+		return nil
+	default:
+		return fmt.Errorf("tags: cannot scan %T", src)
+	}
+
+	var m map[string]string
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return fmt.Errorf("tags: %w", err)
+	}
+
+	if len(m) == 0 {
+		m = nil
+	}
+	*t = m
+	return nil
+}
+
+// MarshalXML() encodes the tags as a tag element for each key, in key order, like
+// <tags><tag key="language">french</tag></tags>. XML has no equivalent of a JSON object,
+// and encoding/xml can't encode maps.
+
+func (t Tags) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		tag := xml.StartElement{
+			Name: xml.Name{Local: "tag"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+		}
+		err = e.EncodeElement(t[key], tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// ValidateTags() checks the number of tags and the length of each key and value.
+
+func ValidateTags(v *validator.Validator, tags Tags) {
+	v.Check(len(tags) <= MaxTags, "tags", fmt.Sprintf("must not contain more than %d tags", MaxTags))
+
+	for key, value := range tags {
+		v.Check(key != "", "tags", "must not have an empty key")
+		v.Check(!strings.Contains(key, ":"), "tags", "must not have a key containing a colon")
+		v.Check(len(key) <= MaxTagKeyBytes, "tags", fmt.Sprintf("must not have a key more than %d bytes long", MaxTagKeyBytes))
+		v.Check(len(value) <= MaxTagValueBytes, "tags", fmt.Sprintf("must not have a value more than %d bytes long", MaxTagValueBytes))
+	}
+}
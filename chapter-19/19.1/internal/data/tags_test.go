@@ -0,0 +1,161 @@
+package data
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestValidateTags(t *testing.T) {
+	tooMany := make(Tags)
+	for i := range MaxTags + 1 {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+
+	tests := []struct {
+		name    string
+		tags    Tags
+		wantErr string
+	}{
+		{name: "None"},
+		{name: "Some", tags: Tags{"language": "french", "colour": ""}},
+		{name: "Too many", tags: tooMany, wantErr: "must not contain more than 20 tags"},
+		{name: "Empty key", tags: Tags{"": "french"}, wantErr: "must not have an empty key"},
+		{name: "Colon in key", tags: Tags{"lang:uage": "french"}, wantErr: "must not have a key containing a colon"},
+		{name: "Long key", tags: Tags{strings.Repeat("k", MaxTagKeyBytes+1): "v"}, wantErr: "must not have a key more than 50 bytes long"},
+		{name: "Long value", tags: Tags{"k": strings.Repeat("v", MaxTagValueBytes+1)}, wantErr: "must not have a value more than 200 bytes long"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateTags(v, tt.tags)
+
+			if got := v.Errors["tags"]; got != tt.wantErr {
+				t.Errorf("got tags error %q; want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTagsValueAndScan(t *testing.T) {
+	value, err := Tags(nil).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value.([]byte)) != "{}" {
+		t.Errorf("got nil tags value %s; want {}", value)
+	}
+
+	value, err = Tags{"language": "french"}.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tags Tags
+	err = tags.Scan(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(tags, Tags{"language": "french"}) {
+		t.Errorf("got %v; want map[language:french]", tags)
+	}
+
+	// An empty object scans to nil, so that it's left out of responses.
+	err = tags.Scan([]byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags != nil {
+		t.Errorf("got %v; want nil", tags)
+	}
+}
+
+func TestFiltersValidateTag(t *testing.T) {
+	tests := []struct {
+		tag     string
+		wantErr string
+	}{
+		{tag: ""},
+		{tag: "language:french"},
+		{tag: "colour:"},
+		{tag: "language", wantErr: "must be in the form key:value"},
+		{tag: ":french", wantErr: "must be in the form key:value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			v := validator.New()
+			DefaultFilterConfig.Validate(v, Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: []string{"id"}, Tag: tt.tag})
+
+			if got := v.Errors["tag"]; got != tt.wantErr {
+				t.Errorf("got tag error %q; want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMovieModelTags(t *testing.T) {
+	db := newTestDB(t)
+	m := MovieModel{DB: db}
+
+	amelie := &Movie{Title: "Amélie", Year: 2001, Runtime: 122, Genres: []string{"comedy"}, Tags: Tags{"language": "french", "colour": "yes"}}
+	heat := &Movie{Title: "Heat", Year: 1995, Runtime: 170, Genres: []string{"crime"}, Tags: Tags{"language": "english"}}
+	memento := &Movie{Title: "Memento", Year: 2000, Runtime: 113, Genres: []string{"thriller"}}
+
+	for _, movie := range []*Movie{amelie, heat, memento} {
+		err := m.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := m.Get(amelie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(got.Tags, amelie.Tags) {
+		t.Errorf("got tags %v; want %v", got.Tags, amelie.Tags)
+	}
+
+	// Updating replaces the tags.
+	updated := got.WithUpdates(MovieUpdate{Tags: Tags{"language": "french"}})
+	err = m.Update(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tag  string
+		want []string
+	}{
+		{tag: "", want: []string{"Amélie", "Heat", "Memento"}},
+		{tag: "language:french", want: []string{"Amélie"}},
+		{tag: "language:english", want: []string{"Heat"}},
+		{tag: "colour:yes", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			filters := Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: []string{"id"}, Tag: tt.tag}
+
+			movies, _, err := m.GetAll("", []string{}, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var titles []string
+			for _, movie := range movies {
+				titles = append(titles, movie.Title)
+			}
+
+			if !slices.Equal(titles, tt.want) {
+				t.Errorf("got %v; want %v", titles, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package data
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// newTestDB() returns a connection pool to a fresh copy of the greenlight schema. The
+// DSN for the test database is read from the GREENLIGHT_TEST_DB_DSN environment
+// variable, and the test is skipped if it isn't set (or if the -short flag is used).
+// The schema is built by running the up migrations in order, and torn down again by
+// running the down migrations in reverse when the test finishes, so it always matches
+// what we deploy.
+
+func newTestDB(t *testing.T) *sql.DB {
+	// Skip the rest if the "-short" flag is provided when running the test.
+	if testing.Short() {
+		t.Skip("data: skipping integration test")
+	}
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("data: GREENLIGHT_TEST_DB_DSN not set, skipping integration test")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ups, err := filepath.Glob("../../migrations/*.up.sql")
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	downs, err := filepath.Glob("../../migrations/*.down.sql")
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	slices.Sort(ups)
+	slices.Sort(downs)
+	slices.Reverse(downs)
+
+	err = execScripts(db, append([]string{"./testdata/setup.sql"}, ups...)...)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	// Use t.Cleanup() to tear the schema down and close the connection pool once the
+	// current test (or sub-test) has finished.
+	t.Cleanup(func() {
+		defer db.Close()
+
+		err := execScripts(db, append(downs, "./testdata/teardown.sql")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	return db
+}
+
+// execScripts() reads and executes each of the SQL script files in order.
+
+func execScripts(db *sql.DB, paths ...string) error {
+	for _, path := range paths {
+		script, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec(string(script))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertTestMovie() inserts a valid movie with the given title, failing the test on
+// error.
+
+func insertTestMovie(t *testing.T, m MovieModel, title string) *Movie {
+	t.Helper()
+
+	movie := &Movie{
+		Title:   title,
+		Year:    2001,
+		Runtime: 120,
+		Genres:  []string{"drama"},
+	}
+
+	err := m.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return movie
+}
+
+// insertTestUser() inserts an activated user with the given email address, failing the
+// test on error.
+
+func insertTestUser(t *testing.T, m UserModel, email string) *User {
+	t.Helper()
+
+	user := &User{
+		Name:      "Test User",
+		Email:     email,
+		Activated: true,
+	}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
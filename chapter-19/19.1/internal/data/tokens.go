@@ -6,17 +6,19 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"fmt"
 	"time"
 
 	"greelight.techkunstler.com/internal/validator"
 )
 
-// Define constants for the token scope. For now we just define the scope "activation"
-// but we'll add additional scopes later in the book.
+// Define constants for the token scopes. A token can only be used for the scope it was
+// created with, so, for example, an activation token can't be used to authenticate.
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
 )
 
 type Token struct {
@@ -79,7 +81,8 @@ func ValidateTokenPlainText(v *validator.Validator, tokenPlainText string) {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Timeouts Timeouts
 }
 
 // The New() method is a shortcut which creates a new Token struct and then inserts the
@@ -105,13 +108,15 @@ func (m TokenModel) Insert(token *Token) error {
 
 	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
 
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
-
-	return err
+	if err != nil {
+		return fmt.Errorf("tokens: insert: %w", err)
+	}
+	return nil
 }
 
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
@@ -122,10 +127,13 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	WHERE scope = $1 AND user_id = $2
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
 
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
-	return err
+	if err != nil {
+		return fmt.Errorf("tokens: delete all for user id=%d: %w", userID, err)
+	}
+	return nil
 }
@@ -0,0 +1,90 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGeneratedTokenScopes(t *testing.T) {
+	for _, scope := range []string{ScopeActivation, ScopeAuthentication, ScopePasswordReset} {
+		token, err := generatedToken(42, time.Hour, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token.Scope != scope {
+			t.Errorf("got scope %q; want %q", token.Scope, scope)
+		}
+		if len(token.Plaintext) != 26 {
+			t.Errorf("%s: got %d byte plaintext; want 26", scope, len(token.Plaintext))
+		}
+	}
+}
+
+func TestTokenModelInsertAndDelete(t *testing.T) {
+	db := newTestDB(t)
+	users := UserModel{DB: db}
+	tokens := TokenModel{DB: db}
+
+	user := insertTestUser(t, users, "alice@example.com")
+
+	scopes := []string{ScopeActivation, ScopeAuthentication, ScopePasswordReset}
+
+	for i, scope := range scopes {
+		// New() inserts the token, so it should be possible to look the user up by it.
+		token, err := tokens.New(user.ID, time.Hour, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := users.GetForToken(scope, token.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID {
+			t.Errorf("%s: got user id %d; want %d", scope, got.ID, user.ID)
+		}
+
+		// Tokens are scoped, so the same plaintext mustn't work for another scope.
+		other := scopes[(i+1)%len(scopes)]
+		_, err = users.GetForToken(other, token.Plaintext)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("%s: got error %v for scope %s; want %v", scope, err, other, ErrRecordNotFound)
+		}
+
+		err = tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = users.GetForToken(scope, token.Plaintext)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("%s: got error %v after deleting; want %v", scope, err, ErrRecordNotFound)
+		}
+	}
+}
+
+func TestUserModelGetForTokenExpired(t *testing.T) {
+	db := newTestDB(t)
+	users := UserModel{DB: db}
+	tokens := TokenModel{DB: db}
+
+	user := insertTestUser(t, users, "alice@example.com")
+
+	token, err := tokens.New(user.ID, -time.Minute, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = users.GetForToken(ScopeAuthentication, token.Plaintext)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for an expired token; want %v", err, ErrRecordNotFound)
+	}
+
+	// A plaintext which was never issued isn't found either.
+	_, err = users.GetForToken(ScopeAuthentication, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for an unknown token; want %v", err, ErrRecordNotFound)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -79,6 +81,28 @@ func ValidateEmail(v *validator.Validator, email string) {
 
 }
 
+// ValidateRegistrationEmail() checks that the domain of an email address being used to
+// register a new account isn't in the blocked list (for example, disposable email
+// providers). Subdomains of a blocked domain are blocked too. Domains are compared
+// case-insensitively.
+
+func ValidateRegistrationEmail(v *validator.Validator, email string, blockedDomains []string) {
+	_, domain, found := strings.Cut(email, "@")
+	if !found {
+		return
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	for _, blocked := range blockedDomains {
+		blocked = strings.ToLower(strings.TrimSuffix(blocked, "."))
+
+		if domain == blocked || strings.HasSuffix(domain, "."+blocked) {
+			v.AddError("email", "this email domain is not allowed")
+			return
+		}
+	}
+}
+
 func ValidatePasswordPlainText(v *validator.Validator, password string) {
 	v.Check(password != "", "passwrod", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be atleast 8 bytes long")
@@ -112,7 +136,8 @@ func ValidateUser(v *validator.Validator, user *User) {
 // Create a UserModel struct which wraps the connection pool.
 
 type UserModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Timeouts Timeouts
 }
 
 // Insert a new record in the databasw for the user. Note that the id,
@@ -129,7 +154,7 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
 	defer cancel()
 
 	// If the table already contains a record with this email address, then when
@@ -143,9 +168,9 @@ func (m UserModel) Insert(user *User) error {
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates the unique constraint "user_email_key"`:
-			return ErrDuplicateEmail
+			return fmt.Errorf("users: insert: %w", ErrDuplicateEmail)
 		default:
-			return err
+			return fmt.Errorf("users: insert: %w", err)
 		}
 	}
 	return nil
@@ -164,7 +189,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -180,9 +205,9 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
+			return nil, fmt.Errorf("users: get by email: %w", ErrRecordNotFound)
 		default:
-			return nil, err
+			return nil, fmt.Errorf("users: get by email: %w", err)
 		}
 	}
 
@@ -212,7 +237,7 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.write())
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -220,11 +245,11 @@ func (m UserModel) Update(user *User) error {
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "user_email_key`:
-			return ErrDuplicateEmail
+			return fmt.Errorf("users: update id=%d: %w", user.ID, ErrDuplicateEmail)
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
+			return fmt.Errorf("users: update id=%d: %w", user.ID, ErrEditConflict)
 		default:
-			return err
+			return fmt.Errorf("users: update id=%d: %w", user.ID, err)
 		}
 	}
 	return nil
@@ -255,7 +280,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.read())
 	defer cancel()
 
 	// Execute the query, scanning hte return values into a User struct. If no matching
@@ -274,9 +299,9 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
+			return nil, fmt.Errorf("users: get for token scope=%s: %w", tokenScope, ErrRecordNotFound)
 		default:
-			return nil, err
+			return nil, fmt.Errorf("users: get for token scope=%s: %w", tokenScope, err)
 		}
 	}
 	// Return the matching user
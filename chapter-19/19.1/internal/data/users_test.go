@@ -0,0 +1,63 @@
+package data
+
+import (
+	"testing"
+
+	"greelight.techkunstler.com/internal/validator"
+)
+
+func TestValidateRegistrationEmail(t *testing.T) {
+	blocked := []string{"mailinator.com", "Example.ORG"}
+
+	tests := []struct {
+		name  string
+		email string
+		valid bool
+	}{
+		{
+			name:  "Allowed domain",
+			email: "alice@example.com",
+			valid: true,
+		},
+		{
+			name:  "Blocked domain",
+			email: "bob@mailinator.com",
+			valid: false,
+		},
+		{
+			name:  "Blocked domain mixed case",
+			email: "bob@MailInator.Com",
+			valid: false,
+		},
+		{
+			name:  "Blocked list entry mixed case",
+			email: "carol@example.org",
+			valid: false,
+		},
+		{
+			name:  "Subdomain of blocked domain",
+			email: "dave@eu.mailinator.com",
+			valid: false,
+		},
+		{
+			name:  "Domain ending with blocked name",
+			email: "erin@notmailinator.com",
+			valid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+
+			ValidateRegistrationEmail(v, tt.email, blocked)
+
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t; want %t (errors: %v)", v.Valid(), tt.valid, v.Errors)
+			}
+			if !tt.valid && v.Errors["email"] != "this email domain is not allowed" {
+				t.Errorf("got email error %q", v.Errors["email"])
+			}
+		})
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
+	"net"
+	"net/smtp"
+	"strconv"
 	"time"
 
 	"github.com/go-mail/mail/v2"
@@ -100,3 +103,39 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	}
 	return nil
 }
+
+// Verify() checks that the SMTP server can be reached, by connecting to it, sending a
+// NOOP command and disconnecting again. It doesn't authenticate or send any email, so a
+// nil error doesn't guarantee that sending will succeed, but an error means it
+// certainly won't.
+
+func (m Mailer) Verify() error {
+	addr := net.JoinHostPort(m.dialer.Host, strconv.Itoa(m.dialer.Port))
+
+	conn, err := net.DialTimeout("tcp", addr, m.dialer.Timeout)
+	if err != nil {
+		return err
+	}
+
+	// Make sure a server which accepts the connection but never responds can't block us
+	// for longer than the timeout.
+	err = conn.SetDeadline(time.Now().Add(m.dialer.Timeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, m.dialer.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	err = c.Noop()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
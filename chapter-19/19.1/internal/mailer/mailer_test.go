@@ -0,0 +1,96 @@
+package mailer
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newFakeSMTPServer() starts a minimal SMTP server which accepts a single connection
+// and understands just enough of the protocol for Verify(). It returns the host and port
+// it is listening on.
+
+func newFakeSMTPServer(t *testing.T) (string, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		reply := func(line string) {
+			rw.WriteString(line + "\r\n")
+			rw.Flush()
+		}
+
+		reply("220 localhost ESMTP fake")
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "NOOP":
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, p
+}
+
+func TestMailerVerify(t *testing.T) {
+	t.Run("Reachable", func(t *testing.T) {
+		host, port := newFakeSMTPServer(t)
+
+		m := New(host, port, "user", "pass", "test@example.com")
+
+		err := m.Verify()
+		if err != nil {
+			t.Errorf("got error %v; want nil", err)
+		}
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		// Grab a free port and close the listener straight away, so nothing is
+		// listening on it.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		m := New("127.0.0.1", port, "user", "pass", "test@example.com")
+
+		err = m.Verify()
+		if err == nil {
+			t.Error("got nil error; want a connection error")
+		}
+	})
+}
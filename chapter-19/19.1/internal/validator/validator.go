@@ -1,8 +1,12 @@
 package validator
 
 import (
+	"embed"
+	"encoding/json"
+	"path"
 	"regexp"
 	"slices"
+	"strings"
 )
 
 // Declare a regular expression for sanity checking the format of email addresses (we'll
@@ -14,14 +18,85 @@ var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
-// Define a new Validator type which contains a map of validation errors.
+// DefaultLocale is the language validation messages are written in.
+const DefaultLocale = "en"
+
+// The locales directory holds a JSON message catalog for each supported language other
+// than English. Each catalog maps the English message to its translation.
+//
+//go:embed "locales"
+var localeFS embed.FS
+
+var catalogs = mustLoadCatalogs()
+
+func mustLoadCatalogs() map[string]map[string]string {
+	files, err := localeFS.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+
+	catalogs := make(map[string]map[string]string)
+
+	for _, file := range files {
+		js, err := localeFS.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		var catalog map[string]string
+		err = json.Unmarshal(js, &catalog)
+		if err != nil {
+			panic(err)
+		}
+
+		catalogs[strings.TrimSuffix(file.Name(), ".json")] = catalog
+	}
+
+	return catalogs
+}
+
+// SupportedLocale returns true if validation messages can be produced in the locale.
+func SupportedLocale(locale string) bool {
+	_, ok := catalogs[locale]
+	return ok || locale == DefaultLocale
+}
+
+// DefaultMaxErrors is the number of errors a new Validator collects before it starts
+// dropping them.
+const DefaultMaxErrors = 50
+
+// Define a new Validator type which contains a map of validation errors. Once the map
+// holds MaxErrors entries (if MaxErrors is greater than zero) further errors are
+// dropped and Omitted is set, so that a hostile payload can't produce an arbitrarily
+// large error response.
 type Validator struct {
-	Errors map[string]string
+	Errors    map[string]string
+	MaxErrors int
+	Omitted   bool
+	locale    string
 }
 
 // New is a helper which creates a new Validator instance with an empty errors map.
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return NewLocalized(DefaultLocale)
+}
+
+// NewLocalized creates a new Validator instance which translates error messages into the
+// given locale (like "de"). Unsupported locales fall back to English.
+func NewLocalized(locale string) *Validator {
+	if !SupportedLocale(locale) {
+		locale = DefaultLocale
+	}
+	return &Validator{Errors: make(map[string]string), MaxErrors: DefaultMaxErrors, locale: locale}
+}
+
+// translate returns the message in the validator's locale, or unchanged if there is no
+// translation for it.
+func (v *Validator) translate(message string) string {
+	if translated, ok := catalogs[v.locale][message]; ok {
+		return translated
+	}
+	return message
 }
 
 // Valid returns true if the errors map doesn't contain any entries.
@@ -30,11 +105,16 @@ func (v *Validator) Valid() bool {
 }
 
 // AddError adds an error message to the map (so long as no entry already exists for
-// the given key).
+// the given key, and the map isn't full).
 func (v *Validator) AddError(key, message string) {
-	if _, exists := v.Errors[key]; !exists {
-		v.Errors[key] = message
+	if _, exists := v.Errors[key]; exists {
+		return
+	}
+	if v.MaxErrors > 0 && len(v.Errors) >= v.MaxErrors {
+		v.Omitted = true
+		return
 	}
+	v.Errors[key] = v.translate(message)
 }
 
 // Check adds an error message to the map only if a validation check is not 'ok'.
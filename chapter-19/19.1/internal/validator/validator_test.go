@@ -0,0 +1,87 @@
+package validator
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestNewLocalized(t *testing.T) {
+	tests := []struct {
+		name   string
+		locale string
+		want   string
+	}{
+		{
+			name:   "Supported locale",
+			locale: "de",
+			want:   "muss angegeben werden",
+		},
+		{
+			name:   "Default locale",
+			locale: "en",
+			want:   "must be provided",
+		},
+		{
+			name:   "Unknown locale falls back to English",
+			locale: "xx",
+			want:   "must be provided",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewLocalized(tt.locale)
+			v.Check(false, "title", "must be provided")
+
+			if got := v.Errors["title"]; got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLocalizedUntranslatedMessage(t *testing.T) {
+	v := NewLocalized("de")
+	v.AddError("page", "must be a maximum of 100")
+
+	// Messages missing from the catalog are left in English.
+	if got := v.Errors["page"]; got != "must be a maximum of 100" {
+		t.Errorf("got %q; want the original message", got)
+	}
+}
+
+func TestValidatorMaxErrors(t *testing.T) {
+	v := New()
+	v.MaxErrors = 3
+
+	for _, key := range []string{"a", "b", "c"} {
+		v.AddError(key, "must be provided")
+	}
+	if v.Omitted {
+		t.Fatal("got Omitted true before the limit was passed")
+	}
+
+	// Repeating an existing key isn't an extra error.
+	v.AddError("a", "must be provided")
+	if v.Omitted {
+		t.Fatal("got Omitted true for a repeated key")
+	}
+
+	v.AddError("d", "must be provided")
+	if len(v.Errors) != 3 {
+		t.Errorf("got %d errors; want 3", len(v.Errors))
+	}
+	if !v.Omitted {
+		t.Error("got Omitted false; want true")
+	}
+
+	// With no limit every error is kept.
+	v = New()
+	v.MaxErrors = 0
+	for i := range 100 {
+		v.AddError(strconv.Itoa(i), "must be provided")
+	}
+	if len(v.Errors) != 100 || v.Omitted {
+		t.Errorf("got %d errors and Omitted %t; want 100 and false", len(v.Errors), v.Omitted)
+	}
+}
@@ -0,0 +1,4 @@
+-- Add the permission used to guard the operational /v1/debug endpoints.
+INSERT INTO permissions (code)
+VALUES
+  ('admin:read');
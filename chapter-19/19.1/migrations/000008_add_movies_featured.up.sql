@@ -0,0 +1,4 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS featured boolean NOT NULL DEFAULT false;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS movies_featured_idx ON movies (updated_at DESC) WHERE featured;
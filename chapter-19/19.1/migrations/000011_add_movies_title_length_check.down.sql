@@ -0,0 +1 @@
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_title_length_check;
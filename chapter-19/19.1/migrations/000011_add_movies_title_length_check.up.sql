@@ -0,0 +1 @@
+ALTER TABLE movies ADD CONSTRAINT movies_title_length_check CHECK (octet_length(title) <= 500);
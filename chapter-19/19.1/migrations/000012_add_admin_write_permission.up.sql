@@ -0,0 +1,4 @@
+-- Add the permission used to guard the bulk catalog maintenance endpoints.
+INSERT INTO permissions (code)
+VALUES
+  ('admin:write');
@@ -0,0 +1,3 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS tags jsonb NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS movies_tags_idx ON movies USING GIN (tags);